@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"reporter/internal"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func printError(err error) {
+	fmt.Fprintln(os.Stderr, "Error:", err.Error())
+}
+
+// Returns context which is cancelled when the reporter is asked to terminate.
+func signalContext() context.Context {
+	ctx, _ := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	return ctx
+}
+
+// Finds config file unless its path was specified via CLI argument. Returns
+// false if there's none.
+func findConfig() bool {
+	if settings.ConfigJsonPath != "" {
+		return true
+	}
+
+	path, err := internal.SearchConfig(settings.SelfDir)
+	if err != nil {
+		printError(err)
+		return false
+	}
+	settings.ConfigJsonPath = path
+
+	return true
+}
+
+// Returns config overrides from "REPORTER_SET_*" env vars followed by those
+// from CLI arguments (which thus take precedence). Returns false if some of
+// them are invalid.
+func configOverrides() ([]internal.ConfigOverride, bool) {
+	overrides := internal.EnvConfigOverrides(os.Environ())
+
+	for _, arg := range settings.ConfigOverrides {
+		override, err := internal.ParseConfigOverride(arg)
+		if err != nil {
+			printError(err)
+			return nil, false
+		}
+		overrides = append(overrides, override)
+	}
+
+	return overrides, true
+}
+
+// Loads config from path specified via CLI argument or from the one we find
+// ourselves. Returns false if the config couldn't be loaded.
+func loadConfig() (internal.Config, bool) {
+	if !findConfig() {
+		return internal.Config{}, false
+	}
+
+	overrides, ok := configOverrides()
+	if !ok {
+		return internal.Config{}, false
+	}
+
+	config, err := internal.ReadConfig(settings.ConfigJsonPath, overrides...)
+	if err != nil {
+		printError(err)
+		return config, false
+	}
+	internal.RedactStandardLogger(config.Redactor())
+
+	return config, true
+}
+
+func newReporter(config internal.Config) *internal.Reporter {
+	reporter := &internal.Reporter{
+		ConfigJson: config,
+		HttpClient: &http.Client{
+			Timeout: 1 * time.Minute, // Payload requests will timeout after this.
+		},
+		StateDir:     settings.SelfDir,
+		Systemd:      settings.SystemdMode,
+		SetupLogging: configureLogging,
+	}
+
+	if settings.VerboseMode {
+		reporter.VerboseOutput = os.Stdout
+	}
+
+	return reporter
+}
+
+// Handles "reporter validate [--check-vars]".
+func commandValidate(checkVars bool) int {
+	config, ok := loadConfig()
+	if !ok {
+		return exitConfigError
+	}
+
+	if settings.VerboseMode {
+		for _, expr := range config.PayloadExpressions() {
+			fmt.Printf("%s: ${%s} needs %v\n", expr.Path, expr.Expression, expr.Variables)
+		}
+	}
+
+	if checkVars {
+		vars, failed := newReporter(config).Gather(signalContext())
+		for _, name := range failed {
+			fmt.Fprintf(os.Stderr, "Gatherer '%s' failed, its variables may be missing.\n", name)
+		}
+
+		if errs := config.CheckPayloadVariables(vars); len(errs) != 0 {
+			printError(errs)
+			return exitConfigError
+		}
+	}
+
+	fmt.Printf("Config '%s' is valid.\n", settings.ConfigJsonPath)
+	return exitOk
+}
+
+// Handles "reporter render".
+func commandRender() int {
+	config, ok := loadConfig()
+	if !ok {
+		return exitConfigError
+	}
+
+	reporter := newReporter(config)
+	reports := config.EffectiveReports()
+	reportVars := reporter.GatherReports(signalContext(), reports)
+
+	// With explicit reports, payloads of all of them are printed by name.
+	payloads := make(map[string]internal.PayloadType)
+	for i, report := range reports {
+		payload, errs := reporter.Render(report, reportVars[i])
+		for _, err := range errs {
+			if len(config.Reports) == 0 {
+				fmt.Fprintln(os.Stderr, "Expression error:", err.Error())
+			} else {
+				fmt.Fprintf(os.Stderr, "Expression error in report '%s': %s\n", report.Name, err.Error())
+			}
+		}
+		payloads[report.Name] = payload
+	}
+
+	var output interface{} = payloads
+	if len(config.Reports) == 0 {
+		output = payloads[reports[0].Name]
+	}
+
+	pretty, err := json.MarshalIndent(output, "", "  ")
+	if err != nil {
+		printError(err)
+		return exitFailure
+	}
+
+	fmt.Println(string(pretty))
+	return exitOk
+}
+
+// Handles "reporter render-config".
+func commandRenderConfig() int {
+	if !findConfig() {
+		return exitConfigError
+	}
+
+	overrides, ok := configOverrides()
+	if !ok {
+		return exitConfigError
+	}
+
+	rendered, err := internal.RenderConfig(settings.ConfigJsonPath, overrides...)
+	if err != nil {
+		printError(err)
+		return exitConfigError
+	}
+	fmt.Println(string(rendered))
+
+	// The merged config is printed even if it's not valid, as that's what
+	// one would want to look at.
+	if _, err := internal.ReadConfig(settings.ConfigJsonPath, overrides...); err != nil {
+		printError(err)
+		return exitConfigError
+	}
+
+	return exitOk
+}
+
+// Handles "reporter run [--once]".
+func commandRun(once bool) int {
+	config, ok := loadConfig()
+	if !ok {
+		return exitConfigError
+	}
+	setupLogging(config)
+
+	ctx := signalContext()
+	reporter := newReporter(config)
+	summary, err := reporter.Single(ctx)
+	if err == nil {
+		err = summary.Err()
+	}
+
+	if once {
+		if err != nil {
+			printError(err)
+			return exitFailure
+		}
+		return exitOk
+	}
+
+	reporter.Run(ctx)
+	return exitOk
+}
+
+// Handles "reporter daemon".
+func commandDaemon() int {
+	// Do this before daemonization, so that errors in config are visible soon.
+	config, ok := loadConfig()
+	if !ok {
+		return exitConfigError
+	}
+	setupLogging(config)
+
+	ctx := signalContext()
+	reporter := newReporter(config)
+	if _, err := reporter.Single(ctx); err != nil {
+		printError(err)
+		return exitFailure
+	}
+
+	if settings.DaemonMode {
+		weAreTheDaemon, daemonCtx := internal.Daemonize(settings.SelfDir)
+
+		if weAreTheDaemon {
+			// Do our best to remove the PID file when terminating the child
+			// process.
+			defer func() {
+				if err := daemonCtx.Release(); err != nil {
+					log.Errorf("Unable to release PID file: %s", err.Error())
+				}
+			}()
+		} else {
+			// We're the parent process - we'll tell the client the reporter
+			// is being daemonized and then exit.
+			fmt.Println("Daemonizing...")
+			return exitOk
+		}
+
+		log.Warning("Running in daemon mode. PID:", os.Getpid())
+	}
+
+	reporter.Run(ctx)
+	log.Warning("Reporter terminated.")
+	return exitOk
+}
+
+// Handles "reporter stop".
+func commandStop() int {
+	wasRunning, err := internal.StopDaemon(settings.SelfDir)
+	if err != nil {
+		printError(err)
+		return exitFailure
+	}
+
+	if !wasRunning {
+		fmt.Println("Reporter is not running.")
+		return exitNotRunning
+	}
+
+	fmt.Println("Reporter stopped.")
+	return exitOk
+}
+
+// Handles "reporter status".
+func commandStatus() int {
+	process := internal.FindDaemon(settings.SelfDir)
+	if process == nil {
+		fmt.Println("Reporter is not running.")
+		return exitNotRunning
+	}
+
+	fmt.Printf("Reporter is running (PID %d).\n", process.Pid)
+	return exitOk
+}
+
+// Handles "reporter ctl <command>" which talks to a running reporter via its
+// control socket.
+func commandCtl(command string, socketPath string, jsonOutput bool) int {
+	if socketPath == "" {
+		config, ok := loadConfig()
+		if !ok {
+			return exitConfigError
+		}
+		socketPath = internal.ControlSocketPath(config, settings.SelfDir)
+	}
+
+	data, err := internal.SendControlCommand(socketPath, command)
+	if err != nil {
+		printError(err)
+		return exitFailure
+	}
+
+	if jsonOutput {
+		fmt.Println(string(data))
+		return exitOk
+	}
+
+	output, err := internal.FormatControlResponse(command, data)
+	if err != nil {
+		printError(err)
+		return exitFailure
+	}
+
+	fmt.Print(output)
+	return exitOk
+}
+
+// Handles "reporter eval [expression] [--template string] [--vars file]".
+// Without any expression or template an interactive evaluator is started.
+func commandEval(expression string, template string, varsFile string) int {
+	var vars internal.EvalVariables
+
+	if varsFile != "" {
+		var err error
+		vars, err = internal.ReadVariablesFile(varsFile)
+		if err != nil {
+			printError(err)
+			return exitFailure
+		}
+	} else {
+		config, ok := loadConfig()
+		if !ok {
+			return exitConfigError
+		}
+		vars, _ = newReporter(config).Gather(signalContext())
+	}
+
+	if expression == "" && template == "" {
+		if internal.EvalRepl(os.Stdin, os.Stdout, vars, false) != 0 {
+			return exitFailure
+		}
+		return exitOk
+	}
+
+	result := exitOk
+	evaluate := func(input string, template bool) {
+		value, err := internal.Evaluate(input, template, vars)
+		if err != nil {
+			printError(err)
+			result = exitFailure
+			return
+		}
+		fmt.Println(value)
+	}
+
+	if expression != "" {
+		evaluate(expression, false)
+	}
+	if template != "" {
+		evaluate(template, true)
+	}
+
+	return result
+}
@@ -0,0 +1,125 @@
+package internal
+
+import (
+	"sort"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Functions aggregating values of a variable sampled in cycles since the
+// report was sent last time. Their results are provided to expressions as
+// reserved variables "$<function>.<name>", e.g. "$avg.load".
+var aggregateFunctions = []string{"avg", "min", "max", "p95", "count"}
+
+// Numeric values of variables sampled for a report since it was sent last
+// time.
+type sampleWindow struct {
+	start   time.Time                    // When the report was sent last time.
+	samples map[string][]decimal.Decimal // [variable name: values]
+}
+
+func newSampleWindow(start time.Time) *sampleWindow {
+	return &sampleWindow{start: start, samples: make(map[string][]decimal.Decimal)}
+}
+
+// Adds numeric values of the named variables into the window. Values which
+// are missing or are not numbers are skipped.
+func (w *sampleWindow) add(vars EvalVariables, names []string) {
+	for _, name := range names {
+		if value, err := decimal.NewFromString(vars[name]); err == nil {
+			w.samples[name] = append(w.samples[name], value)
+		}
+	}
+}
+
+// Adds aggregates of the samples of the named variables into the variables.
+// Only count is added for variables without samples.
+func (w *sampleWindow) addAggregateVariables(vars EvalVariables, names []string) {
+	for _, name := range names {
+		values := w.samples[name]
+		vars["$count."+name] = decimal.NewFromInt(int64(len(values))).String()
+		if len(values) == 0 {
+			continue
+		}
+
+		sorted := append([]decimal.Decimal{}, values...)
+		sort.Slice(sorted, func(i, j int) bool {
+			return sorted[i].LessThan(sorted[j])
+		})
+
+		// Nearest-rank percentile.
+		rank := decimal.NewFromInt(int64(len(sorted))).Mul(decimal.NewFromFloat(0.95)).Ceil().IntPart()
+
+		vars["$avg."+name] = decimal.Avg(sorted[0], sorted[1:]...).String()
+		vars["$min."+name] = sorted[0].String()
+		vars["$max."+name] = sorted[len(sorted)-1].String()
+		vars["$p95."+name] = sorted[rank-1].String()
+	}
+}
+
+// Returns sorted names of variables used as arguments of aggregate functions
+// in the expressions.
+func aggregatedVariables(nodes []exprNode) []string {
+	found := make(map[string]bool)
+
+	var walk func(node exprNode)
+	walk = func(node exprNode) {
+		switch node := node.(type) {
+		case exprNegation:
+			walk(node.operand)
+		case exprBinary:
+			walk(node.left)
+			walk(node.right)
+		case exprCall:
+			if containsString(aggregateFunctions, node.name) {
+				found[node.args[0].(exprVariable).name] = true
+			}
+			for _, arg := range node.args {
+				walk(arg)
+			}
+		}
+	}
+	for _, node := range nodes {
+		walk(node)
+	}
+
+	result := make([]string, 0, len(found))
+	for name := range found {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+
+	return result
+}
+
+// Samples variables of the report and decides whether the report is to be
+// sent in this cycle - either because it's forced, or because its send
+// interval elapsed since it was sent last time. If it is, aggregates of the
+// samples are added into the variables (and derived variables are evaluated
+// again, so that they can use them) and a new window of samples is started.
+func (r *Reporter) sampleReport(report ReportConfig, vars EvalVariables, now time.Time, force bool) bool {
+	if r.windows == nil {
+		r.windows = make(map[string]*sampleWindow)
+	}
+
+	window := r.windows[report.Name]
+	if window == nil {
+		window = newSampleWindow(now)
+		r.windows[report.Name] = window
+	}
+	window.add(vars, r.ConfigJson.aggregated)
+
+	// Cycles are a bit late rather than early, but let's not rely on that.
+	sendInterval := time.Duration(report.SendInterval)
+	elapsed := now.Sub(window.start) + report.RunInterval()/2
+	if !force && sendInterval > 0 && elapsed < sendInterval {
+		return false
+	}
+
+	window.addAggregateVariables(vars, r.ConfigJson.aggregated)
+	r.ConfigJson.addDerivedVariables(vars)
+	r.windows[report.Name] = newSampleWindow(now)
+
+	return true
+}
@@ -0,0 +1,137 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAggregateFunctions(t *testing.T) {
+	window := newSampleWindow(time.Now())
+	for _, load := range []string{"4", "1", "not a number", "2.5", "0.5"} {
+		window.add(EvalVariables{"load": load, "name": "box"}, []string{"load", "missing", "name"})
+	}
+	vars := EvalVariables{"load": "0.5"}
+	window.addAggregateVariables(vars, []string{"load", "missing", "name"})
+
+	testEvalExpr(t, vars, "avg(load)", "2")
+	testEvalExpr(t, vars, "min(load)", "0.5")
+	testEvalExpr(t, vars, "max(load)", "4")
+	testEvalExpr(t, vars, "p95(load)", "4")
+	testEvalExpr(t, vars, "count(load)", "4")
+	testEvalExpr(t, vars, "max(load) - load", "3.5")
+	testEvalExpr(t, vars, "count(missing)", "0")
+	testEvalExpr(t, vars, "count(name)", "0")
+
+	_, err := evalExpression("avg(missing)", vars)
+	assert.EqualError(t, err, "no samples of variable 'missing'")
+	_, err = evalExpression("max(other)", vars)
+	assert.EqualError(t, err, "no samples of variable 'other'")
+	_, err = parseExpression("avg(load, 2)")
+	assert.EqualError(t, err, "cannot parse expression 'avg(load, 2)': function 'avg' at position 1 expects 1 argument, got 2")
+
+	// Nearest-rank percentile of 20 values is the 19th one.
+	window = newSampleWindow(time.Now())
+	for i := 1; i <= 20; i++ {
+		window.add(EvalVariables{"n": strconv.Itoa(i)}, []string{"n"})
+	}
+	vars = EvalVariables{}
+	window.addAggregateVariables(vars, []string{"n"})
+	assert.Equal(t, "19", vars["$p95.n"])
+	assert.Equal(t, "10.5", vars["$avg.n"])
+}
+
+func TestAggregatedVariables(t *testing.T) {
+	config, err := buildConfigFromJson([]byte(`{
+	"vars": {"peak": "max(load) * 100", "busy": "count(cpu) * 2"},
+	"payload": {"load": {"avg": "${avg(load)}", "p95": "${p95(machine.load)}"}, "plain": "${cpu}"},
+}`), "/opt/reporter")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"cpu", "load", "machine.load"}, config.aggregated)
+}
+
+func TestSendInterval(t *testing.T) {
+	var received int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received++
+	}))
+	defer server.Close()
+
+	load := filepath.Join(t.TempDir(), "load")
+	gatherer := writeTestGatherer(t, "load.sh", "echo load=$(cat "+load+")\n")
+
+	config, err := buildConfigFromJson([]byte(`{
+	"target": ["`+server.URL+`"],
+	"gatherers": ["`+gatherer+`"],
+	"send_interval": "1h",
+	"vars": {"peak": "max(load) * 10"},
+	"payload": {"avg": "${avg(load)}", "peak": "${peak}", "last": "${load}", "samples": "${count(load)}"},
+}`), "/opt/reporter")
+	assert.NoError(t, err)
+	assert.Equal(t, Duration(time.Hour), config.EffectiveReports()[0].SendInterval)
+
+	// The first cycle sends the report right away.
+	reporter := &Reporter{ConfigJson: config, HttpClient: &http.Client{}}
+	os.WriteFile(load, []byte("1"), 0644)
+	summary, err := reporter.Single(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "1", summary.Payload["avg"])
+	assert.Equal(t, 1, received)
+
+	// Next cycles only sample variables until the send interval elapses.
+	for _, value := range []string{"2", "6"} {
+		os.WriteFile(load, []byte(value), 0644)
+		summary, err = reporter.runReports(context.Background(), config.EffectiveReports(), false)
+		assert.NoError(t, err)
+		assert.Nil(t, summary.Payload)
+		assert.Empty(t, summary.Reports)
+		assert.Equal(t, value, summary.Variables["load"])
+	}
+	assert.Equal(t, 1, received)
+
+	// Derived variables can use aggregates too.
+	os.WriteFile(load, []byte("4"), 0644)
+	reporter.windows[defaultReportName].start = time.Now().Add(-time.Hour)
+	summary, err = reporter.runReports(context.Background(), config.EffectiveReports(), false)
+	assert.NoError(t, err)
+	assert.Equal(t, PayloadType{"avg": "4", "peak": "60", "last": "4", "samples": "3"}, summary.Payload)
+	assert.Equal(t, 2, received)
+	assert.NotContains(t, summary.Variables, "$avg.load")
+
+	// New window is started once the report is sent.
+	summary, _ = reporter.Single(context.Background())
+	assert.Equal(t, "1", summary.Payload["samples"])
+}
+
+func TestSendIntervalValidationErrors(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"config.json": `{
+	"interval": "1m",
+	"send_interval": "30s",
+	"reports": [
+		{"name": "often", "interval": "10s"},
+		{"name": "rarely", "send_interval": "-1s"},
+		{"name": "fast", "interval": "10s", "send_interval": "5s"},
+	],
+}`,
+	})
+
+	_, err := ReadConfig(filepath.Join(dir, "config.json"))
+	var errs ConfigErrors
+	assert.ErrorAs(t, err, &errs)
+	for i := range errs {
+		errs[i].File = ""
+	}
+
+	assert.Equal(t, []string{
+		"6:39: reports[1].send_interval: report 'rarely' has negative send interval",
+		"7:56: reports[2].send_interval: send_interval of report 'fast' must not be shorter than its interval",
+	}, configErrorStrings(errs))
+}
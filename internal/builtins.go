@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Names of built-in "time.<name>" variables, which cannot be used as names of
+// custom time formats.
+var builtinTimeNames = []string{"unix", "unix_ms", "iso"}
+
+// Names of built-in variables provided in each cycle (except the ones of
+// custom time formats).
+var builtinVariableNames = []string{
+	"reporter.version",
+	"reporter.pid",
+	"reporter.cycle",
+	"reporter.uptime_s",
+	"reporter.config_path",
+	"host.id",
+	"host.name",
+	"host.os",
+	"host.arch",
+	"time.unix",
+	"time.unix_ms",
+	"time.iso",
+}
+
+// Prefix of variables describing health of gatherers, e.g.
+// "_gatherers.machine.ok".
+const gathererHealthPrefix = "_gatherers."
+
+// Returns true if the variable is provided by the reporter itself.
+func isBuiltinVariable(name string, config BuiltinsConfig) bool {
+	if containsString(builtinVariableNames, name) || strings.HasPrefix(name, gathererHealthPrefix) {
+		return true
+	}
+
+	format, ok := strings.CutPrefix(name, "time.")
+	_, isFormat := config.TimeFormats[format]
+
+	return ok && isFormat
+}
+
+// Returns built-in variables provided by the reporter itself in each cycle.
+//
+// Reporter:
+//   - reporter.version     - version of the reporter
+//   - reporter.pid         - PID of the reporter process
+//   - reporter.cycle       - number of the current cycle (starting from 1)
+//   - reporter.uptime_s    - seconds since the reporter's first cycle
+//   - reporter.config_path - absolute path to the loaded config file
+//
+// Host:
+//   - host.id   - stable identifier of the machine (see getHostId())
+//   - host.name - hostname of the machine
+//   - host.os   - operating system (e.g. "linux")
+//   - host.arch - architecture (e.g. "amd64")
+//
+// Time (local time, unless "builtins.utc" is enabled in config):
+//   - time.unix    - Unix timestamp in seconds
+//   - time.unix_ms - Unix timestamp in milliseconds
+//   - time.iso     - time in RFC 3339 format
+//   - time.<name>  - time formatted by each "builtins.time_formats" entry,
+//     which are specified as Go time layouts (e.g. "2006-01-02")
+func (r *Reporter) builtinVariables(now time.Time) StringMap {
+	config := r.ConfigJson.Builtins
+	if config.Utc {
+		now = now.UTC()
+	}
+
+	hostname, _ := os.Hostname()
+
+	vars := StringMap{
+		"reporter.version":     ReporterVersion,
+		"reporter.pid":         strconv.Itoa(os.Getpid()),
+		"reporter.cycle":       strconv.Itoa(r.cycle),
+		"reporter.uptime_s":    strconv.FormatInt(int64(now.Sub(r.startedAt).Seconds()), 10),
+		"reporter.config_path": r.ConfigJson.path,
+		"host.id":              r.getHostId(),
+		"host.name":            hostname,
+		"host.os":              runtime.GOOS,
+		"host.arch":            runtime.GOARCH,
+		"time.unix":            strconv.FormatInt(now.Unix(), 10),
+		"time.unix_ms":         strconv.FormatInt(now.UnixMilli(), 10),
+		"time.iso":             now.Format(time.RFC3339),
+	}
+
+	for name, layout := range config.TimeFormats {
+		vars["time."+name] = now.Format(layout)
+	}
+
+	return vars
+}
+
+// Merges gatherers' results together with built-in variables. Built-in
+// variables take precedence, unless overriding them is allowed in config.
+func (r *Reporter) mergeWithBuiltins(results []StringMap, builtins StringMap) StringMap {
+	if r.ConfigJson.Builtins.AllowOverride {
+		return MergeResults(append([]StringMap{builtins}, results...))
+	}
+
+	return MergeResults(append(results, builtins))
+}
@@ -0,0 +1,56 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuiltinVariables(t *testing.T) {
+	now := time.Date(2023, 6, 15, 12, 30, 45, 0, time.FixedZone("CEST", 2*60*60))
+
+	reporter := &Reporter{
+		ConfigJson: Config{
+			path: "/etc/reporter/config.json",
+			Builtins: BuiltinsConfig{
+				Utc:         true,
+				TimeFormats: StringMap{"date": "2006-01-02", "clock": "15:04"},
+			},
+		},
+		startedAt: now.Add(-90 * time.Second),
+		cycle:     4,
+	}
+
+	vars := reporter.builtinVariables(now)
+
+	assert.Equal(t, ReporterVersion, vars["reporter.version"])
+	assert.Equal(t, "4", vars["reporter.cycle"])
+	assert.Equal(t, "90", vars["reporter.uptime_s"])
+	assert.Equal(t, "/etc/reporter/config.json", vars["reporter.config_path"])
+	assert.NotEmpty(t, vars["host.os"])
+	assert.Equal(t, "1686825045", vars["time.unix"])
+	assert.Equal(t, "1686825045000", vars["time.unix_ms"])
+	assert.Equal(t, "2023-06-15T10:30:45Z", vars["time.iso"])
+	assert.Equal(t, "2023-06-15", vars["time.date"])
+	assert.Equal(t, "10:30", vars["time.clock"])
+
+	for name := range vars {
+		assert.True(t, isBuiltinVariable(name, reporter.ConfigJson.Builtins), name)
+	}
+	assert.Len(t, vars, len(builtinVariableNames)+2)
+	assert.False(t, isBuiltinVariable("time.other", reporter.ConfigJson.Builtins))
+}
+
+func TestBuiltinVariablesOverride(t *testing.T) {
+	results := []StringMap{{"host.name": "from-gatherer", "a": "1"}}
+	builtins := StringMap{"host.name": "builtin"}
+
+	reporter := &Reporter{}
+	merged := reporter.mergeWithBuiltins(results, builtins)
+	assert.Equal(t, StringMap{"host.name": "builtin", "a": "1"}, merged)
+
+	reporter.ConfigJson.Builtins.AllowOverride = true
+	merged = reporter.mergeWithBuiltins(results, builtins)
+	assert.Equal(t, StringMap{"host.name": "from-gatherer", "a": "1"}, merged)
+}
@@ -2,100 +2,759 @@ package internal
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
-
-	"github.com/tidwall/jsonc"
 )
 
-var configSearchPaths = []string{
-	"/config.json",
-	"/config/config.json",
+// Environment variable with path to config file, used instead of searching
+// for it.
+const ConfigPathEnvVar = "REPORTER_CONFIG"
+
+// Name of directory with config in system-wide and XDG config directories.
+const configAppDir = "maxon-reporter"
+
+var configFileNames = []string{
+	"config.json",
+	"config.yaml",
+	"config.yml",
+	"config.toml",
 }
 
+var RE_NAME = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+var RE_NON_NAME_CHARS = regexp.MustCompile(`[^a-zA-Z0-9_]+`)
+
 // Build Config struct from JSON data passed as bytes.
-// The relative
-func buildConfigFromJson(jsonBytes []byte, baseDir string) Config {
+// The relative gatherer paths are resolved against the provided baseDir.
+func buildConfigFromJson(jsonBytes []byte, baseDir string) (Config, error) {
+	root, err := parseJsonConfigNode(jsonBytes, "")
+	if err != nil {
+		return Config{}, err
+	}
+
+	c, errs := buildConfigFromNode(root, baseDir)
+	if len(errs) != 0 {
+		return c, errs
+	}
+
+	return c, nil
+}
+
+// Build Config struct from parsed config document. References to environment
+// variables and files are resolved first. Problems with structure of the
+// document (unknown keys, wrong types) are returned, but the config is still
+// built from the rest of the document.
+func buildConfigFromNode(root *configNode, baseDir string) (Config, ConfigErrors) {
 	c := Config{}
 
-	if err := json.Unmarshal(jsonc.ToJSON(jsonBytes), &c); err != nil {
-		ErrorExit("Parsing config", err.Error())
-		return c
+	var errs ConfigErrors
+	var secrets []string
+	resolveConfigRefs(root, "", baseDir, &secrets, &errs)
+	value := checkConfigNode(root, reflect.TypeOf(c), "", &errs)
+
+	// The checked value always matches the Config struct, so this can fail
+	// only because of a bug.
+	jsonBytes, err := json.Marshal(value)
+	if err == nil {
+		err = json.Unmarshal(jsonBytes, &c)
+	}
+	if err != nil {
+		errs = append(errs, ConfigError{Msg: err.Error()})
+		return c, errs
 	}
 
-	var err error
 	var absPath string
-	for i, gathererPath := range c.Gatherers {
+	for i, gatherer := range c.Gatherers {
+		// HTTP gatherers have no path to resolve.
+		if gatherer.Path == "" {
+			continue
+		}
+
 		// Absolute gatherer paths will be kept as-is, while relative gatherer
 		// paths will be made absolute by basing them upon provided baseDir.
-		if filepath.IsAbs(gathererPath) {
-			absPath = gathererPath
+		if filepath.IsAbs(gatherer.Path) {
+			absPath = gatherer.Path
 		} else {
-			absPath, err = filepath.Abs(filepath.Join(baseDir, gathererPath))
-			FatalExitOnError(err)
+			absPath, err = filepath.Abs(filepath.Join(baseDir, gatherer.Path))
+			if err != nil {
+				errs.add(configPathIndex("gatherers", i), "%s", err.Error())
+				continue
+			}
+		}
+
+		c.Gatherers[i].Path = absPath
+	}
+
+	for i := range c.Reports {
+		c.Reports[i].path = configPathIndex("reports", i)
+	}
+
+	for i, path := range c.Secrets {
+		node := root.find(path)
+		if node == nil {
+			secretPath := configPathIndex("secrets", i)
+			errs.addAt(root.lookupPos(secretPath), secretPath, "secret '%s' not found in config", path)
+			continue
+		}
+		// Values of secret payload fields are known only once the payload
+		// is built.
+		if !c.isPayloadPath(path) {
+			secrets = append(secrets, collectStrings(node.toInterface())...)
+		}
+	}
+	c.redactor = NewRedactor(secrets...)
+
+	assignGathererNames(c.Gatherers)
+	c.Logging.Path = resolveLogPath(c.Logging.Path, baseDir)
+	if c.StateFile != "" && !filepath.IsAbs(c.StateFile) {
+		c.StateFile = filepath.Join(baseDir, c.StateFile)
+	}
+
+	// Parse expressions in payload template only once, right now.
+	var compileErrs ConfigErrors
+	c.derived = compileDerivedVariables(c.Vars, &compileErrs)
+	c.templates = make(map[string]*compiledTemplate)
+	for _, report := range c.EffectiveReports() {
+		if _, ok := report.Payload[payloadIfKey]; ok {
+			compileErrs.add(
+				configPathKey(report.payloadPath(), payloadIfKey),
+				"'%s' can be used only in nested objects and array items", payloadIfKey,
+			)
 		}
+		checkMisplacedPayloadLoop(report.Payload, report.payloadPath(), &compileErrs)
+		compilePayloadTemplates(report.Payload, report.payloadPath(), c.templates, &compileErrs)
+	}
+	errs.addLocated(root, compileErrs)
 
-		c.Gatherers[i] = absPath
+	var expressions []exprNode
+	for _, derived := range c.derived {
+		expressions = append(expressions, derived.expr)
+	}
+	for _, t := range c.templates {
+		expressions = append(expressions, t.expressions...)
 	}
+	c.aggregated = aggregatedVariables(expressions)
 
-	return c
+	return c, errs
 }
 
-func validateConfig(c Config) error {
-	var err error
+// Compiles all string values of the payload template into the templates map.
+func compilePayloadTemplates(
+	payload PayloadType,
+	path string,
+	templates map[string]*compiledTemplate,
+	errs *ConfigErrors,
+) {
+	for k, v := range payload {
+		valuePath := configPathKey(path, k)
+
+		if k == payloadIfKey {
+			switch v.(type) {
+			case string, float64:
+			default:
+				errs.add(valuePath, "condition must be a string or a number")
+				continue
+			}
+		}
+
+		switch v := v.(type) {
+		case string:
+			if _, ok := templates[v]; ok {
+				continue
+			}
+			t, err := compileTemplate(v)
+			if err != nil {
+				errs.add(valuePath, "%s", err.Error())
+				continue
+			}
+			templates[v] = t
+		case StringKeyMap:
+			checkMisplacedPayloadLoop(v, valuePath, errs)
+			compilePayloadTemplates(v, valuePath, templates, errs)
+		case []interface{}:
+			for i, item := range v {
+				if item, ok := item.(StringKeyMap); ok {
+					itemPath := configPathIndex(valuePath, i)
+					checkPayloadLoop(item, itemPath, errs)
+					compilePayloadTemplates(item, itemPath, templates, errs)
+				}
+			}
+		}
+	}
+}
+
+// Checks "$each" and "$as" directives of the payload template array item.
+func checkPayloadLoop(item StringKeyMap, path string, errs *ConfigErrors) {
+	each, hasEach := item[payloadEachKey]
+	as, hasAs := item[payloadAsKey]
+	if !hasEach {
+		if hasAs {
+			errs.add(configPathKey(path, payloadAsKey), "'%s' can be used only together with '%s'", payloadAsKey, payloadEachKey)
+		}
+		return
+	}
+
+	pattern, ok := each.(string)
+	if !ok {
+		errs.add(configPathKey(path, payloadEachKey), "pattern must be a string")
+		return
+	}
+	wildcards := strings.Count(pattern, "*")
+	if wildcards == 0 {
+		errs.add(configPathKey(path, payloadEachKey), "pattern '%s' has no '*' wildcard", pattern)
+	}
+
+	if !hasAs {
+		return
+	}
+	names, ok := as.(string)
+	if !ok {
+		errs.add(configPathKey(path, payloadAsKey), "names must be a comma-separated string")
+		return
+	}
+	for _, name := range payloadEachNames(names) {
+		if !RE_NAME.MatchString(name) {
+			errs.add(configPathKey(path, payloadAsKey), "name '%s' may contain only letters, digits and underscores", name)
+		}
+	}
+	if count := len(payloadEachNames(names)); count > wildcards {
+		errs.add(configPathKey(path, payloadAsKey), "%d name(s) given for %d wildcard(s)", count, wildcards)
+	}
+}
 
-	for _, target := range c.Target {
-		if !strings.HasPrefix(target, "https://") && !strings.HasPrefix(target, "http://") {
-			return fmt.Errorf("target URL '%s' is not an acceptable URL", target)
+// Reports "$each" and "$as" directives used outside of array items.
+func checkMisplacedPayloadLoop(object StringKeyMap, path string, errs *ConfigErrors) {
+	for _, key := range []string{payloadEachKey, payloadAsKey} {
+		if _, ok := object[key]; ok {
+			errs.add(configPathKey(path, key), "'%s' can be used only in array items", key)
 		}
 	}
+}
+
+// Returns redactor of secret values of the config (nil if the config was not
+// loaded from a file).
+func (c Config) Redactor() *Redactor {
+	return c.redactor
+}
+
+// Returns reports sent by the reporter - the ones from "reports" or a single
+// one made of top-level "target" and "payload". Reports without interval use
+// the interval of the whole config.
+func (c Config) EffectiveReports() []ReportConfig {
+	if len(c.Reports) == 0 {
+		return []ReportConfig{{
+			Name:         defaultReportName,
+			Target:       c.Target,
+			Interval:     c.Interval,
+			SendInterval: c.SendInterval,
+			Payload:      c.Payload,
+		}}
+	}
+
+	reports := make([]ReportConfig, len(c.Reports))
+	for i, report := range c.Reports {
+		if report.Interval == 0 {
+			report.Interval = c.Interval
+		}
+		if report.SendInterval == 0 {
+			report.SendInterval = c.SendInterval
+		}
+		reports[i] = report
+	}
+
+	return reports
+}
+
+// Returns path of the report's payload template in config.
+func (r ReportConfig) payloadPath() string {
+	return configPathKey(r.path, "payload")
+}
+
+// Returns true if the config path points into payload template of a report.
+func (c Config) isPayloadPath(path string) bool {
+	for _, report := range c.EffectiveReports() {
+		if isConfigSubpath(path, report.payloadPath()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Adds values of variables used in expressions of secret payload fields into
+// the config's redactor. This is done before the payload is built, so that
+// the values are redacted from expression errors too.
+func (c Config) addSecretVariables(vars EvalVariables) {
+	for _, path := range c.Secrets {
+		if !c.isPayloadPath(path) {
+			continue
+		}
+
+		for _, expr := range c.PayloadExpressions() {
+			if !isConfigSubpath(expr.Path, path) {
+				continue
+			}
+			for _, name := range expr.Variables {
+				if value, ok := vars[name]; ok {
+					c.redactor.Add(value)
+				}
+			}
+		}
+	}
+}
+
+// Adds values of secret fields of the report's payload into the config's
+// redactor.
+func (c Config) addPayloadSecrets(report ReportConfig, payload PayloadType) {
+	payloadPath := report.payloadPath()
+	for _, path := range c.Secrets {
+		if isConfigSubpath(path, payloadPath) {
+			value := lookupPayloadPath(payload, strings.TrimPrefix(path, payloadPath))
+			c.redactor.Add(collectStrings(value)...)
+		}
+	}
+}
+
+// Returns all expressions found in payload templates of all reports, sorted
+// by their paths.
+func (c Config) PayloadExpressions() []PayloadExpression {
+	var result []PayloadExpression
+
+	var walk func(payload PayloadType, path string)
+	walk = func(payload PayloadType, path string) {
+		for k, v := range payload {
+			valuePath := configPathKey(path, k)
+
+			switch v := v.(type) {
+			case string:
+				t := c.templates[v]
+				if t == nil {
+					continue
+				}
+				for i, expr := range t.expressions {
+					result = append(result, PayloadExpression{
+						Path:       valuePath,
+						Expression: t.sources[i],
+						Variables:  exprVariables(expr),
+					})
+				}
+			case StringKeyMap:
+				walk(v, valuePath)
+			case []interface{}:
+				for i, item := range v {
+					if item, ok := item.(StringKeyMap); ok {
+						walk(item, configPathIndex(valuePath, i))
+					}
+				}
+			}
+		}
+	}
+	for _, report := range c.EffectiveReports() {
+		walk(report.Payload, report.payloadPath())
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Path < result[j].Path
+	})
+
+	return result
+}
+
+// Cross-checks variables needed by payload expressions against the variables
+// (e.g. produced by gatherers in a test run) and returns a problem for each
+// variable which is missing. Expressions in objects with "$if" condition or
+// "$each" loop are not checked, as their variables might be missing on
+// purpose or bound by the loop.
+func (c Config) CheckPayloadVariables(vars EvalVariables) ConfigErrors {
+	var errs ConfigErrors
+
+	expressions := c.PayloadExpressions()
+	var skipped []string
+	for _, expr := range expressions {
+		if parent, ok := strings.CutSuffix(expr.Path, "."+payloadIfKey); ok {
+			skipped = append(skipped, parent)
+		}
+	}
+	for _, report := range c.EffectiveReports() {
+		skipped = append(skipped, payloadLoopPaths(report.Payload, report.payloadPath())...)
+	}
+
+	for _, expr := range expressions {
+		if isConfigSubpathOfAny(expr.Path, skipped) {
+			continue
+		}
+		if _, ok := vars[strings.TrimSpace(expr.Expression)]; ok {
+			continue
+		}
+		for _, name := range expr.Variables {
+			if _, ok := vars[name]; !ok {
+				errs.add(expr.Path, "expression '%s' needs variable '%s' which is not defined", expr.Expression, name)
+			}
+		}
+	}
+
+	return errs
+}
+
+// Returns paths of array items with "$each" loop in the payload template.
+func payloadLoopPaths(payload PayloadType, path string) []string {
+	var result []string
+
+	for k, v := range payload {
+		valuePath := configPathKey(path, k)
+
+		switch v := v.(type) {
+		case StringKeyMap:
+			result = append(result, payloadLoopPaths(v, valuePath)...)
+		case []interface{}:
+			for i, item := range v {
+				if item, ok := item.(StringKeyMap); ok {
+					itemPath := configPathIndex(valuePath, i)
+					if _, ok := item[payloadEachKey]; ok {
+						result = append(result, itemPath)
+					} else {
+						result = append(result, payloadLoopPaths(item, itemPath)...)
+					}
+				}
+			}
+		}
+	}
+
+	return result
+}
 
+// Gatherers without explicitly specified name get a name derived from their
+// path or URL. Derived names are made unique by appending a numeric suffix.
+func assignGathererNames(gatherers []GathererConfig) {
+	used := make(map[string]bool)
+	for _, g := range gatherers {
+		if g.Name != "" {
+			used[g.Name] = true
+		}
+	}
+
+	for i, g := range gatherers {
+		if g.Name != "" {
+			continue
+		}
+
+		var name string
+		if g.Url != "" {
+			name = strings.TrimPrefix(strings.TrimPrefix(g.Url, "http://"), "https://")
+		} else {
+			name = strings.TrimSuffix(filepath.Base(g.Path), filepath.Ext(g.Path))
+		}
+		name = RE_NON_NAME_CHARS.ReplaceAllString(strings.Trim(name, "/"), "_")
+
+		unique := name
+		for n := 2; used[unique]; n++ {
+			unique = fmt.Sprintf("%s_%d", name, n)
+		}
+
+		used[unique] = true
+		gatherers[i].Name = unique
+	}
+}
+
+// Checks values of the config and returns all problems found.
+func validateConfig(c Config) ConfigErrors {
+	var errs ConfigErrors
+
+	for i, target := range c.Target {
+		if !isHttpUrl(target) {
+			errs.add(configPathIndex("target", i), "target URL '%s' is not an acceptable URL", target)
+		}
+	}
+
+	if c.Interval < 0 {
+		errs.add("interval", "interval must not be negative")
+	}
+	if c.SendInterval < 0 {
+		errs.add("send_interval", "send_interval must not be negative")
+	}
+
+	// Top-level target and payload make the default report, which is not
+	// used if there are explicit reports.
+	if len(c.Reports) != 0 {
+		if len(c.Target) != 0 {
+			errs.add("target", "top-level target must not be used together with reports")
+		}
+		if len(c.Payload) != 0 {
+			errs.add("payload", "top-level payload must not be used together with reports")
+		}
+	}
+
+	gathererNames := make(map[string]bool)
 	for _, gatherer := range c.Gatherers {
-		if !IsExistingFile(gatherer) {
-			return fmt.Errorf("gatherer '%s' not found", gatherer)
+		gathererNames[gatherer.Name] = true
+	}
+
+	reportNames := make(map[string]bool)
+	for i, report := range c.Reports {
+		path := configPathIndex("reports", i)
+		validateReport(report, path, gathererNames, &errs)
+
+		if reportNames[report.Name] {
+			errs.add(configPathKey(path, "name"), "report name '%s' is not unique", report.Name)
+		}
+		reportNames[report.Name] = true
+	}
+
+	// Send interval may be inherited from the whole config, as well as the
+	// interval.
+	for _, report := range c.EffectiveReports() {
+		if report.SendInterval > 0 && time.Duration(report.SendInterval) < report.RunInterval() {
+			errs.add(
+				configPathKey(report.path, "send_interval"),
+				"send_interval of report '%s' must not be shorter than its interval", report.Name,
+			)
+		}
+	}
+
+	if c.Metrics.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.Metrics.Listen); err != nil {
+			errs.add("metrics.listen", "metrics listen address '%s' is invalid: %s", c.Metrics.Listen, err.Error())
+		}
+	}
+
+	if err := validateLoggingConfig(c.Logging); err != nil {
+		errs.add("logging", "%s", err.Error())
+	}
+
+	if _, err := parseControlSocketMode(c.Control.Mode); err != nil {
+		errs.add("control.mode", "%s", err.Error())
+	}
+
+	for name := range c.Builtins.TimeFormats {
+		if !RE_NAME.MatchString(name) {
+			errs.add(
+				configPathKey("builtins.time_formats", name),
+				"time format name '%s' may contain only letters, digits and underscores", name,
+			)
+		} else if containsString(builtinTimeNames, name) {
+			errs.add(
+				configPathKey("builtins.time_formats", name),
+				"time format name '%s' is reserved for built-in variable 'time.%s'", name, name,
+			)
+		}
+	}
+
+	// Derived variables must not replace built-in ones. Reserved names
+	// (starting with "$") are not valid names of derived variables at all.
+	for name := range c.Vars {
+		if isBuiltinVariable(name, c.Builtins) {
+			errs.add(configPathKey("vars", name), "variable '%s' would override built-in variable", name)
+		}
+	}
+
+	names := make(map[string]bool)
+	for i, gatherer := range c.Gatherers {
+		path := configPathIndex("gatherers", i)
+		validateGatherer(gatherer, path, &errs)
+
+		if names[gatherer.Name] {
+			errs.add(configPathKey(path, "name"), "gatherer name '%s' is not unique", gatherer.Name)
+		}
+		names[gatherer.Name] = true
+	}
+
+	return errs
+}
+
+func validateReport(r ReportConfig, path string, gathererNames map[string]bool, errs *ConfigErrors) {
+	if r.Name == "" {
+		errs.add(path, "report has no name")
+	} else if !RE_NAME.MatchString(r.Name) {
+		errs.add(configPathKey(path, "name"), "report name '%s' may contain only letters, digits and underscores", r.Name)
+	}
+
+	for i, target := range r.Target {
+		if !isHttpUrl(target) {
+			errs.add(configPathIndex(configPathKey(path, "target"), i), "target URL '%s' is not an acceptable URL", target)
 		}
 	}
 
-	return err
+	if r.Interval < 0 {
+		errs.add(configPathKey(path, "interval"), "report '%s' has negative interval", r.Name)
+	}
+	if r.SendInterval < 0 {
+		errs.add(configPathKey(path, "send_interval"), "report '%s' has negative send interval", r.Name)
+	}
+
+	for i, name := range r.Gatherers {
+		if !gathererNames[name] {
+			errs.add(configPathIndex(configPathKey(path, "gatherers"), i), "report '%s' uses unknown gatherer '%s'", r.Name, name)
+		}
+	}
 }
 
-// Finds some config file relative to main executable.
-func FindConfig() string {
+func validateGatherer(g GathererConfig, path string, errs *ConfigErrors) {
+	if !RE_NAME.MatchString(g.Name) {
+		errs.add(configPathKey(path, "name"), "gatherer name '%s' may contain only letters, digits and underscores", g.Name)
+	}
+
+	if g.Path != "" && g.Url != "" {
+		errs.add(path, "gatherer '%s' must not have both path and URL", g.Path)
+		return
+	}
+
+	switch g.OnFailure {
+	case "", GathererOnFailureDiscard, GathererOnFailureKeep, GathererOnFailureKeepWithWarning:
+	default:
+		errs.add(configPathKey(path, "on_failure"), "gatherer '%s' has unknown on_failure policy '%s'", g.Name, g.OnFailure)
+	}
+
+	if g.FallbackGrace < 0 {
+		errs.add(configPathKey(path, "fallback_grace"), "gatherer '%s' has negative fallback_grace", g.Name)
+	}
+
+	if g.Url == "" {
+		if g.Path == "" {
+			errs.add(path, "gatherer has neither path nor URL specified")
+			return
+		}
+
+		info, err := os.Stat(g.Path)
+		if err != nil || info.IsDir() {
+			errs.add(configPathKey(path, "path"), "gatherer '%s' not found", g.Path)
+		} else if info.Mode()&0111 == 0 {
+			errs.add(configPathKey(path, "path"), "gatherer '%s' is not executable", g.Path)
+		}
+		return
+	}
+
+	if !isHttpUrl(g.Url) {
+		errs.add(configPathKey(path, "url"), "gatherer URL '%s' is not an acceptable URL", g.Url)
+	}
+
+	switch g.Format {
+	case "", ScrapeFormatJson, ScrapeFormatPrometheus:
+	default:
+		errs.add(configPathKey(path, "format"), "gatherer '%s' has unknown format '%s'", g.Url, g.Format)
+	}
+
+	if g.Timeout < 0 {
+		errs.add(configPathKey(path, "timeout"), "gatherer '%s' has negative timeout", g.Url)
+	}
+}
+
+func isHttpUrl(str string) bool {
+	u, err := url.Parse(str)
+	if err != nil {
+		return false
+	}
+
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// Returns directories where config is searched for, in order:
+//   - the directory (i.e. directory of the main executable) and its "config"
+//     subdirectory,
+//   - "maxon-reporter" in the user's XDG config directory ("~/.config"),
+//   - "/etc/maxon-reporter",
+//   - "maxon-reporter" in XDG system config directories ("/etc/xdg").
+func configSearchDirs(dir string) []string {
+	dirs := []string{dir, filepath.Join(dir, "config")}
+
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			configHome = filepath.Join(home, ".config")
+		}
+	}
+	if configHome != "" {
+		dirs = append(dirs, filepath.Join(configHome, configAppDir))
+	}
+
+	dirs = append(dirs, filepath.Join("/etc", configAppDir))
+
+	configDirs := os.Getenv("XDG_CONFIG_DIRS")
+	if configDirs == "" {
+		configDirs = "/etc/xdg"
+	}
+	for _, configDir := range filepath.SplitList(configDirs) {
+		if configDir != "" {
+			dirs = append(dirs, filepath.Join(configDir, configAppDir))
+		}
+	}
+
+	return dirs
+}
+
+// Finds config file - the one specified by REPORTER_CONFIG environment
+// variable, or the first one found in search directories (see
+// configSearchDirs()).
+func SearchConfig(dir string) (string, error) {
+	if path := os.Getenv(ConfigPathEnvVar); path != "" {
+		if !IsExistingFile(path) {
+			return "", fmt.Errorf("cannot find config file '%s' (from %s)", path, ConfigPathEnvVar)
+		}
+		log.Infof("Using config from %s: %s", ConfigPathEnvVar, path)
+		return path, nil
+	}
+
 	var tried []string
 
-	for _, path := range configSearchPaths {
-		path, err := filepath.Abs(Settings.SelfDir + path)
-		FatalExitOnError(err)
+	for _, searchDir := range configSearchDirs(dir) {
+		for _, name := range configFileNames {
+			path, err := filepath.Abs(filepath.Join(searchDir, name))
+			if err != nil {
+				return "", err
+			}
 
-		tried = append(tried, path)
-		if IsExistingFile(path) {
-			log.Info("Found config:", path)
-			return path
+			tried = append(tried, path)
+			if IsExistingFile(path) {
+				log.Info("Found config:", path)
+				return path, nil
+			}
 		}
 	}
 
-	ErrorExit(fmt.Sprintf(
-		"cannot find 'config.json' file, tried:\n%s",
+	return "", fmt.Errorf(
+		"cannot find config file, tried:\n%s",
 		strings.Join(tried, "\n"),
-	))
-	return ""
+	)
 }
 
-func LoadConfig(configPath string) Config {
+// Reads, parses and validates config file. Overrides are applied on top of it
+// (in order).
+func ReadConfig(configPath string, overrides ...ConfigOverride) (Config, error) {
 	// Make the config path absolute.
 	configPath, err := filepath.Abs(configPath)
-	FatalExitOnError(err)
-	jsonBytes, err := os.ReadFile(configPath)
-	FatalExitOnError(err)
+	if err != nil {
+		return Config{}, err
+	}
+
+	// JSON, YAML and TOML configs are all parsed into the same node tree, so
+	// they're merged, built and validated the same way.
+	root, err := readConfigNode(configPath, overrides)
+	if err != nil {
+		var problems ConfigErrors
+		if errors.As(err, &problems) {
+			return Config{}, fmt.Errorf("parsing config: %w", err)
+		}
+		return Config{}, err
+	}
 
-	config := buildConfigFromJson(jsonBytes, filepath.Dir(configPath))
-	if err := validateConfig(config); err != nil {
-		ErrorExit("Config validation", err.Error())
+	// Report all problems at once - both with structure of the config and
+	// with its values.
+	config, errs := buildConfigFromNode(root, filepath.Dir(configPath))
+	config.path = configPath
+	config.overrides = overrides
+	errs.addLocated(root, validateConfig(config))
+	if len(errs) != 0 {
+		return config, fmt.Errorf("config validation: %w", errs)
 	}
 
-	return config
+	return config, nil
 }
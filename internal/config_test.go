@@ -1,14 +1,20 @@
 package internal
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/mohae/deepcopy"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestLoadConfig(t *testing.T) {
-	Settings.SelfDir = "../example"
-	config := LoadConfig(FindConfig())
+	path, err := SearchConfig("../example")
+	assert.NoError(t, err)
+	config, err := ReadConfig(path)
+	assert.NoError(t, err)
 
 	assert.Len(t, config.Target, 2)
 	assert.Equal(t, "https://httpbingo.org/post", config.Target[0])
@@ -19,8 +25,334 @@ func TestLoadConfig(t *testing.T) {
 	assert.Equal(t, "And this one too...", config.Env["ANOTHER_ENV_VAR_ABC"])
 
 	assert.Len(t, config.Gatherers, 2)
-	assert.Contains(t, config.Gatherers[0], "/gatherers/machine.sh")
-	assert.Contains(t, config.Gatherers[1], "/gatherers/some_script.py")
+	assert.Contains(t, config.Gatherers[0].Path, "/gatherers/machine.sh")
+	assert.Contains(t, config.Gatherers[1].Path, "/gatherers/some_script.py")
 
 	assert.NotEmpty(t, config.Payload)
 }
+
+func TestBuildConfigWithHttpGatherer(t *testing.T) {
+	config, err := buildConfigFromJson([]byte(`{
+		"gatherers": [
+			"./gatherers/machine.sh",
+			{"url": "http://127.0.0.1:9100/metrics", "format": "prometheus", "timeout": "2s"},
+		],
+	}`), "/opt/reporter")
+
+	assert.NoError(t, err)
+	assert.Len(t, config.Gatherers, 2)
+	assert.Equal(t, "/opt/reporter/gatherers/machine.sh", config.Gatherers[0].Path)
+	assert.Equal(t, "http://127.0.0.1:9100/metrics", config.Gatherers[1].Url)
+	assert.Equal(t, ScrapeFormatPrometheus, config.Gatherers[1].Format)
+	assert.Equal(t, Duration(2*time.Second), config.Gatherers[1].Timeout)
+	assert.Empty(t, config.Gatherers[1].Path)
+}
+
+func TestGathererNames(t *testing.T) {
+	gatherers := []GathererConfig{
+		{Path: "/opt/gatherers/machine.sh"},
+		{Path: "/opt/other/machine.py"},
+		{Name: "custom", Path: "/opt/gatherers/some-script.py"},
+		{Url: "http://127.0.0.1:9100/metrics"},
+	}
+	assignGathererNames(gatherers)
+
+	assert.Equal(t, "machine", gatherers[0].Name)
+	assert.Equal(t, "machine_2", gatherers[1].Name)
+	assert.Equal(t, "custom", gatherers[2].Name)
+	assert.Equal(t, "127_0_0_1_9100_metrics", gatherers[3].Name)
+}
+
+func TestConfigNodePositions(t *testing.T) {
+	root, err := parseJsonConfigNode([]byte(`{
+	// Comment.
+	"target": ["http://a", /* another one */ "http://b"],
+	"payload": {"fields": [{"value": 1}]},
+}`), "config.json")
+	assert.NoError(t, err)
+
+	assert.Equal(t, configPos{"config.json", 1, 1}, root.pos)
+	assert.Equal(t, configPos{"config.json", 3, 43}, root.lookupPos("target[1]"))
+	assert.Equal(t, configPos{"config.json", 4, 35}, root.lookupPos("payload.fields[0].value"))
+	// Position of the deepest existing part of the path is returned.
+	assert.Equal(t, configPos{"config.json", 4, 13}, root.lookupPos("payload.nope.value"))
+
+	_, err = parseJsonConfigNode([]byte("{\n\t\"a\": [1,\n\t2 x\n}"), "config.json")
+	assert.EqualError(t, err, "config.json:3:4: invalid character 'x' after array element")
+
+	_, err = parseJsonConfigNode([]byte(`{"a": 1, "a": 2}`), "config.json")
+	assert.EqualError(t, err, "config.json:1:10: duplicate key 'a'")
+}
+
+func TestConfigStructureErrors(t *testing.T) {
+	_, err := buildConfigFromJson([]byte(`{
+	"targets": ["http://localhost"],
+	"gatherer": [],
+	"gatherers": [
+		{"url": "http://localhost", "timeout": "2 s"},
+		{"path": 5},
+	],
+	"logging": {"max_size_mb": 1.5, "levels": {"gatherers": 3}},
+	"payload": {
+		"a": "${1 +} and ${a}",
+		"fields": [{"value": "${(a * b}"}, 5],
+		"ok": true,
+	},
+}`), "/opt/reporter")
+
+	var errs ConfigErrors
+	assert.ErrorAs(t, err, &errs)
+	assert.Equal(t, []string{
+		"2:2: targets: unknown key 'targets' (did you mean 'target'?)",
+		"3:2: gatherer: unknown key 'gatherer' (did you mean 'gatherers'?)",
+		"5:42: gatherers[0].timeout: invalid duration '2 s' (use e.g. \"30s\" or \"1m30s\")",
+		"6:12: gatherers[1].path: expected string, got number",
+		"8:29: logging.max_size_mb: expected integer, got '1.5'",
+		"8:58: logging.levels.gatherers: expected string, got number",
+		"10:8: payload.a: cannot parse expression '1 +': unexpected end of expression",
+		"11:24: payload.fields[0].value: cannot parse expression '(a * b': unexpected end of expression",
+		"11:38: payload.fields[1]: expected object, got number",
+		"12:9: payload.ok: expected string, number, object or array, got boolean",
+	}, configErrorStrings(errs))
+}
+
+func TestConfigValidationErrors(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "executable.sh"), []byte("#!/bin/sh\n"), 0755)
+	os.WriteFile(filepath.Join(dir, "plain.sh"), []byte("#!/bin/sh\n"), 0644)
+
+	configPath := filepath.Join(dir, "config.json")
+	os.WriteFile(configPath, []byte(`{
+	"target": ["http://localhost", "ftp://localhost", "http://"],
+	"gatherers": [
+		"./executable.sh",
+		"./plain.sh",
+		"./missing.sh",
+		{"path": 1},
+		{"url": "localhost:9100", "on_failure": "ignore"},
+	],
+	"control": {"mode": "999"},
+	"builtins": {"time_formats": {"date": "2006-01-02", "iso": "2006"}},
+}`), 0644)
+
+	_, err := ReadConfig(configPath)
+	assert.ErrorContains(t, err, "config validation: 9 problems found")
+
+	var errs ConfigErrors
+	assert.ErrorAs(t, err, &errs)
+	for i := range errs {
+		assert.Equal(t, configPath, errs[i].File)
+		errs[i].File = ""
+	}
+
+	// Problems caused by problems with structure are not reported (e.g.
+	// missing path of gatherers[3]).
+	assert.Equal(t, []string{
+		"2:33: target[1]: target URL 'ftp://localhost' is not an acceptable URL",
+		"2:52: target[2]: target URL 'http://' is not an acceptable URL",
+		"5:3: gatherers[1].path: gatherer '" + filepath.Join(dir, "plain.sh") + "' is not executable",
+		"6:3: gatherers[2].path: gatherer '" + filepath.Join(dir, "missing.sh") + "' not found",
+		"7:12: gatherers[3].path: expected string, got number",
+		"8:11: gatherers[4].url: gatherer URL 'localhost:9100' is not an acceptable URL",
+		"8:43: gatherers[4].on_failure: gatherer 'localhost_9100' has unknown on_failure policy 'ignore'",
+		"10:22: control.mode: invalid control socket mode '999'",
+		"11:61: builtins.time_formats.iso: time format name 'iso' is reserved for built-in variable 'time.iso'",
+	}, configErrorStrings(errs))
+}
+
+func configErrorStrings(errs ConfigErrors) []string {
+	var result []string
+	for _, err := range errs {
+		result = append(result, err.Error())
+	}
+
+	return result
+}
+
+func TestPayloadExpressions(t *testing.T) {
+	config, err := buildConfigFromJson([]byte(`{
+	"payload": {
+		"title": "${host.name} (${reporter.version})",
+		"fields": [{"value": "${100 * load / cpus}"}, {"value": 5}],
+		"static": "nothing here",
+	},
+}`), "/opt/reporter")
+	assert.NoError(t, err)
+
+	assert.Equal(t, []PayloadExpression{
+		{"payload.fields[0].value", "100 * load / cpus", []string{"cpus", "load"}},
+		{"payload.title", "host.name", []string{"host.name"}},
+		{"payload.title", "reporter.version", []string{"reporter.version"}},
+	}, config.PayloadExpressions())
+
+	errs := config.CheckPayloadVariables(EvalVariables{"load": "1", "host.name": "box"})
+	assert.Equal(t, []string{
+		"payload.fields[0].value: expression '100 * load / cpus' needs variable 'cpus' which is not defined",
+		"payload.title: expression 'reporter.version' needs variable 'reporter.version' which is not defined",
+	}, configErrorStrings(errs))
+
+	// Compiled templates are used when building the payload.
+	payload, errs2 := buildPayload(config.Payload, EvalVariables{
+		"load": "2", "cpus": "4", "host.name": "box", "reporter.version": "1.0",
+	}, config.templates)
+	assert.Empty(t, errs2)
+	assert.Equal(t, "box (1.0)", payload["title"])
+	assert.Equal(t, "50", payload["fields"].([]interface{})[0].(StringKeyMap)["value"])
+}
+
+func TestReportsValidationErrors(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"config.json": `{
+	"target": ["http://localhost"],
+	"gatherers": [{"name": "load", "url": "http://localhost/load"}],
+	"reports": [
+		{"name": "heartbeat", "target": ["localhost"], "gatherers": ["load", "disk"]},
+		{"name": "heartbeat", "interval": "-1s"},
+		{"name": "with space", "payload": {"a": "${1 +}"}},
+		{},
+	],
+}`,
+	})
+
+	_, err := ReadConfig(filepath.Join(dir, "config.json"))
+	var errs ConfigErrors
+	assert.ErrorAs(t, err, &errs)
+	for i := range errs {
+		errs[i].File = ""
+	}
+
+	assert.Equal(t, []string{
+		"2:12: target: top-level target must not be used together with reports",
+		"5:36: reports[0].target[0]: target URL 'localhost' is not an acceptable URL",
+		"5:72: reports[0].gatherers[1]: report 'heartbeat' uses unknown gatherer 'disk'",
+		"6:12: reports[1].name: report name 'heartbeat' is not unique",
+		"6:37: reports[1].interval: report 'heartbeat' has negative interval",
+		"7:12: reports[2].name: report name 'with space' may contain only letters, digits and underscores",
+		"7:43: reports[2].payload.a: cannot parse expression '1 +': unexpected end of expression",
+		"8:3: reports[3]: report has no name",
+	}, configErrorStrings(errs))
+}
+
+func TestPayloadConditions(t *testing.T) {
+	config, err := buildConfigFromJson([]byte(`{
+	"payload": {
+		"raid": {"$if": "${defined(raid.status)}", "status": "${raid.status}"},
+		"gpu": {"$if": "${exists(gpu)}", "temp": "${gpu.temp}"},
+		"fields": [
+			{"$if": "${defined(load) * load}", "value": "${load}"},
+			{"$if": "${missing}", "value": "error"},
+			{"$if": 0, "value": "never"},
+			{"value": "always", "nested": {"$if": "${defined(nope)}"}},
+		],
+	},
+}`), "/opt/reporter")
+	assert.NoError(t, err)
+
+	payload, errs := buildPayload(deepcopy.Copy(config.Payload).(PayloadType), EvalVariables{
+		"raid.status": "degraded",
+		"load":        "0",
+	}, config.templates)
+	assert.Len(t, errs, 1)
+	assert.Equal(t, PayloadType{
+		"raid":   StringKeyMap{"status": "degraded"},
+		"fields": []interface{}{StringKeyMap{"value": "always"}},
+	}, payload)
+
+	payload, _ = buildPayload(deepcopy.Copy(config.Payload).(PayloadType), EvalVariables{
+		"gpu.temp": "60",
+		"load":     "2",
+	}, config.templates)
+	assert.Equal(t, PayloadType{
+		"gpu": StringKeyMap{"temp": "60"},
+		"fields": []interface{}{
+			StringKeyMap{"value": "2"},
+			StringKeyMap{"value": "always"},
+		},
+	}, payload)
+
+	// Variables of conditional objects may be missing.
+	assert.Empty(t, config.CheckPayloadVariables(EvalVariables{}))
+
+	_, err = buildConfigFromJson([]byte(`{
+	"payload": {"$if": "1", "a": {"$if": {}}, "b": [{"$if": "${a >}"}]},
+}`), "/opt/reporter")
+	var configErrs ConfigErrors
+	assert.ErrorAs(t, err, &configErrs)
+	assert.Equal(t, []string{
+		"2:21: payload.$if: '$if' can be used only in nested objects and array items",
+		"2:39: payload.a.$if: condition must be a string or a number",
+		"2:58: payload.b[0].$if: cannot parse expression 'a >': unexpected character '>' at position 3",
+	}, configErrorStrings(configErrs))
+}
+
+func TestPayloadLoops(t *testing.T) {
+	config, err := buildConfigFromJson([]byte(`{
+	"payload": {
+		"fields": [
+			{"title": "Load", "value": "${load}"},
+			{
+				"$each": "disk.*.used",
+				"$as": "disk",
+				"title": "Disk ${disk} (${$key})",
+				"value": "${$value / 2}",
+				"parts": [{"$each": "disk.${disk}.part.*", "name": "${$1}"}],
+			},
+			{"$each": "net.*.*", "$if": "${$2 - 1}", "value": "${$1}/${$2}"},
+		],
+	},
+}`), "/opt/reporter")
+	assert.NoError(t, err)
+
+	vars := EvalVariables{
+		"load":             "1",
+		"disk.sdb.used":    "10",
+		"disk.sda.used":    "x",
+		"disk.sda.free":    "5",
+		"disk.sda.part.1":  "boot",
+		"disk.sda.part.2":  "root",
+		"disk.md.0.used":   "1",
+		"net.eth0.1":       "a",
+		"net.eth0.2":       "b",
+		"net.eth0.2.extra": "c",
+	}
+	payload, errs := buildPayload(deepcopy.Copy(config.Payload).(PayloadType), vars, config.templates)
+	assert.Len(t, errs, 1)
+	assert.Equal(t, PayloadType{
+		"fields": []interface{}{
+			StringKeyMap{"title": "Load", "value": "1"},
+			StringKeyMap{
+				"title": "Disk sda (disk.sda.used)",
+				"value": "${$value / 2}",
+				"parts": []interface{}{StringKeyMap{"name": "1"}, StringKeyMap{"name": "2"}},
+			},
+			StringKeyMap{
+				"title": "Disk sdb (disk.sdb.used)",
+				"value": "5",
+				"parts": []interface{}{},
+			},
+			StringKeyMap{"value": "eth0/2"},
+		},
+	}, payload)
+
+	// Variables bound by loops are not checked.
+	assert.Empty(t, config.CheckPayloadVariables(EvalVariables{"load": "1"}))
+
+	_, err = buildConfigFromJson([]byte(`{
+	"payload": {
+		"$each": "x.*",
+		"a": {"$as": "x"},
+		"b": [{"$each": "x"}, {"$as": "x"}, {"$each": "x.*", "$as": "a, b c"}, {"$each": "x.*", "$as": "a, b"}],
+	},
+}`), "/opt/reporter")
+	var configErrs ConfigErrors
+	assert.ErrorAs(t, err, &configErrs)
+	assert.Equal(t, []string{
+		"3:12: payload.$each: '$each' can be used only in array items",
+		"4:16: payload.a.$as: '$as' can be used only in array items",
+		"5:19: payload.b[0].$each: pattern 'x' has no '*' wildcard",
+		"5:33: payload.b[1].$as: '$as' can be used only together with '$each'",
+		"5:63: payload.b[2].$as: name 'b c' may contain only letters, digits and underscores",
+		"5:63: payload.b[2].$as: 2 name(s) given for 1 wildcard(s)",
+		"5:98: payload.b[3].$as: 2 name(s) given for 1 wildcard(s)",
+	}, configErrorStrings(configErrs))
+}
@@ -0,0 +1,352 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A single problem found in config.
+type ConfigError struct {
+	Path string // Path of the problematic value, e.g. "payload.fields[2].value".
+	File string
+	Line int // From 1, zero if unknown.
+	Col  int
+	Msg  string
+}
+
+func (e ConfigError) Error() string {
+	position := e.File
+	if e.Line != 0 {
+		position = strings.TrimPrefix(fmt.Sprintf("%s:%d:%d", e.File, e.Line, e.Col), ":")
+	}
+
+	var parts []string
+	if position != "" {
+		parts = append(parts, position)
+	}
+	if e.Path != "" {
+		parts = append(parts, e.Path)
+	}
+
+	return strings.Join(append(parts, e.Msg), ": ")
+}
+
+// All problems found in config.
+type ConfigErrors []ConfigError
+
+func (e ConfigErrors) Error() string {
+	if len(e) == 1 {
+		return e[0].Error()
+	}
+
+	lines := []string{fmt.Sprintf("%d problems found", len(e))}
+	for _, err := range e {
+		lines = append(lines, "  "+err.Error())
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func (e *ConfigErrors) add(path string, format string, args ...interface{}) {
+	*e = append(*e, ConfigError{Path: path, Msg: fmt.Sprintf(format, args...)})
+}
+
+func (e *ConfigErrors) addAt(pos configPos, path string, format string, args ...interface{}) {
+	*e = append(*e, ConfigError{
+		Path: path,
+		File: pos.file,
+		Line: pos.line,
+		Col:  pos.col,
+		Msg:  fmt.Sprintf(format, args...),
+	})
+}
+
+// Adds semantic problems (which have no position yet) found in config built
+// from the root node. Problems of values which already have a problem
+// reported inside or around them are skipped, as they are most likely caused
+// by it.
+func (e *ConfigErrors) addLocated(root *configNode, problems ConfigErrors) {
+	reported := append(ConfigErrors{}, *e...)
+
+	for _, problem := range problems {
+		if reported.cover(problem.Path) {
+			continue
+		}
+
+		pos := root.lookupPos(problem.Path)
+		problem.File, problem.Line, problem.Col = pos.file, pos.line, pos.col
+		*e = append(*e, problem)
+	}
+
+	sort.SliceStable(*e, func(i, j int) bool {
+		a, b := (*e)[i], (*e)[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		return a.Line < b.Line || (a.Line == b.Line && a.Col < b.Col)
+	})
+}
+
+// Returns true if there's a problem reported for the path, any of its parents
+// or any of its children.
+func (e ConfigErrors) cover(path string) bool {
+	for _, err := range e {
+		if isConfigSubpath(path, err.Path) || isConfigSubpath(err.Path, path) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns true if the path is the same as the parent path or is inside it.
+func isConfigSubpath(path string, parent string) bool {
+	return path == parent ||
+		strings.HasPrefix(path, parent+".") ||
+		strings.HasPrefix(path, parent+"[")
+}
+
+func isConfigSubpathOfAny(path string, parents []string) bool {
+	for _, parent := range parents {
+		if isConfigSubpath(path, parent) {
+			return true
+		}
+	}
+
+	return false
+}
+
+var (
+	typeDuration       = reflect.TypeOf(Duration(0))
+	typeGathererConfig = reflect.TypeOf(GathererConfig{})
+	typePayload        = reflect.TypeOf(PayloadType{})
+)
+
+// Checks that the config node matches the structure of the Go type (unknown
+// keys, wrong types) and returns the node's value with problematic parts left
+// out, so that it can be always decoded into the type. Problems found are
+// added into errs.
+func checkConfigNode(node *configNode, t reflect.Type, path string, errs *ConfigErrors) interface{} {
+	switch t {
+	case typeDuration:
+		switch node.kind {
+		case configNodeNumber:
+			return node.value
+		case configNodeString:
+			if _, err := time.ParseDuration(node.value.(string)); err != nil {
+				errs.addAt(node.pos, path, "invalid duration '%s' (use e.g. \"30s\" or \"1m30s\")", node.value)
+				return nil
+			}
+			return node.value
+		}
+		errs.addAt(node.pos, path, "expected duration as string or number of seconds, got %s", node.kind)
+		return nil
+	case typeGathererConfig:
+		// Plain string is a path to executable gatherer.
+		if node.kind == configNodeString {
+			return node.value
+		}
+	case typePayload:
+		if node.kind != configNodeObject {
+			errs.addAt(node.pos, path, "expected object, got %s", node.kind)
+			return nil
+		}
+		checkPayloadNode(node, path, errs)
+		return node.toInterface()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		return checkConfigStruct(node, t, path, errs)
+	case reflect.Map:
+		if node.kind != configNodeObject {
+			errs.addAt(node.pos, path, "expected object, got %s", node.kind)
+			return nil
+		}
+		result := make(StringKeyMap)
+		for _, entry := range node.entries {
+			if entry.value.kind == configNodeNull {
+				continue
+			}
+			value := checkConfigNode(entry.value, t.Elem(), configPathKey(path, entry.key), errs)
+			if value != nil {
+				result[entry.key] = value
+			}
+		}
+		return result
+	case reflect.Slice:
+		if node.kind != configNodeArray {
+			errs.addAt(node.pos, path, "expected array, got %s", node.kind)
+			return nil
+		}
+		result := make([]interface{}, len(node.items))
+		for i, item := range node.items {
+			result[i] = checkConfigNode(item, t.Elem(), configPathIndex(path, i), errs)
+		}
+		return result
+	case reflect.String:
+		return checkConfigScalar(node, configNodeString, path, errs)
+	case reflect.Bool:
+		return checkConfigScalar(node, configNodeBool, path, errs)
+	case reflect.Int, reflect.Int64:
+		value := checkConfigScalar(node, configNodeNumber, path, errs)
+		if value != nil {
+			if _, err := value.(json.Number).Int64(); err != nil {
+				errs.addAt(node.pos, path, "expected integer, got '%s'", value)
+				return nil
+			}
+		}
+		return value
+	case reflect.Interface:
+		return node.toInterface()
+	}
+
+	panic(fmt.Sprintf("unsupported config type %s", t))
+}
+
+// Returns key of the struct field in config.
+func configFieldName(field reflect.StructField) string {
+	name := strings.Split(field.Tag.Get("json"), ",")[0]
+	if name == "" {
+		name = strings.ToLower(field.Name)
+	}
+
+	return name
+}
+
+func checkConfigScalar(node *configNode, kind configNodeKind, path string, errs *ConfigErrors) interface{} {
+	if node.kind != kind {
+		errs.addAt(node.pos, path, "expected %s, got %s", kind, node.kind)
+		return nil
+	}
+
+	return node.value
+}
+
+func checkConfigStruct(node *configNode, t reflect.Type, path string, errs *ConfigErrors) interface{} {
+	if node.kind != configNodeObject {
+		errs.addAt(node.pos, path, "expected object, got %s", node.kind)
+		return nil
+	}
+
+	// Find fields by their names in config (keys are matched
+	// case-insensitively, just as json.Unmarshal() does).
+	fields := make(map[string]reflect.StructField)
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := configFieldName(field)
+		fields[strings.ToLower(name)] = field
+		names = append(names, name)
+	}
+
+	result := make(StringKeyMap)
+	for _, entry := range node.entries {
+		entryPath := configPathKey(path, entry.key)
+
+		field, ok := fields[strings.ToLower(entry.key)]
+		if !ok {
+			msg := fmt.Sprintf("unknown key '%s'", entry.key)
+			if suggestion := suggestName(entry.key, names); suggestion != "" {
+				msg += fmt.Sprintf(" (did you mean '%s'?)", suggestion)
+			}
+			errs.addAt(entry.keyPos, entryPath, "%s", msg)
+			continue
+		}
+
+		// Null means "not specified".
+		if entry.value.kind == configNodeNull {
+			continue
+		}
+
+		value := checkConfigNode(entry.value, field.Type, entryPath, errs)
+		if value != nil {
+			result[entry.key] = value
+		}
+	}
+
+	return result
+}
+
+// Checks values of payload template. The payload may contain only strings,
+// numbers, objects and arrays of objects.
+func checkPayloadNode(node *configNode, path string, errs *ConfigErrors) {
+	for _, entry := range node.entries {
+		value := entry.value
+		valuePath := configPathKey(path, entry.key)
+
+		switch value.kind {
+		case configNodeString, configNodeNumber:
+		case configNodeObject:
+			checkPayloadNode(value, valuePath, errs)
+		case configNodeArray:
+			for i, item := range value.items {
+				itemPath := configPathIndex(valuePath, i)
+				if item.kind != configNodeObject {
+					errs.addAt(item.pos, itemPath, "expected object, got %s", item.kind)
+					continue
+				}
+				checkPayloadNode(item, itemPath, errs)
+			}
+		default:
+			errs.addAt(value.pos, valuePath, "expected string, number, object or array, got %s", value.kind)
+		}
+	}
+}
+
+// Returns the name most similar to the (probably mistyped) name, if there's
+// some similar enough.
+func suggestName(name string, names []string) string {
+	best := ""
+	bestDistance := 3 // Suggest only names at most 2 edits away.
+
+	for _, candidate := range names {
+		distance := editDistance(strings.ToLower(name), strings.ToLower(candidate))
+		if distance < bestDistance {
+			best, bestDistance = candidate, distance
+		}
+	}
+
+	return best
+}
+
+// Levenshtein distance of two strings.
+func editDistance(a string, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+
+	return previous[len(b)]
+}
+
+func minInt(values ...int) int {
+	result := values[0]
+	for _, v := range values[1:] {
+		if v < result {
+			result = v
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,341 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	ConfigFormatJson = "json"
+	ConfigFormatYaml = "yaml"
+	ConfigFormatToml = "toml"
+)
+
+// Returns format of the config file according to its extension. JSON (with
+// comments) is the default.
+func configFormatOf(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return ConfigFormatYaml
+	case ".toml":
+		return ConfigFormatToml
+	}
+
+	return ConfigFormatJson
+}
+
+// Parses config file contents in the specified format into a tree of config
+// nodes, so that all formats are validated and built into Config the same
+// way.
+func parseConfigNode(data []byte, format string, file string) (*configNode, error) {
+	switch format {
+	case ConfigFormatYaml:
+		return parseYamlConfigNode(data, file)
+	case ConfigFormatToml:
+		return parseTomlConfigNode(data, file)
+	}
+
+	return parseJsonConfigNode(data, file)
+}
+
+var RE_YAML_ERROR_LINE = regexp.MustCompile(`^yaml: line (\d+): `)
+
+func parseYamlConfigNode(data []byte, file string) (*configNode, error) {
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		// Make the error position the same as for other formats.
+		problem := ConfigError{File: file, Msg: err.Error()}
+		if match := RE_YAML_ERROR_LINE.FindStringSubmatch(err.Error()); match != nil {
+			problem.Line, _ = strconv.Atoi(match[1])
+			problem.Col = 1
+			problem.Msg = strings.TrimPrefix(err.Error(), match[0])
+		}
+		return nil, ConfigErrors{problem}
+	}
+
+	// Empty document.
+	if len(document.Content) == 0 {
+		return &configNode{kind: configNodeNull, pos: configPos{file, 1, 1}}, nil
+	}
+
+	return yamlToConfigNode(document.Content[0], file)
+}
+
+func yamlToConfigNode(n *yaml.Node, file string) (*configNode, error) {
+	pos := configPos{file: file, line: n.Line, col: n.Column}
+	node := &configNode{pos: pos}
+
+	errorAt := func(pos configPos, msg string) error {
+		return ConfigErrors{{File: pos.file, Line: pos.line, Col: pos.col, Msg: msg}}
+	}
+
+	switch n.Kind {
+	case yaml.AliasNode:
+		return yamlToConfigNode(n.Alias, file)
+	case yaml.MappingNode:
+		node.kind = configNodeObject
+		seen := make(map[string]bool)
+		var merged []configEntry
+
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			keyNode, valueNode := n.Content[i], n.Content[i+1]
+			keyPos := configPos{file: file, line: keyNode.Line, col: keyNode.Column}
+
+			value, err := yamlToConfigNode(valueNode, file)
+			if err != nil {
+				return nil, err
+			}
+
+			// Merge key ("<<: *alias") brings in entries of another mapping
+			// (or a list of mappings) unless they're specified explicitly.
+			if keyNode.ShortTag() == "!!merge" {
+				sources := []*configNode{value}
+				if value.kind == configNodeArray {
+					sources = value.items
+				}
+				for _, source := range sources {
+					if source.kind != configNodeObject {
+						return nil, errorAt(keyPos, "merge key needs a mapping")
+					}
+					merged = append(merged, source.entries...)
+				}
+				continue
+			}
+
+			key := keyNode.Value
+			if seen[key] {
+				return nil, errorAt(keyPos, fmt.Sprintf("duplicate key '%s'", key))
+			}
+			seen[key] = true
+
+			node.entries = append(node.entries, configEntry{key: key, keyPos: keyPos, value: value})
+		}
+
+		for _, entry := range merged {
+			if !seen[entry.key] {
+				seen[entry.key] = true
+				node.entries = append(node.entries, entry)
+			}
+		}
+	case yaml.SequenceNode:
+		node.kind = configNodeArray
+		for _, itemNode := range n.Content {
+			item, err := yamlToConfigNode(itemNode, file)
+			if err != nil {
+				return nil, err
+			}
+			node.items = append(node.items, item)
+		}
+	case yaml.ScalarNode:
+		switch n.ShortTag() {
+		case "!!null":
+			node.kind = configNodeNull
+		case "!!bool":
+			var value bool
+			if err := n.Decode(&value); err != nil {
+				return nil, errorAt(pos, err.Error())
+			}
+			node.kind, node.value = configNodeBool, value
+		case "!!int":
+			var value int64
+			if err := n.Decode(&value); err != nil {
+				return nil, errorAt(pos, err.Error())
+			}
+			node.kind, node.value = configNodeNumber, json.Number(strconv.FormatInt(value, 10))
+		case "!!float":
+			var value float64
+			if err := n.Decode(&value); err != nil {
+				return nil, errorAt(pos, err.Error())
+			}
+			number, err := configNumber(value)
+			if err != nil {
+				return nil, errorAt(pos, err.Error())
+			}
+			node.kind, node.value = configNodeNumber, number
+		default:
+			// Strings, timestamps and anything else are used as strings.
+			node.kind, node.value = configNodeString, n.Value
+		}
+	default:
+		return nil, errorAt(pos, "unsupported YAML node")
+	}
+
+	return node, nil
+}
+
+func parseTomlConfigNode(data []byte, file string) (*configNode, error) {
+	var document map[string]interface{}
+	if _, err := toml.Decode(string(data), &document); err != nil {
+		problem := ConfigError{File: file, Msg: err.Error()}
+		var parseErr toml.ParseError
+		if errors.As(err, &parseErr) {
+			problem.Line, problem.Col = parseErr.Position.Line, parseErr.Position.Col
+			problem.Msg = parseErr.Message
+		}
+		return nil, ConfigErrors{problem}
+	}
+
+	positions := locateTomlKeys(string(data), file)
+	root := configPos{file: file, line: 1, col: 1}
+
+	return tomlToConfigNode(document, "", root, positions)
+}
+
+func tomlToConfigNode(
+	value interface{},
+	path string,
+	pos configPos,
+	positions map[string]configPos,
+) (*configNode, error) {
+	if known, ok := positions[path]; ok {
+		pos = known
+	}
+	node := &configNode{pos: pos}
+
+	switch value := value.(type) {
+	case map[string]interface{}:
+		node.kind = configNodeObject
+
+		keys := make([]string, 0, len(value))
+		for k := range value {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			entryPath := configPathKey(path, k)
+			entry, err := tomlToConfigNode(value[k], entryPath, pos, positions)
+			if err != nil {
+				return nil, err
+			}
+			node.entries = append(node.entries, configEntry{key: k, keyPos: entry.pos, value: entry})
+		}
+
+		// Keep the order of the source, as the other formats do.
+		sort.SliceStable(node.entries, func(i, j int) bool {
+			a, b := node.entries[i].keyPos, node.entries[j].keyPos
+			return a.line < b.line || (a.line == b.line && a.col < b.col)
+		})
+	case []map[string]interface{}:
+		// Array of tables.
+		node.kind = configNodeArray
+		for i, item := range value {
+			itemNode, err := tomlToConfigNode(item, configPathIndex(path, i), pos, positions)
+			if err != nil {
+				return nil, err
+			}
+			node.items = append(node.items, itemNode)
+		}
+	case []interface{}:
+		node.kind = configNodeArray
+		for i, item := range value {
+			itemNode, err := tomlToConfigNode(item, configPathIndex(path, i), pos, positions)
+			if err != nil {
+				return nil, err
+			}
+			node.items = append(node.items, itemNode)
+		}
+	case bool:
+		node.kind, node.value = configNodeBool, value
+	case int64:
+		node.kind, node.value = configNodeNumber, json.Number(strconv.FormatInt(value, 10))
+	case float64:
+		number, err := configNumber(value)
+		if err != nil {
+			return nil, ConfigErrors{{Path: path, File: pos.file, Line: pos.line, Col: pos.col, Msg: err.Error()}}
+		}
+		node.kind, node.value = configNodeNumber, number
+	case string:
+		node.kind, node.value = configNodeString, value
+	case time.Time:
+		node.kind, node.value = configNodeString, value.Format(time.RFC3339Nano)
+	default:
+		// Local dates and times.
+		node.kind, node.value = configNodeString, fmt.Sprint(value)
+	}
+
+	return node, nil
+}
+
+func configNumber(value float64) (json.Number, error) {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return "", fmt.Errorf("unsupported number '%v'", value)
+	}
+
+	return json.Number(strconv.FormatFloat(value, 'f', -1, 64)), nil
+}
+
+var (
+	RE_TOML_TABLE_HEADER = regexp.MustCompile(`^\s*(\[\[?)\s*([^\[\]]+?)\s*\]\]?`)
+	RE_TOML_KEY          = regexp.MustCompile(`^(\s*)("[^"]*"|'[^']*'|[A-Za-z0-9_\-.]+)\s*=`)
+)
+
+// The TOML decoder doesn't provide positions of values, so we find positions
+// of keys (as config paths) by scanning the source line by line. This covers
+// keys of tables (including arrays of tables) and dotted keys, which is where
+// nearly all problems are.
+func locateTomlKeys(source string, file string) map[string]configPos {
+	positions := make(map[string]configPos)
+	tableCounts := make(map[string]int)
+	table := ""
+	inMultiline := ""
+
+	for i, line := range strings.Split(source, "\n") {
+		lineNo := i + 1
+
+		// Skip contents of multi-line strings.
+		if inMultiline != "" {
+			if strings.Count(line, inMultiline)%2 == 1 {
+				inMultiline = ""
+			}
+			continue
+		}
+
+		if match := RE_TOML_TABLE_HEADER.FindStringSubmatchIndex(line); match != nil {
+			name := tomlKeyPath(line[match[4]:match[5]])
+			if line[match[2]:match[3]] == "[[" {
+				index := tableCounts[name]
+				tableCounts[name]++
+				name = configPathIndex(name, index)
+			}
+			table = name
+			positions[table] = configPos{file: file, line: lineNo, col: match[4] + 1}
+			continue
+		}
+
+		if match := RE_TOML_KEY.FindStringSubmatchIndex(line); match != nil {
+			key := tomlKeyPath(line[match[4]:match[5]])
+			positions[configPathKey(table, key)] = configPos{file: file, line: lineNo, col: match[4] + 1}
+
+			rest := line[match[1]:]
+			for _, quotes := range []string{`"""`, `'''`} {
+				if strings.Count(rest, quotes)%2 == 1 {
+					inMultiline = quotes
+				}
+			}
+		}
+	}
+
+	return positions
+}
+
+// Converts TOML key (possibly dotted and quoted) into config path.
+func tomlKeyPath(key string) string {
+	parts := strings.Split(key, ".")
+	for i, part := range parts {
+		parts[i] = strings.Trim(strings.TrimSpace(part), `"'`)
+	}
+
+	return strings.Join(parts, ".")
+}
@@ -0,0 +1,190 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const formatsJsonConfig = `{
+	"target": ["http://localhost/report"],
+	"gatherers": [
+		"./machine.sh",
+		{"url": "http://127.0.0.1:9100/metrics", "format": "prometheus", "timeout": "2s"},
+	],
+	"env": {"SOME_VAR": "value"},
+	"logging": {"max_size_mb": 5, "compress": true},
+	"payload": {
+		"title": "${host.name}",
+		"ratio": 0.5,
+		"fields": [{"value": "${100 * load / cpus}"}],
+	},
+}`
+
+const formatsYamlConfig = `
+target:
+  - http://localhost/report
+gatherers:
+  - ./machine.sh
+  - url: http://127.0.0.1:9100/metrics
+    format: prometheus
+    timeout: 2s
+env:
+  SOME_VAR: value
+logging:
+  max_size_mb: 5
+  compress: true
+payload:
+  title: "${host.name}"
+  ratio: 0.5
+  fields:
+    - value: "${100 * load / cpus}"
+`
+
+const formatsTomlConfig = `
+target = ["http://localhost/report"]
+gatherers = [
+	"./machine.sh",
+	{url = "http://127.0.0.1:9100/metrics", format = "prometheus", timeout = "2s"},
+]
+
+[env]
+SOME_VAR = "value"
+
+[logging]
+max_size_mb = 5
+compress = true
+
+[payload]
+title = "${host.name}"
+ratio = 0.5
+
+[[payload.fields]]
+value = "${100 * load / cpus}"
+`
+
+func writeFormatsConfig(t *testing.T, name string, content string) string {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "machine.sh"), []byte("#!/bin/sh\n"), 0755)
+
+	path := filepath.Join(dir, name)
+	os.WriteFile(path, []byte(content), 0644)
+
+	return path
+}
+
+func TestConfigFormats(t *testing.T) {
+	expected, err := ReadConfig(writeFormatsConfig(t, "config.json", formatsJsonConfig))
+	assert.NoError(t, err)
+
+	for name, content := range map[string]string{
+		"config.yaml": formatsYamlConfig,
+		"config.yml":  formatsYamlConfig,
+		"config.toml": formatsTomlConfig,
+	} {
+		config, err := ReadConfig(writeFormatsConfig(t, name, content))
+		assert.NoError(t, err, name)
+
+		assert.Equal(t, expected.Target, config.Target, name)
+		assert.Equal(t, expected.Env, config.Env, name)
+		assert.Equal(t, expected.Logging, config.Logging, name)
+		assert.Equal(t, expected.Payload, config.Payload, name)
+		assert.Equal(t, expected.PayloadExpressions(), config.PayloadExpressions(), name)
+		assert.Len(t, config.Gatherers, 2, name)
+		assert.Equal(t, "machine", config.Gatherers[0].Name, name)
+		assert.Equal(t, expected.Gatherers[1], config.Gatherers[1], name)
+	}
+}
+
+func TestSearchConfigFormats(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "config"), 0755)
+	os.WriteFile(filepath.Join(dir, "config", "config.toml"), []byte(""), 0644)
+
+	path, err := SearchConfig(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "config", "config.toml"), path)
+
+	// Config in the directory itself is preferred.
+	os.WriteFile(filepath.Join(dir, "config.yml"), []byte(""), 0644)
+	path, err = SearchConfig(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "config.yml"), path)
+}
+
+func TestYamlConfigErrors(t *testing.T) {
+	_, err := ReadConfig(writeFormatsConfig(t, "config.yaml", `
+target: http://localhost
+gatherers:
+  - path: ./machine.sh
+    on_failur: keep
+payload:
+  ok: true
+  value: "${1 +}"
+`))
+
+	var errs ConfigErrors
+	assert.ErrorAs(t, err, &errs)
+	for i := range errs {
+		errs[i].File = ""
+	}
+
+	assert.Equal(t, []string{
+		"2:9: target: expected array, got string",
+		"5:5: gatherers[0].on_failur: unknown key 'on_failur' (did you mean 'on_failure'?)",
+		"7:7: payload.ok: expected string, number, object or array, got boolean",
+		"8:10: payload.value: cannot parse expression '1 +': unexpected end of expression",
+	}, configErrorStrings(errs))
+
+	_, err = parseYamlConfigNode([]byte("a: 1\nb: x: y\n"), "config.yaml")
+	assert.EqualError(t, err, "config.yaml:2:1: mapping values are not allowed in this context")
+
+	_, err = parseYamlConfigNode([]byte("a: 1\na: 2\n"), "config.yaml")
+	assert.EqualError(t, err, "config.yaml:2:1: duplicate key 'a'")
+}
+
+func TestYamlMergeKeys(t *testing.T) {
+	root, err := parseYamlConfigNode([]byte(`
+defaults: &defaults
+  format: json
+  timeout: 2s
+gatherer:
+  <<: *defaults
+  timeout: 5s
+`), "config.yaml")
+	assert.NoError(t, err)
+
+	assert.Equal(t, StringKeyMap{"format": "json", "timeout": "5s"}, root.toInterface().(StringKeyMap)["gatherer"])
+}
+
+func TestTomlConfigErrors(t *testing.T) {
+	_, err := ReadConfig(writeFormatsConfig(t, "config.toml", `
+target = "http://localhost"
+
+[[gatherers]]
+path = "./machine.sh"
+on_failur = "keep"
+
+[payload]
+ok = true
+value = "${1 +}"
+`))
+
+	var errs ConfigErrors
+	assert.ErrorAs(t, err, &errs)
+	for i := range errs {
+		errs[i].File = ""
+	}
+
+	assert.Equal(t, []string{
+		"2:1: target: expected array, got string",
+		"6:1: gatherers[0].on_failur: unknown key 'on_failur' (did you mean 'on_failure'?)",
+		"9:1: payload.ok: expected string, number, object or array, got boolean",
+		"10:1: payload.value: cannot parse expression '1 +': unexpected end of expression",
+	}, configErrorStrings(errs))
+
+	_, err = parseTomlConfigNode([]byte("a = 1\nb = [1, 2\n"), "config.toml")
+	assert.EqualError(t, err, "config.toml:2:10: expected a comma (',') or array terminator (']'), but got end of file")
+}
@@ -0,0 +1,360 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Key of config (or config fragment) listing other files to merge into it.
+const configIncludeKey = "include"
+
+// Directory next to the main config with fragments merged automatically.
+const configFragmentsDir = "config.d"
+
+var configFragmentPatterns = []string{"*.json", "*.yaml", "*.yml", "*.toml"}
+
+// Reads the config file and merges all its fragments into it - files from
+// its "include" list (recursively) and then files from "config.d" directory
+// next to it (in order of their names). Later fragments are merged over
+// earlier ones:
+//   - objects are merged key by key (recursively),
+//   - arrays are appended to (e.g. "target", "gatherers" or "fields" in
+//     payload), skipping scalar values which are already there,
+//   - other values are replaced.
+//
+// Relative gatherer paths of each fragment are resolved against the fragment's
+// own directory. Overrides are applied on top of the merged config.
+func readConfigNode(configPath string, overrides []ConfigOverride) (*configNode, error) {
+	// Missing main config is not a problem of the config.
+	if _, err := os.Stat(configPath); err != nil {
+		return nil, err
+	}
+
+	loader := &configLoader{loaded: make(map[string]bool)}
+
+	root := loader.load(configPath, configPos{}, true)
+	if root != nil {
+		fragments, err := globConfigFragments(filepath.Join(filepath.Dir(configPath), configFragmentsDir))
+		if err != nil {
+			return nil, err
+		}
+		for _, fragment := range fragments {
+			if node := loader.load(fragment, configPos{}, false); node != nil {
+				root = mergeConfigNodes(root, node, "", &loader.errs)
+			}
+		}
+
+		for _, override := range overrides {
+			applyConfigOverride(root, override, &loader.errs)
+		}
+	}
+
+	if len(loader.errs) != 0 {
+		return nil, loader.errs
+	}
+
+	return root, nil
+}
+
+type configLoader struct {
+	loaded map[string]bool
+	errs   ConfigErrors
+}
+
+// Loads a single config file with its includes merged into it. Returns nil if
+// the file cannot be loaded (problems are added into errors).
+func (l *configLoader) load(path string, includedAt configPos, isMain bool) *configNode {
+	if l.loaded[path] {
+		l.errs.addAt(includedAt, "", "config '%s' is included more than once", path)
+		return nil
+	}
+	l.loaded[path] = true
+
+	if !isMain {
+		log.Infof("Including config: %s", path)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		l.errs.addAt(includedAt, "", "%s", err.Error())
+		return nil
+	}
+
+	node, err := parseConfigNode(data, configFormatOf(path), path)
+	if err != nil {
+		if problems, ok := err.(ConfigErrors); ok {
+			l.errs = append(l.errs, problems...)
+		} else {
+			l.errs.addAt(configPos{file: path}, "", "%s", err.Error())
+		}
+		return nil
+	}
+
+	// The main config's gatherers are resolved when building the config.
+	if !isMain {
+		resolveFragmentGathererPaths(node, filepath.Dir(path))
+	}
+
+	for _, include := range l.takeIncludes(node, filepath.Dir(path)) {
+		if included := l.load(include.path, include.pos, false); included != nil {
+			node = mergeConfigNodes(node, included, "", &l.errs)
+		}
+	}
+
+	return node
+}
+
+type configInclude struct {
+	path string
+	pos  configPos
+}
+
+// Removes "include" entry from the config node and returns paths of files it
+// refers to. Paths can be glob patterns and they're relative to the directory
+// of the config.
+func (l *configLoader) takeIncludes(node *configNode, dir string) []configInclude {
+	if node.kind != configNodeObject {
+		return nil
+	}
+
+	var includeNode *configNode
+	for i, entry := range node.entries {
+		if entry.key == configIncludeKey {
+			includeNode = entry.value
+			node.entries = append(node.entries[:i:i], node.entries[i+1:]...)
+			break
+		}
+	}
+	if includeNode == nil {
+		return nil
+	}
+
+	patterns := []*configNode{includeNode}
+	if includeNode.kind == configNodeArray {
+		patterns = includeNode.items
+	}
+
+	var result []configInclude
+	for i, pattern := range patterns {
+		path := configIncludeKey
+		if includeNode.kind == configNodeArray {
+			path = configPathIndex(path, i)
+		}
+
+		if pattern.kind != configNodeString {
+			l.errs.addAt(pattern.pos, path, "expected string, got %s", pattern.kind)
+			continue
+		}
+
+		include := pattern.value.(string)
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(dir, include)
+		}
+
+		matches, err := filepath.Glob(include)
+		if err != nil {
+			l.errs.addAt(pattern.pos, path, "invalid pattern '%s': %s", pattern.value, err.Error())
+			continue
+		}
+		if len(matches) == 0 && !hasGlobMeta(include) {
+			l.errs.addAt(pattern.pos, path, "included config '%s' not found", include)
+			continue
+		}
+
+		for _, match := range matches {
+			result = append(result, configInclude{path: match, pos: pattern.pos})
+		}
+	}
+
+	return result
+}
+
+func hasGlobMeta(path string) bool {
+	return strings.ContainsAny(path, `*?[\`)
+}
+
+// Returns config files in the directory sorted by their names (nothing if the
+// directory doesn't exist).
+func globConfigFragments(dir string) ([]string, error) {
+	var result []string
+
+	for _, pattern := range configFragmentPatterns {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, matches...)
+	}
+	sort.Strings(result)
+
+	return result, nil
+}
+
+// Makes relative paths of gatherers in the config fragment absolute.
+func resolveFragmentGathererPaths(node *configNode, dir string) {
+	gatherers := node.lookup("gatherers")
+	if gatherers == nil || gatherers.kind != configNodeArray {
+		return
+	}
+
+	for _, gatherer := range gatherers.items {
+		if gatherer.kind == configNodeObject {
+			gatherer = gatherer.lookup("path")
+		}
+		if gatherer == nil || gatherer.kind != configNodeString {
+			continue
+		}
+
+		if path := gatherer.value.(string); !filepath.IsAbs(path) {
+			gatherer.value = filepath.Join(dir, path)
+		}
+	}
+}
+
+// Merges the config node into another one and returns the result. Both nodes
+// may be modified.
+func mergeConfigNodes(dst *configNode, src *configNode, path string, errs *ConfigErrors) *configNode {
+	switch {
+	case dst.kind == configNodeNull:
+		return src
+	case src.kind == configNodeNull:
+		return dst
+	case dst.kind == configNodeObject && src.kind == configNodeObject:
+		for _, srcEntry := range src.entries {
+			entryPath := configPathKey(path, srcEntry.key)
+			merged := false
+
+			for i, dstEntry := range dst.entries {
+				if dstEntry.key == srcEntry.key {
+					dst.entries[i].value = mergeConfigNodes(dstEntry.value, srcEntry.value, entryPath, errs)
+					merged = true
+					break
+				}
+			}
+
+			if !merged {
+				dst.entries = append(dst.entries, srcEntry)
+			}
+		}
+		return dst
+	case dst.kind == configNodeArray && src.kind == configNodeArray:
+		for _, item := range src.items {
+			if !dst.containsScalar(item) {
+				dst.items = append(dst.items, item)
+			}
+		}
+		return dst
+	case dst.kind == configNodeObject || dst.kind == configNodeArray ||
+		src.kind == configNodeObject || src.kind == configNodeArray:
+		errs.addAt(
+			src.pos, path, "cannot merge %s into %s from %s:%d",
+			src.kind, dst.kind, dst.pos.file, dst.pos.line,
+		)
+		return dst
+	}
+
+	// Scalar values are replaced.
+	return src
+}
+
+// Returns true if the array node contains the same scalar value as the node.
+func (n *configNode) containsScalar(node *configNode) bool {
+	if node.kind == configNodeObject || node.kind == configNodeArray {
+		return false
+	}
+
+	for _, item := range n.items {
+		if item.kind == node.kind && item.value == node.value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns value of the object node's entry, nil if there's no such entry.
+func (n *configNode) lookup(key string) *configNode {
+	for _, entry := range n.entries {
+		if entry.key == key {
+			return entry.value
+		}
+	}
+
+	return nil
+}
+
+// Encodes the node as JSON, keeping the order of object keys.
+func (n *configNode) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+
+	switch n.kind {
+	case configNodeObject:
+		buf.WriteByte('{')
+		for i, entry := range n.entries {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			key, err := json.Marshal(entry.key)
+			if err != nil {
+				return nil, err
+			}
+			value, err := entry.value.MarshalJSON()
+			if err != nil {
+				return nil, err
+			}
+			buf.Write(key)
+			buf.WriteByte(':')
+			buf.Write(value)
+		}
+		buf.WriteByte('}')
+	case configNodeArray:
+		buf.WriteByte('[')
+		for i, item := range n.items {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			value, err := item.MarshalJSON()
+			if err != nil {
+				return nil, err
+			}
+			buf.Write(value)
+		}
+		buf.WriteByte(']')
+	default:
+		return json.Marshal(n.value)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Returns the config file with all its fragments merged into it and overrides
+// applied, as indented JSON. The merged config is not validated.
+func RenderConfig(configPath string, overrides ...ConfigOverride) ([]byte, error) {
+	configPath, err := filepath.Abs(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := readConfigNode(configPath, overrides)
+	if err != nil {
+		return nil, err
+	}
+
+	compact, err := root.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	var pretty bytes.Buffer
+	if err := json.Indent(&pretty, compact, "", "  "); err != nil {
+		return nil, err
+	}
+
+	return pretty.Bytes(), nil
+}
@@ -0,0 +1,139 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfigFiles(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		os.WriteFile(path, []byte(content), 0755)
+	}
+
+	return dir
+}
+
+func TestConfigIncludes(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"main/config.json": `{
+			"include": ["../teams/*.yaml", "../common.json"],
+			"target": ["http://localhost/a"],
+			"gatherers": ["./machine.sh"],
+			"env": {"A": "1", "B": "2"},
+			"payload": {
+				"machine": {"name": "box"},
+				"fields": [{"title": "Load"}],
+			},
+		}`,
+		"main/machine.sh": "#!/bin/sh\n",
+		"teams/app.yaml": `
+gatherers:
+  - path: ./app.sh
+payload:
+  machine:
+    title: Box
+  fields:
+    - title: Requests
+`,
+		"teams/app.sh": "#!/bin/sh\n",
+		"common.json": `{
+			"target": ["http://localhost/a", "http://localhost/b"],
+			"env": {"B": "3"},
+		}`,
+		"main/config.d/10-logging.toml": "[logging]\nlevel = \"debug\"\n",
+		"main/config.d/20-fields.json":  `{"payload": {"fields": [{"title": "Disk"}]}}`,
+	})
+
+	config, err := ReadConfig(filepath.Join(dir, "main", "config.json"))
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"http://localhost/a", "http://localhost/b"}, config.Target)
+	assert.Equal(t, map[string]string{"A": "1", "B": "3"}, config.Env)
+	assert.Equal(t, "debug", config.Logging.Level)
+
+	// Gatherer paths are relative to the file they're defined in.
+	assert.Len(t, config.Gatherers, 2)
+	assert.Equal(t, filepath.Join(dir, "main", "machine.sh"), config.Gatherers[0].Path)
+	assert.Equal(t, filepath.Join(dir, "teams", "app.sh"), config.Gatherers[1].Path)
+
+	assert.Equal(t, PayloadType{
+		"machine": StringKeyMap{"name": "box", "title": "Box"},
+		"fields": []interface{}{
+			StringKeyMap{"title": "Load"},
+			StringKeyMap{"title": "Requests"},
+			StringKeyMap{"title": "Disk"},
+		},
+	}, config.Payload)
+
+	rendered, err := RenderConfig(filepath.Join(dir, "main", "config.json"))
+	assert.NoError(t, err)
+	assert.Equal(t, `{
+  "target": [
+    "http://localhost/a",
+    "http://localhost/b"
+  ],
+  "gatherers": [
+    "./machine.sh",
+    {
+      "path": "`+filepath.Join(dir, "teams", "app.sh")+`"
+    }
+  ],
+  "env": {
+    "A": "1",
+    "B": "3"
+  },
+  "payload": {
+    "machine": {
+      "name": "box",
+      "title": "Box"
+    },
+    "fields": [
+      {
+        "title": "Load"
+      },
+      {
+        "title": "Requests"
+      },
+      {
+        "title": "Disk"
+      }
+    ]
+  },
+  "logging": {
+    "level": "debug"
+  }
+}`, string(rendered))
+}
+
+func TestConfigIncludeErrors(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"config.json": `{
+	"include": ["a.json", "missing.json", 5],
+	"payload": {"fields": []},
+}`,
+		"a.json": `{
+	"include": "config.json",
+	"payload": {"fields": {"title": "x"}},
+}`,
+		"config.d/broken.json": `{"target": [}`,
+	})
+
+	_, err := ReadConfig(filepath.Join(dir, "config.json"))
+	assert.ErrorContains(t, err, "parsing config: 5 problems found")
+
+	var errs ConfigErrors
+	assert.ErrorAs(t, err, &errs)
+	assert.Equal(t, []string{
+		filepath.Join(dir, "config.json") + ":2:24: include[1]: included config '" + filepath.Join(dir, "missing.json") + "' not found",
+		filepath.Join(dir, "config.json") + ":2:40: include[2]: expected string, got number",
+		filepath.Join(dir, "a.json") + ":2:13: config '" + filepath.Join(dir, "config.json") + "' is included more than once",
+		filepath.Join(dir, "a.json") + ":3:24: payload.fields: cannot merge object into array from " + filepath.Join(dir, "config.json") + ":3",
+		filepath.Join(dir, "config.d", "broken.json") + ":1:13: invalid character '}' looking for beginning of value",
+	}, configErrorStrings(errs))
+}
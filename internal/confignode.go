@@ -0,0 +1,320 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/jsonc"
+)
+
+type configNodeKind int
+
+const (
+	configNodeNull configNodeKind = iota
+	configNodeBool
+	configNodeNumber
+	configNodeString
+	configNodeObject
+	configNodeArray
+)
+
+func (k configNodeKind) String() string {
+	return [...]string{"null", "boolean", "number", "string", "object", "array"}[k]
+}
+
+// Position in the config file.
+type configPos struct {
+	file string
+	line int // From 1, zero if unknown.
+	col  int // From 1.
+}
+
+// Single key-value pair of a config object.
+type configEntry struct {
+	key    string
+	keyPos configPos
+	value  *configNode
+}
+
+// Config document parsed into a tree which keeps track of where each value
+// came from, so that problems with config can be reported with exact
+// location.
+type configNode struct {
+	kind    configNodeKind
+	value   interface{} // bool, json.Number or string for scalar nodes.
+	entries []configEntry
+	items   []*configNode
+	pos     configPos
+}
+
+// Converts the node into plain Go values, as json.Unmarshal() into
+// interface{} would do (except that numbers are kept as json.Number).
+func (n *configNode) toInterface() interface{} {
+	switch n.kind {
+	case configNodeObject:
+		result := make(StringKeyMap, len(n.entries))
+		for _, entry := range n.entries {
+			result[entry.key] = entry.value.toInterface()
+		}
+		return result
+	case configNodeArray:
+		result := make([]interface{}, len(n.items))
+		for i, item := range n.items {
+			result[i] = item.toInterface()
+		}
+		return result
+	}
+
+	return n.value
+}
+
+// Finds the node at the config path (e.g. "payload.fields[2].value") and
+// returns its position. If the path doesn't exist completely, position of its
+// deepest existing part is returned.
+func (n *configNode) lookupPos(path string) configPos {
+	current := n
+	pos := n.pos
+	segments := splitConfigPath(path)
+
+	for i := 0; i < len(segments); i++ {
+		var next *configNode
+		segment := segments[i]
+
+		if index, err := strconv.Atoi(segment); err == nil && current.kind == configNodeArray {
+			if index >= 0 && index < len(current.items) {
+				next = current.items[index]
+			}
+		} else if current.kind == configNodeObject {
+			// Keys may contain dots (e.g. names of variables), the longest
+			// matching key is used.
+			for j := len(segments); j > i && next == nil; j-- {
+				if next = current.lookup(strings.Join(segments[i:j], ".")); next != nil {
+					i = j - 1
+				}
+			}
+		}
+
+		if next == nil {
+			break
+		}
+		current = next
+		pos = next.pos
+	}
+
+	return pos
+}
+
+// Returns the node at the config path, nil if there's none.
+func (n *configNode) find(path string) *configNode {
+	current := n
+
+	for _, segment := range splitConfigPath(path) {
+		switch current.kind {
+		case configNodeObject:
+			current = current.lookup(segment)
+		case configNodeArray:
+			index, err := strconv.Atoi(segment)
+			if err != nil || index < 0 || index >= len(current.items) {
+				return nil
+			}
+			current = current.items[index]
+		default:
+			return nil
+		}
+
+		if current == nil {
+			return nil
+		}
+	}
+
+	return current
+}
+
+func splitConfigPath(path string) []string {
+	if path == "" {
+		return nil
+	}
+
+	path = strings.ReplaceAll(strings.ReplaceAll(path, "[", "."), "]", "")
+	return strings.Split(strings.TrimPrefix(path, "."), ".")
+}
+
+// Joins config path with an object key.
+func configPathKey(path string, key string) string {
+	if path == "" {
+		return key
+	}
+
+	return path + "." + key
+}
+
+// Joins config path with an array index.
+func configPathIndex(path string, index int) string {
+	return fmt.Sprintf("%s[%d]", path, index)
+}
+
+// Parses JSON config (with comments and trailing commas allowed) into a tree of
+// config nodes. The file name is used only for reporting positions.
+func parseJsonConfigNode(jsonBytes []byte, file string) (*configNode, error) {
+	// Comments and trailing commas are replaced by whitespace, so the offsets
+	// in the plain JSON match offsets in the original source.
+	plain := jsonc.ToJSON(jsonBytes)
+
+	p := &jsonNodeParser{
+		source:  plain,
+		file:    file,
+		decoder: json.NewDecoder(bytes.NewReader(plain)),
+	}
+	p.decoder.UseNumber()
+
+	for i, c := range plain {
+		if c == '\n' {
+			p.lineStarts = append(p.lineStarts, i+1)
+		}
+	}
+
+	root, err := p.parseValue()
+	if err == nil {
+		// There must be nothing else after the document.
+		if _, err = p.decoder.Token(); err == io.EOF {
+			return root, nil
+		} else if err == nil {
+			err = errors.New("unexpected data after top-level value")
+		}
+	}
+
+	var problem ConfigError
+	if errors.As(err, &problem) {
+		return nil, ConfigErrors{problem}
+	}
+
+	offset := p.decoder.InputOffset()
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		// Offset of syntax error is after the offending character.
+		offset = syntaxErr.Offset - 1
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = errors.New("unexpected end of JSON input")
+	}
+
+	return nil, ConfigErrors{p.errorAt(p.posAt(offset), err.Error())}
+}
+
+// Builds config node tree from tokens of JSON decoder, computing positions of
+// tokens from their offsets.
+type jsonNodeParser struct {
+	source     []byte
+	file       string
+	decoder    *json.Decoder
+	lineStarts []int // Offsets where lines (except the first one) start.
+}
+
+func (p *jsonNodeParser) posAt(offset int64) configPos {
+	line := sort.Search(len(p.lineStarts), func(i int) bool {
+		return int64(p.lineStarts[i]) > offset
+	})
+
+	lineStart := 0
+	if line > 0 {
+		lineStart = p.lineStarts[line-1]
+	}
+
+	return configPos{file: p.file, line: line + 1, col: int(offset) - lineStart + 1}
+}
+
+func (p *jsonNodeParser) errorAt(pos configPos, msg string) ConfigError {
+	return ConfigError{File: pos.file, Line: pos.line, Col: pos.col, Msg: msg}
+}
+
+// Returns position of the next token, which starts after any whitespace and
+// separators following the previous token.
+func (p *jsonNodeParser) nextTokenPos() configPos {
+	offset := int(p.decoder.InputOffset())
+	for offset < len(p.source) && strings.IndexByte(" \t\r\n,:", p.source[offset]) != -1 {
+		offset++
+	}
+
+	return p.posAt(int64(offset))
+}
+
+func (p *jsonNodeParser) parseValue() (*configNode, error) {
+	pos := p.nextTokenPos()
+	token, err := p.decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	node := &configNode{pos: pos, value: token}
+	switch token := token.(type) {
+	case nil:
+		node.kind = configNodeNull
+	case bool:
+		node.kind = configNodeBool
+	case json.Number:
+		node.kind = configNodeNumber
+	case string:
+		node.kind = configNodeString
+	case json.Delim:
+		node.value = nil
+		if token == '{' {
+			node.kind = configNodeObject
+			err = p.parseObject(node)
+		} else {
+			node.kind = configNodeArray
+			err = p.parseArray(node)
+		}
+	}
+
+	return node, err
+}
+
+func (p *jsonNodeParser) parseObject(node *configNode) error {
+	seen := make(map[string]bool)
+
+	for p.decoder.More() {
+		keyPos := p.nextTokenPos()
+		token, err := p.decoder.Token()
+		if err != nil {
+			return err
+		}
+
+		key := token.(string)
+		if seen[key] {
+			return p.errorAt(keyPos, fmt.Sprintf("duplicate key '%s'", key))
+		}
+		seen[key] = true
+
+		value, err := p.parseValue()
+		if err != nil {
+			return err
+		}
+
+		node.entries = append(node.entries, configEntry{key: key, keyPos: keyPos, value: value})
+	}
+
+	// Consume the closing brace.
+	_, err := p.decoder.Token()
+	return err
+}
+
+func (p *jsonNodeParser) parseArray(node *configNode) error {
+	for p.decoder.More() {
+		item, err := p.parseValue()
+		if err != nil {
+			return err
+		}
+
+		node.items = append(node.items, item)
+	}
+
+	// Consume the closing bracket.
+	_, err := p.decoder.Token()
+	return err
+}
@@ -0,0 +1,190 @@
+package internal
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Prefix of environment variables overriding config values, e.g.
+// "REPORTER_SET_payload__machine__name" overrides "payload.machine.name".
+const ConfigOverrideEnvPrefix = "REPORTER_SET_"
+
+// Value set on top of the loaded config, e.g. via CLI argument
+// "--set payload.machine.name=box".
+type ConfigOverride struct {
+	Path   string // Config path, e.g. "target" or "payload.fields[0].value".
+	Value  string // JSON value or a plain string.
+	Source string // Where the override comes from, used in error messages.
+}
+
+// Parses override in "key.path=value" format.
+func ParseConfigOverride(arg string) (ConfigOverride, error) {
+	path, value, ok := strings.Cut(arg, "=")
+	if !ok || strings.TrimSpace(path) == "" {
+		return ConfigOverride{}, fmt.Errorf("invalid override '%s' (use 'key.path=value')", arg)
+	}
+
+	path = strings.TrimSpace(path)
+	return ConfigOverride{Path: path, Value: value, Source: "--set " + path}, nil
+}
+
+// Returns overrides from "REPORTER_SET_*" environment variables (sorted by
+// their names). Double underscores in names separate parts of config path.
+func EnvConfigOverrides(environ []string) []ConfigOverride {
+	var result []ConfigOverride
+
+	for _, variable := range environ {
+		name, value, _ := strings.Cut(variable, "=")
+		if !strings.HasPrefix(name, ConfigOverrideEnvPrefix) || name == ConfigOverrideEnvPrefix {
+			continue
+		}
+
+		path := strings.ReplaceAll(strings.TrimPrefix(name, ConfigOverrideEnvPrefix), "__", ".")
+		result = append(result, ConfigOverride{Path: path, Value: value, Source: name})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Source < result[j].Source
+	})
+
+	return result
+}
+
+// Sets the override's value at its path in the config node, creating objects
+// on the way if needed. Keys of config structs are matched case-insensitively.
+// Values are interpreted according to the type at the path - strings are kept
+// as-is and a single value set to an array replaces the array.
+func applyConfigOverride(root *configNode, override ConfigOverride, errs *ConfigErrors) {
+	pos := configPos{file: override.Source}
+	segments := splitConfigPath(override.Path)
+
+	var t reflect.Type = reflect.TypeOf(Config{})
+	current := root
+
+	for i, segment := range segments {
+		last := i == len(segments)-1
+		var target **configNode
+
+		switch current.kind {
+		case configNodeArray:
+			index, err := strconv.Atoi(segment)
+			if err != nil || index < 0 || index > len(current.items) {
+				errs.addAt(pos, override.Path, "invalid index '%s' of array with %d item(s)", segment, len(current.items))
+				return
+			}
+			if index == len(current.items) {
+				current.items = append(current.items, &configNode{kind: configNodeNull, pos: pos})
+			}
+			target = &current.items[index]
+			t = configElemType(t)
+		case configNodeObject, configNodeNull:
+			if current.kind == configNodeNull {
+				current.kind, current.value = configNodeObject, nil
+			}
+
+			isStruct := t != nil && t.Kind() == reflect.Struct
+			t = configChildType(t, segment)
+			entry := findConfigEntry(current, segment, isStruct)
+			if entry == nil {
+				current.entries = append(current.entries, configEntry{
+					key:    segment,
+					keyPos: pos,
+					value:  &configNode{kind: configNodeNull, pos: pos},
+				})
+				entry = &current.entries[len(current.entries)-1]
+			}
+			target = &entry.value
+		default:
+			errs.addAt(pos, override.Path, "cannot set '%s' inside %s", segment, current.kind)
+			return
+		}
+
+		if last {
+			*target = parseOverrideValue(override.Value, t, pos)
+			return
+		}
+		current = *target
+	}
+
+	// Empty path.
+	errs.addAt(pos, override.Path, "missing config path")
+}
+
+// Returns type of the value under the key of config object of the type (nil
+// if unknown).
+func configChildType(t reflect.Type, key string) reflect.Type {
+	if t == nil {
+		return nil
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.IsExported() && strings.EqualFold(configFieldName(field), key) {
+				return field.Type
+			}
+		}
+	case reflect.Map:
+		return t.Elem()
+	}
+
+	return nil
+}
+
+func configElemType(t reflect.Type) reflect.Type {
+	if t != nil && t.Kind() == reflect.Slice {
+		return t.Elem()
+	}
+
+	return nil
+}
+
+func findConfigEntry(node *configNode, key string, caseInsensitive bool) *configEntry {
+	for i := range node.entries {
+		entry := &node.entries[i]
+		if entry.key == key || (caseInsensitive && strings.EqualFold(entry.key, key)) {
+			return entry
+		}
+	}
+
+	return nil
+}
+
+// Converts override value to config node of the type.
+func parseOverrideValue(value string, t reflect.Type, pos configPos) *configNode {
+	if t != nil && t.Kind() == reflect.String {
+		return &configNode{kind: configNodeString, value: value, pos: pos}
+	}
+
+	node, err := parseJsonConfigNode([]byte(value), pos.file)
+	if err != nil || strings.TrimSpace(value) == "" {
+		node = &configNode{kind: configNodeString, value: value}
+	}
+	setConfigNodePos(node, pos)
+
+	// Single value set to an array replaces the array.
+	if t != nil && t.Kind() == reflect.Slice && node.kind != configNodeArray {
+		item := node
+		if t.Elem().Kind() == reflect.String {
+			item = &configNode{kind: configNodeString, value: value, pos: pos}
+		}
+		node = &configNode{kind: configNodeArray, items: []*configNode{item}, pos: pos}
+	}
+
+	return node
+}
+
+func setConfigNodePos(node *configNode, pos configPos) {
+	node.pos = pos
+	for i := range node.entries {
+		node.entries[i].keyPos = pos
+		setConfigNodePos(node.entries[i].value, pos)
+	}
+	for _, item := range node.items {
+		setConfigNodePos(item, pos)
+	}
+}
@@ -0,0 +1,142 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseConfigOverride(t *testing.T) {
+	override, err := ParseConfigOverride("payload.machine.name = box=1")
+	assert.NoError(t, err)
+	assert.Equal(t, ConfigOverride{"payload.machine.name", " box=1", "--set payload.machine.name"}, override)
+
+	_, err = ParseConfigOverride("target")
+	assert.EqualError(t, err, "invalid override 'target' (use 'key.path=value')")
+	_, err = ParseConfigOverride("=x")
+	assert.Error(t, err)
+}
+
+func TestEnvConfigOverrides(t *testing.T) {
+	assert.Equal(t, []ConfigOverride{
+		{"TARGET", "http://localhost", "REPORTER_SET_TARGET"},
+		{"env.API_TOKEN", "x=y", "REPORTER_SET_env__API_TOKEN"},
+	}, EnvConfigOverrides([]string{
+		"PATH=/usr/bin",
+		"REPORTER_SET_env__API_TOKEN=x=y",
+		"REPORTER_SET_TARGET=http://localhost",
+		"REPORTER_SET_=nothing",
+	}))
+}
+
+func TestConfigOverrides(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"config.json": `{
+			"target": ["http://localhost/a", "http://localhost/b"],
+			"env": {"PORT": "80"},
+			"logging": {"level": "warning"},
+			"payload": {
+				"machine": {"name": "${host.name}"},
+				"fields": [{"value": "${load}"}],
+			},
+		}`,
+	})
+
+	overrides := []ConfigOverride{
+		{"TARGET", "http://localhost/c", "REPORTER_SET_TARGET"},
+		{"interval", "30s", "--set interval"},
+		{"env.PORT", "8080", "--set env.PORT"},
+		{"env.port", "8081", "--set env.port"},
+		{"Logging.Level", "debug", "--set Logging.Level"},
+		{"payload.machine.name", "box", "--set payload.machine.name"},
+		{"payload.machine.cpus", "4", "--set payload.machine.cpus"},
+		{"payload.fields[1]", `{"value": "${load * 2}"}`, "--set payload.fields[1]"},
+		{"payload.links", `[{"url": "http://localhost"}]`, "--set payload.links"},
+	}
+	config, err := ReadConfig(filepath.Join(dir, "config.json"), overrides...)
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"http://localhost/c"}, config.Target)
+	assert.Equal(t, 30*time.Second, config.RunInterval())
+	assert.Equal(t, map[string]string{"PORT": "8080", "port": "8081"}, config.Env)
+	assert.Equal(t, "debug", config.Logging.Level)
+	assert.Equal(t, PayloadType{
+		"machine": StringKeyMap{"name": "box", "cpus": float64(4)},
+		"fields": []interface{}{
+			StringKeyMap{"value": "${load}"},
+			StringKeyMap{"value": "${load * 2}"},
+		},
+		"links": []interface{}{StringKeyMap{"url": "http://localhost"}},
+	}, config.Payload)
+
+	// Overrides are shown in the rendered config.
+	rendered, err := RenderConfig(filepath.Join(dir, "config.json"), overrides[0])
+	assert.NoError(t, err)
+	assert.Contains(t, string(rendered), `"target": [
+    "http://localhost/c"
+  ]`)
+
+	_, err = ReadConfig(
+		filepath.Join(dir, "config.json"),
+		ConfigOverride{"interval", "soon", "--set interval"},
+		ConfigOverride{"target[5]", "http://localhost/d", "--set target[5]"},
+		ConfigOverride{"env.PORT.x", "1", "REPORTER_SET_env__PORT__x"},
+	)
+	var errs ConfigErrors
+	assert.ErrorAs(t, err, &errs)
+	assert.Equal(t, []string{
+		"--set target[5]: target[5]: invalid index '5' of array with 2 item(s)",
+		"REPORTER_SET_env__PORT__x: env.PORT.x: cannot set 'x' inside string",
+	}, configErrorStrings(errs))
+
+	_, err = ReadConfig(filepath.Join(dir, "config.json"), ConfigOverride{"interval", "soon", "--set interval"})
+	assert.EqualError(t, err, `config validation: --set interval: interval: invalid duration 'soon' (use e.g. "30s" or "1m30s")`)
+}
+
+func TestRunInterval(t *testing.T) {
+	assert.Equal(t, defaultRunInterval, Config{}.RunInterval())
+	assert.Equal(t, time.Minute, Config{Interval: Duration(time.Minute)}.RunInterval())
+
+	_, err := buildConfigFromJson([]byte(`{"interval": 90}`), "/opt/reporter")
+	assert.NoError(t, err)
+}
+
+func TestSearchConfigLocations(t *testing.T) {
+	selfDir := t.TempDir()
+	configHome := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", configHome)
+	t.Setenv("XDG_CONFIG_DIRS", "")
+	t.Setenv(ConfigPathEnvVar, "")
+
+	userConfig := filepath.Join(configHome, "maxon-reporter", "config.yaml")
+	os.MkdirAll(filepath.Dir(userConfig), 0755)
+	os.WriteFile(userConfig, []byte(""), 0644)
+
+	path, err := SearchConfig(selfDir)
+	assert.NoError(t, err)
+	assert.Equal(t, userConfig, path)
+
+	// Env var takes precedence over everything else.
+	envConfig := filepath.Join(t.TempDir(), "custom.toml")
+	os.WriteFile(envConfig, []byte(""), 0644)
+	t.Setenv(ConfigPathEnvVar, envConfig)
+
+	path, err = SearchConfig(selfDir)
+	assert.NoError(t, err)
+	assert.Equal(t, envConfig, path)
+
+	t.Setenv(ConfigPathEnvVar, envConfig+".missing")
+	_, err = SearchConfig(selfDir)
+	assert.EqualError(t, err, "cannot find config file '"+envConfig+".missing' (from REPORTER_CONFIG)")
+
+	assert.Equal(t, []string{
+		selfDir,
+		filepath.Join(selfDir, "config"),
+		filepath.Join(configHome, "maxon-reporter"),
+		"/etc/maxon-reporter",
+		"/etc/xdg/maxon-reporter",
+	}, configSearchDirs(selfDir))
+}
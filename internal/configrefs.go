@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// References to environment variables and files in config strings, resolved
+// when the config is loaded (unlike payload expressions, which are evaluated
+// in every cycle):
+//   - "${env:NAME}" - value of environment variable which must be set,
+//   - "${env:NAME:-default}" - value of environment variable, or the default
+//     if it's not set or is empty,
+//   - "${file:/path}" - contents of the file (without trailing newlines),
+//     relative paths are relative to the config file.
+var RE_CONFIG_REF = regexp.MustCompile(`\$\{(env|file):([^}]*)\}`)
+var RE_ENV_REF = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*)(:-(.*))?$`)
+
+// Replaces all references in string values of the config node (recursively).
+// Relative file paths are resolved against the directory of the file the value
+// is from, or baseDir if it's unknown. Contents of referenced files are
+// considered secret and are added into secrets.
+func resolveConfigRefs(node *configNode, path string, baseDir string, secrets *[]string, errs *ConfigErrors) {
+	switch node.kind {
+	case configNodeObject:
+		for _, entry := range node.entries {
+			resolveConfigRefs(entry.value, configPathKey(path, entry.key), baseDir, secrets, errs)
+		}
+	case configNodeArray:
+		for i, item := range node.items {
+			resolveConfigRefs(item, configPathIndex(path, i), baseDir, secrets, errs)
+		}
+	case configNodeString:
+		dir := baseDir
+		if node.pos.file != "" {
+			dir = filepath.Dir(node.pos.file)
+		}
+
+		value, err := expandConfigRefs(node.value.(string), dir, secrets)
+		if err != nil {
+			errs.addAt(node.pos, path, "%s", err.Error())
+			return
+		}
+		node.value = value
+	}
+}
+
+func expandConfigRefs(str string, dir string, secrets *[]string) (string, error) {
+	var firstErr error
+
+	result := RE_CONFIG_REF.ReplaceAllStringFunc(str, func(ref string) string {
+		match := RE_CONFIG_REF.FindStringSubmatch(ref)
+
+		var value string
+		var err error
+		if match[1] == "env" {
+			value, err = lookupEnvRef(match[2])
+		} else {
+			value, err = readFileRef(match[2], dir)
+			*secrets = append(*secrets, value)
+		}
+
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		return value
+	})
+
+	return result, firstErr
+}
+
+func lookupEnvRef(ref string) (string, error) {
+	match := RE_ENV_REF.FindStringSubmatch(ref)
+	if match == nil {
+		return "", fmt.Errorf("invalid environment variable reference '${env:%s}'", ref)
+	}
+
+	name, hasDefault, defaultValue := match[1], match[2] != "", match[3]
+	value, ok := os.LookupEnv(name)
+	if hasDefault && value == "" {
+		return defaultValue, nil
+	}
+	if !ok {
+		return "", fmt.Errorf("environment variable '%s' is not set", name)
+	}
+
+	return value, nil
+}
+
+func readFileRef(path string, dir string) (string, error) {
+	if path == "" {
+		return "", fmt.Errorf("missing file path in '${file:}'")
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("cannot read referenced file: %s", err.Error())
+	}
+
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
@@ -0,0 +1,57 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigRefs(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "token"), []byte("s3cr3t\n"), 0600)
+	t.Setenv("REPORTER_TEST_HOST", "reports.example.com")
+	t.Setenv("REPORTER_TEST_EMPTY", "")
+
+	config, err := buildConfigFromJson([]byte(`{
+		"target": [
+			"https://${env:REPORTER_TEST_HOST}/post",
+			"https://${env:REPORTER_TEST_UNSET:-localhost}/post",
+		],
+		"env": {
+			"TOKEN": "Bearer ${file:token}",
+			"EMPTY": "${env:REPORTER_TEST_EMPTY}",
+			"DEFAULT": "${env:REPORTER_TEST_EMPTY:-fallback}",
+		},
+		"payload": {
+			"host": "${env:REPORTER_TEST_HOST}",
+			"load": "${machine.load}",
+		},
+	}`), dir)
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"https://reports.example.com/post", "https://localhost/post"}, config.Target)
+	assert.Equal(t, map[string]string{"TOKEN": "Bearer s3cr3t", "EMPTY": "", "DEFAULT": "fallback"}, config.Env)
+
+	// Payload expressions are left for cycles.
+	assert.Equal(t, PayloadType{"host": "reports.example.com", "load": "${machine.load}"}, config.Payload)
+}
+
+func TestConfigRefErrors(t *testing.T) {
+	_, err := buildConfigFromJson([]byte(`{
+	"target": ["https://${env:REPORTER_TEST_UNSET}/post"],
+	"env": {
+		"TOKEN": "${file:missing-token}",
+		"BAD": "${env:NOT-A-NAME}",
+	},
+}`), "/nonexistent")
+
+	var errs ConfigErrors
+	assert.ErrorAs(t, err, &errs)
+	assert.Equal(t, []string{
+		"2:13: target[0]: environment variable 'REPORTER_TEST_UNSET' is not set",
+		"4:12: env.TOKEN: cannot read referenced file: open /nonexistent/missing-token: no such file or directory",
+		"5:10: env.BAD: invalid environment variable reference '${env:NOT-A-NAME}'",
+	}, configErrorStrings(errs))
+}
@@ -0,0 +1,388 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Commands accepted by the control socket.
+var ControlCommands = []string{
+	"status",
+	"run-now",
+	"pause",
+	"resume",
+	"reload",
+	"last-payload",
+	"vars",
+}
+
+const defaultControlSocketMode = 0600
+
+// How long the control socket server waits for a request and client waits for
+// a response.
+const controlTimeout = 10 * time.Second
+
+type ControlRequest struct {
+	Command string `json:"command"`
+}
+
+type ControlResponse struct {
+	Ok    bool            `json:"ok"`
+	Error string          `json:"error,omitempty"`
+	Data  json.RawMessage `json:"data,omitempty"`
+}
+
+// Data returned by the "status" command.
+type ControlStatus struct {
+	Pid        int           `json:"pid"`
+	Version    string        `json:"version"`
+	ConfigPath string        `json:"config_path"`
+	Paused     bool          `json:"paused"`
+	NextRunAt  time.Time     `json:"next_run_at"`
+	LastCycle  *CycleSummary `json:"last_cycle"`
+}
+
+// Returns path to the control socket specified in config or the default one
+// in the state directory. Returns empty string if there's neither.
+func ControlSocketPath(config Config, stateDir string) string {
+	if config.Control.Socket != "" {
+		return config.Control.Socket
+	}
+
+	if stateDir == "" {
+		return ""
+	}
+
+	return filepath.Join(stateDir, ".reporter.sock")
+}
+
+func parseControlSocketMode(mode string) (os.FileMode, error) {
+	if mode == "" {
+		return defaultControlSocketMode, nil
+	}
+
+	parsed, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || parsed > 0777 {
+		return 0, fmt.Errorf("invalid control socket mode '%s'", mode)
+	}
+
+	return os.FileMode(parsed), nil
+}
+
+// Prepares channels used by the control socket server to talk to the run loop.
+func (r *Reporter) initControl() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.runNow == nil {
+		r.runNow = make(chan struct{}, 1)
+		r.reload = make(chan Config, 1)
+	}
+}
+
+func (r *Reporter) isPaused() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.paused
+}
+
+// Starts serving the control socket in background until the context is done.
+func (r *Reporter) ServeControl(ctx context.Context) error {
+	path := ControlSocketPath(r.ConfigJson, r.StateDir)
+	if path == "" {
+		log.Debug("No control socket path, control socket disabled")
+		return nil
+	}
+
+	mode, err := parseControlSocketMode(r.ConfigJson.Control.Mode)
+	if err != nil {
+		return err
+	}
+
+	// Socket file might be left behind by a reporter which was killed. If
+	// nobody is listening on it, remove it.
+	if _, err := os.Stat(path); err == nil {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return fmt.Errorf("control socket '%s' is already in use", path)
+		}
+		os.Remove(path)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return err
+	}
+
+	log.Infof("Serving control socket: %s", path)
+	go func() {
+		<-ctx.Done()
+		// Closing the listener removes the socket file too.
+		listener.Close()
+	}()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Errorf("Control socket failed: %s", err.Error())
+				}
+				return
+			}
+			go r.handleControlConnection(conn)
+		}
+	}()
+
+	return nil
+}
+
+func (r *Reporter) handleControlConnection(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(controlTimeout))
+
+	var request ControlRequest
+	var response ControlResponse
+
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err == nil || err == io.EOF {
+		err = json.Unmarshal(line, &request)
+	}
+
+	var data interface{}
+	if err == nil {
+		log.Infof("Control command: %s", request.Command)
+		data, err = r.executeControlCommand(request.Command)
+	}
+
+	if err == nil {
+		response.Data, err = json.Marshal(data)
+	}
+	// Responses (e.g. variables or payloads) may contain secrets, which are
+	// replaced in the resulting JSON.
+	if err == nil {
+		response.Data, err = r.redactor().RedactJson(response.Data)
+	}
+
+	if err != nil {
+		response.Error = err.Error()
+	} else {
+		response.Ok = true
+	}
+
+	json.NewEncoder(conn).Encode(response)
+}
+
+// Returns redactor of secrets of the current config.
+func (r *Reporter) redactor() *Redactor {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.ConfigJson.redactor
+}
+
+func (r *Reporter) executeControlCommand(command string) (interface{}, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch command {
+	case "status":
+		return ControlStatus{
+			Pid:        os.Getpid(),
+			Version:    ReporterVersion,
+			ConfigPath: r.ConfigJson.path,
+			Paused:     r.paused,
+			NextRunAt:  r.nextRunAt,
+			LastCycle:  r.lastCycle,
+		}, nil
+	case "run-now":
+		select {
+		case r.runNow <- struct{}{}:
+		default:
+			// A run is already requested.
+		}
+		return "Run requested", nil
+	case "pause":
+		r.paused = true
+		return "Paused", nil
+	case "resume":
+		r.paused = false
+		return "Resumed", nil
+	case "reload":
+		config, err := ReadConfig(r.ConfigJson.path, r.ConfigJson.overrides...)
+		if err != nil {
+			return nil, err
+		}
+		select {
+		case r.reload <- config:
+		default:
+			return nil, errors.New("another reload is already pending")
+		}
+		if changed := restartOnlyChanges(r.ConfigJson, config); len(changed) != 0 {
+			return fmt.Sprintf(
+				"Config reloaded, it will be used since the next cycle (except %s, which need restart)",
+				strings.Join(changed, ", "),
+			), nil
+		}
+		return "Config reloaded, it will be used since the next cycle", nil
+	case "last-payload":
+		if r.lastCycle == nil {
+			return nil, errors.New("no cycle finished yet")
+		}
+		// With explicit reports, the last payload of each of them is returned
+		// by name. The map is copied, as it's marshaled once the lock is
+		// released while the next cycle may be updating it.
+		if len(r.ConfigJson.Reports) != 0 {
+			payloads := make(map[string]PayloadType, len(r.lastPayloads))
+			for name, payload := range r.lastPayloads {
+				payloads[name] = payload
+			}
+			return payloads, nil
+		}
+		// The last cycle may have only sampled variables without sending.
+		if payload, ok := r.lastPayloads[defaultReportName]; ok {
+			return payload, nil
+		}
+		return r.lastCycle.Payload, nil
+	case "vars":
+		if r.lastCycle == nil {
+			return nil, errors.New("no cycle finished yet")
+		}
+		return r.lastCycle.Variables, nil
+	}
+
+	return nil, fmt.Errorf("unknown command '%s'", command)
+}
+
+// Sends a command to the control socket of a running reporter and returns
+// its response data.
+func SendControlCommand(socketPath string, command string) (json.RawMessage, error) {
+	conn, err := net.DialTimeout("unix", socketPath, controlTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to reporter (is it running?): %s", err.Error())
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(controlTimeout))
+
+	if err := json.NewEncoder(conn).Encode(ControlRequest{Command: command}); err != nil {
+		return nil, err
+	}
+
+	var response ControlResponse
+	if err := json.NewDecoder(conn).Decode(&response); err != nil {
+		return nil, err
+	}
+
+	if !response.Ok {
+		return nil, errors.New(response.Error)
+	}
+
+	return response.Data, nil
+}
+
+// Formats data returned by a control command into a human-readable text.
+func FormatControlResponse(command string, data json.RawMessage) (string, error) {
+	switch command {
+	case "status":
+		var status ControlStatus
+		if err := json.Unmarshal(data, &status); err != nil {
+			return "", err
+		}
+		return formatControlStatus(status), nil
+	case "vars":
+		var vars StringMap
+		if err := json.Unmarshal(data, &vars); err != nil {
+			return "", err
+		}
+		return formatVariables(vars), nil
+	case "last-payload":
+		var payload interface{}
+		if err := json.Unmarshal(data, &payload); err != nil {
+			return "", err
+		}
+		pretty, err := json.MarshalIndent(payload, "", "  ")
+		return string(pretty) + "\n", err
+	}
+
+	var message string
+	if err := json.Unmarshal(data, &message); err != nil {
+		return "", err
+	}
+
+	return message + "\n", nil
+}
+
+func formatControlStatus(status ControlStatus) string {
+	state := "running"
+	if status.Paused {
+		state = "paused"
+	}
+
+	result := fmt.Sprintf("State:    %s\n", state)
+	result += fmt.Sprintf("PID:      %d\n", status.Pid)
+	result += fmt.Sprintf("Version:  %s\n", status.Version)
+	result += fmt.Sprintf("Config:   %s\n", status.ConfigPath)
+	if !status.NextRunAt.IsZero() {
+		result += fmt.Sprintf("Next run: %s\n", status.NextRunAt.Format(time.RFC3339))
+	}
+
+	last := status.LastCycle
+	if last == nil {
+		return result + "Last cycle: none\n"
+	}
+
+	result += fmt.Sprintf(
+		"Last cycle: #%d at %s (%d ms)\n",
+		last.Cycle, last.StartedAt.Format(time.RFC3339), last.DurationMs,
+	)
+	result += fmt.Sprintf("  Failed gatherers:  %d %v\n", len(last.FailedGatherers), last.FailedGatherers)
+	result += fmt.Sprintf("  Expression errors: %d\n", last.ExpressionErrors)
+	for _, d := range last.Deliveries {
+		outcome := strconv.Itoa(d.StatusCode)
+		if d.Error != "" {
+			outcome = d.Error
+		}
+		if d.Report != "" {
+			result += fmt.Sprintf("  Delivery of report %s to %s: %s (%d ms)\n", d.Report, d.Target, outcome, d.DurationMs)
+		} else {
+			result += fmt.Sprintf("  Delivery to %s: %s (%d ms)\n", d.Target, outcome, d.DurationMs)
+		}
+	}
+
+	return result
+}
+
+// Formats variables as sorted "key=value" lines.
+func formatVariables(vars StringMap) string {
+	keys := make([]string, 0, len(vars))
+	for k := range vars {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	result := ""
+	for _, k := range keys {
+		result += fmt.Sprintf("%s=%s\n", k, vars[k])
+	}
+
+	return result
+}
@@ -0,0 +1,187 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func startTestControl(t *testing.T, reporter *Reporter) string {
+	socket := filepath.Join(t.TempDir(), "reporter.sock")
+	reporter.ConfigJson.Control = ControlConfig{Socket: socket, Mode: "0640"}
+	reporter.initControl()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	assert.NoError(t, reporter.ServeControl(ctx))
+
+	return socket
+}
+
+func TestControlSocket(t *testing.T) {
+	reporter := &Reporter{
+		lastCycle: &CycleSummary{
+			Cycle:      3,
+			StartedAt:  time.Now(),
+			Variables:  EvalVariables{"b": "2", "a": "1"},
+			Payload:    PayloadType{"value": "1"},
+			Deliveries: []DeliveryResult{{Target: "https://localhost/report", StatusCode: 200}},
+		},
+	}
+	socket := startTestControl(t, reporter)
+
+	info, err := os.Stat(socket)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+
+	data, err := SendControlCommand(socket, "status")
+	assert.NoError(t, err)
+	var status ControlStatus
+	assert.NoError(t, json.Unmarshal(data, &status))
+	assert.Equal(t, os.Getpid(), status.Pid)
+	assert.False(t, status.Paused)
+	assert.Equal(t, 3, status.LastCycle.Cycle)
+
+	text, err := FormatControlResponse("status", data)
+	assert.NoError(t, err)
+	assert.Contains(t, text, "State:    running\n")
+	assert.Contains(t, text, "Delivery to https://localhost/report: 200")
+
+	data, err = SendControlCommand(socket, "vars")
+	assert.NoError(t, err)
+	text, _ = FormatControlResponse("vars", data)
+	assert.Equal(t, "a=1\nb=2\n", text)
+
+	data, err = SendControlCommand(socket, "last-payload")
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"value": "1"}`, string(data))
+
+	_, err = SendControlCommand(socket, "pause")
+	assert.NoError(t, err)
+	assert.True(t, reporter.isPaused())
+	_, err = SendControlCommand(socket, "resume")
+	assert.NoError(t, err)
+	assert.False(t, reporter.isPaused())
+
+	data, err = SendControlCommand(socket, "run-now")
+	assert.NoError(t, err)
+	text, _ = FormatControlResponse("run-now", data)
+	assert.Equal(t, "Run requested\n", text)
+	assert.Len(t, reporter.runNow, 1)
+
+	_, err = SendControlCommand(socket, "explode")
+	assert.EqualError(t, err, "unknown command 'explode'")
+}
+
+func TestControlSocketNoCycleYet(t *testing.T) {
+	socket := startTestControl(t, &Reporter{})
+
+	_, err := SendControlCommand(socket, "vars")
+	assert.EqualError(t, err, "no cycle finished yet")
+}
+
+func TestControlSocketNotRunning(t *testing.T) {
+	_, err := SendControlCommand(filepath.Join(t.TempDir(), "nope.sock"), "status")
+	assert.ErrorContains(t, err, "cannot connect to reporter")
+}
+
+func TestControlLastPayloadDuringCycle(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	config, err := buildConfigFromJson([]byte(`{
+	"reports": [
+		{"name": "first", "target": ["`+server.URL+`"], "payload": {"cycle": "${reporter.cycle}"}},
+		{"name": "second", "target": ["`+server.URL+`"], "payload": {"cycle": "${reporter.cycle}"}},
+	],
+}`), "/opt/reporter")
+	assert.NoError(t, err)
+
+	reporter := &Reporter{ConfigJson: config, HttpClient: &http.Client{}}
+	socket := startTestControl(t, reporter)
+	_, err = reporter.Single(context.Background())
+	assert.NoError(t, err)
+
+	// Run with -race to check the payloads are not read while being written.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			reporter.Single(context.Background())
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		data, err := SendControlCommand(socket, "last-payload")
+		assert.NoError(t, err)
+		assert.Contains(t, string(data), `"second":`)
+	}
+	<-done
+}
+
+func TestReloadedConfigApplied(t *testing.T) {
+	config, err := buildConfigFromJson([]byte(`{
+	"host_id": {"salt": "old"},
+	"control": {"socket": "/run/reporter.sock"},
+}`), "/opt/reporter")
+	assert.NoError(t, err)
+	reloaded, err := buildConfigFromJson([]byte(`{
+	"host_id": {"salt": "new"},
+	"control": {"socket": "/run/other.sock", "mode": "0600"},
+	"logging": {"level": "debug"},
+}`), "/opt/reporter")
+	assert.NoError(t, err)
+
+	var logging []LoggingConfig
+	reporter := &Reporter{ConfigJson: config, hostId: "old-hash", SetupLogging: func(config Config) error {
+		logging = append(logging, config.Logging)
+		return nil
+	}}
+	reporter.applyReloadedConfig(reloaded)
+
+	// Host ID is resolved again with the new salt.
+	assert.Empty(t, reporter.hostId)
+	assert.Equal(t, hashHostId(resolveHostId(machineIdPaths), "new"), reporter.getHostId())
+	assert.Equal(t, []LoggingConfig{reloaded.Logging}, logging)
+	assert.Equal(t, []string{"control.socket", "control.mode"}, restartOnlyChanges(config, reloaded))
+}
+
+func TestControlAndMetricsRedacted(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	t.Setenv("REPORTER_TEST_TOKEN", "target-token-1234")
+	gatherer := writeTestGatherer(t, "auth.sh", "echo api.token=gathered-token-5678\necho count=1\n")
+	config, err := buildConfigFromJson([]byte(`{
+	"target": ["`+server.URL+`/report?token=${env:REPORTER_TEST_TOKEN}"],
+	"gatherers": ["`+gatherer+`"],
+	"payload": {"auth": {"token": "${api.token}"}, "count": "${count}"},
+	"secrets": ["target", "payload.auth"],
+}`), "/opt/reporter")
+	assert.NoError(t, err)
+
+	reporter := &Reporter{ConfigJson: config, HttpClient: &http.Client{}}
+	socket := startTestControl(t, reporter)
+	_, err = reporter.Single(context.Background())
+	assert.NoError(t, err)
+
+	for _, command := range []string{"status", "vars", "last-payload"} {
+		data, err := SendControlCommand(socket, command)
+		assert.NoError(t, err)
+		assert.NotContains(t, string(data), "token-1234", command)
+		assert.NotContains(t, string(data), "token-5678", command)
+	}
+	data, _ := SendControlCommand(socket, "last-payload")
+	assert.JSONEq(t, `{"auth": {"token": "[REDACTED]"}, "count": "1"}`, string(data))
+
+	var metrics strings.Builder
+	reporter.getMetrics().Write(&metrics)
+	assert.Contains(t, metrics.String(), `reporter_deliveries_total{target="[REDACTED]",code="200"} 1`)
+	assert.NotContains(t, metrics.String(), "token-1234")
+}
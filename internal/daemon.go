@@ -1,33 +1,81 @@
 package internal
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"syscall"
 	"time"
 
 	"gopkg.in/sevlyar/go-daemon.v0"
 )
 
-// Daemonizes reporter process.
-// Returns true in the child (forked) process and false in the parent process.
-func Daemonize() (bool, *daemon.Context) {
-	ctx := &daemon.Context{
-		PidFileName: filepath.Join(Settings.SelfDir, ".reporter.pid"),
+// How long to wait for the daemon process to terminate when stopping it.
+const daemonStopTimeout = 10 * time.Second
+
+// Returns daemon context with PID file in the directory (i.e. directory of the
+// main executable).
+func newDaemonContext(dir string) *daemon.Context {
+	return &daemon.Context{
+		PidFileName: filepath.Join(dir, ".reporter.pid"),
 		PidFilePerm: 0644,
 	}
+}
+
+// Daemonizes reporter process.
+// Returns true in the child (forked) process and false in the parent process.
+func Daemonize(dir string) (bool, *daemon.Context) {
+	ctx := newDaemonContext(dir)
 
 	runningProcess, _ := ctx.Search()
 	if runningProcess != nil {
-		fmt.Printf("Killing running reporter with PID %d ...\n", (*runningProcess).Pid)
-		(*runningProcess).Signal(os.Interrupt)
-
-		// This delay seems to fix some weird behavior of Reborn() if it's
-		// called when the already running daemon process might not be
-		// terminated yet.
-		time.Sleep(time.Millisecond * 1000)
+		fmt.Printf("Stopping running reporter with PID %d ...\n", runningProcess.Pid)
+		if err := terminateProcess(runningProcess, ctx.PidFileName); err != nil {
+			fmt.Printf("Cannot stop running reporter: %s\n", err.Error())
+		}
 	}
 
 	child, _ := ctx.Reborn()
 	return child == nil, ctx
 }
+
+// Returns the running reporter daemon process (according to the PID file) or
+// nil if there's none.
+func FindDaemon(dir string) *os.Process {
+	process, _ := newDaemonContext(dir).Search()
+	return process
+}
+
+// Stops the running reporter daemon and waits for it to terminate. Returns
+// false if there was no daemon running.
+func StopDaemon(dir string) (bool, error) {
+	ctx := newDaemonContext(dir)
+
+	process, _ := ctx.Search()
+	if process == nil {
+		return false, nil
+	}
+
+	return true, terminateProcess(process, ctx.PidFileName)
+}
+
+// Asks the process to terminate and waits until it does. Its PID file is
+// removed in case the process didn't get to remove it itself.
+func terminateProcess(process *os.Process, pidFile string) error {
+	if err := process.Signal(syscall.SIGTERM); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(daemonStopTimeout)
+	for time.Now().Before(deadline) {
+		// Signal 0 only checks whether the process still exists.
+		if process.Signal(syscall.Signal(0)) != nil {
+			os.Remove(pidFile)
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return errors.New("reporter did not terminate in time")
+}
@@ -0,0 +1,25 @@
+package internal
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTerminateProcess(t *testing.T) {
+	cmd := exec.Command("sleep", "60")
+	assert.NoError(t, cmd.Start())
+	// Reap the process once it terminates, so that it doesn't stay a zombie.
+	go cmd.Wait()
+
+	pidFile := filepath.Join(t.TempDir(), ".reporter.pid")
+	os.WriteFile(pidFile, []byte("1"), 0644)
+
+	assert.NoError(t, terminateProcess(cmd.Process, pidFile))
+	assert.Error(t, cmd.Process.Signal(syscall.Signal(0)))
+	assert.NoFileExists(t, pidFile)
+}
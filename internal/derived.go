@@ -0,0 +1,121 @@
+package internal
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Names of derived variables - the same as names of variables usable in
+// expressions.
+var RE_VARIABLE_NAME = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.]*$`)
+
+// Variable defined in "vars" section of config by an expression, e.g.
+// "load_score": "100 * machine.load_avg / machine.cpu_count".
+type derivedVariable struct {
+	name string
+	expr exprNode
+}
+
+// Parses expressions of derived variables and returns the variables in order
+// in which they can be evaluated (each after the variables it refers to).
+// Cycles of variables referring to each other are reported as errors.
+func compileDerivedVariables(vars StringMap, errs *ConfigErrors) []derivedVariable {
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parsed := make(map[string]exprNode)
+	for _, name := range names {
+		path := configPathKey("vars", name)
+		if !RE_VARIABLE_NAME.MatchString(name) {
+			errs.add(path, "variable name '%s' may contain only letters, digits, underscores and dots", name)
+			continue
+		}
+
+		node, err := parseExpression(strings.TrimSpace(vars[name]))
+		if err != nil {
+			errs.add(path, "%s", err.Error())
+			continue
+		}
+		parsed[name] = node
+	}
+
+	// Depth-first search, variables are added to the result once all their
+	// dependencies are.
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make(map[string]int)
+	var result []derivedVariable
+	var stack []string
+
+	var visit func(name string) bool
+	visit = func(name string) bool {
+		switch state[name] {
+		case done:
+			return true
+		case visiting:
+			cycle := append(stack[indexOfString(stack, name):], name)
+			errs.add(
+				configPathKey("vars", name),
+				"variable '%s' refers to itself: %s", name, strings.Join(cycle, " -> "),
+			)
+			return false
+		}
+
+		state[name] = visiting
+		stack = append(stack, name)
+		ok := true
+		for _, dependency := range exprDependencies(parsed[name]) {
+			if _, isDerived := parsed[dependency]; isDerived && !visit(dependency) {
+				ok = false
+				break
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[name] = done
+
+		if ok {
+			result = append(result, derivedVariable{name: name, expr: parsed[name]})
+		}
+		return ok
+	}
+
+	for _, name := range names {
+		if _, ok := parsed[name]; ok {
+			visit(name)
+		}
+	}
+
+	return result
+}
+
+// Evaluates derived variables and adds them into the variables. Variables
+// which cannot be evaluated (e.g. because a gatherer failed) are not added,
+// so they're undefined unless a gatherer provides a variable of the same
+// name.
+func (c Config) addDerivedVariables(vars EvalVariables) {
+	for _, derived := range c.derived {
+		value, err := evalExprNode(derived.expr, vars)
+		if err != nil {
+			expressionLog.Debugf("Cannot evaluate variable '%s': %s", derived.name, err.Error())
+			continue
+		}
+		vars[derived.name] = value
+	}
+}
+
+func indexOfString(strs []string, str string) int {
+	for i, s := range strs {
+		if s == str {
+			return i
+		}
+	}
+
+	return -1
+}
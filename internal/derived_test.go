@@ -0,0 +1,160 @@
+package internal
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDerivedVariables(t *testing.T) {
+	config, err := buildConfigFromJson([]byte(`{
+	"vars": {
+		"load.score": "100 * load_per_cpu",
+		"load_per_cpu": "machine.load_avg / machine.cpu_count",
+		"load.warning": "load.score - 20",
+		"broken": "missing + 1",
+		"machine.cpu_count": "machine.cpu_count * 2",
+	},
+	"payload": {"score": "${load.score}", "warning": "${load.warning}"},
+}`), "/opt/reporter")
+
+	// Variable referring to itself is a cycle.
+	var errs ConfigErrors
+	assert.ErrorAs(t, err, &errs)
+	assert.Equal(t, []string{
+		"7:24: vars.machine.cpu_count: variable 'machine.cpu_count' refers to itself: machine.cpu_count -> machine.cpu_count",
+	}, configErrorStrings(errs))
+
+	config, err = buildConfigFromJson([]byte(`{
+	"vars": {
+		"load.score": "100 * load_per_cpu",
+		"load_per_cpu": "machine.load_avg / machine.cpu_count",
+		"load.warning": "load.score - 20",
+		"broken": "missing + 1",
+	},
+}`), "/opt/reporter")
+	assert.NoError(t, err)
+
+	var order []string
+	for _, derived := range config.derived {
+		order = append(order, derived.name)
+	}
+	assert.Equal(t, []string{"broken", "load_per_cpu", "load.score", "load.warning"}, order)
+
+	// Variable which cannot be evaluated doesn't replace the gathered one.
+	vars := EvalVariables{"machine.load_avg": "3", "machine.cpu_count": "4", "broken": "gathered"}
+	config.addDerivedVariables(vars)
+	assert.Equal(t, EvalVariables{
+		"machine.load_avg":  "3",
+		"machine.cpu_count": "4",
+		"broken":            "gathered",
+		"load_per_cpu":      "0.75",
+		"load.score":        "75",
+		"load.warning":      "55",
+	}, vars)
+
+	// Dependent variables are undefined if their dependencies are.
+	vars = EvalVariables{"machine.load_avg": "3"}
+	config.addDerivedVariables(vars)
+	assert.Equal(t, EvalVariables{"machine.load_avg": "3"}, vars)
+}
+
+func TestDerivedVariableErrors(t *testing.T) {
+	_, err := buildConfigFromJson([]byte(`{
+	"vars": {
+		"a": "b + 1",
+		"b": "c * 2",
+		"c": "a",
+		"d": "c + 1",
+		"e": "1 +",
+		"f g": "1",
+	},
+}`), "/opt/reporter")
+
+	var errs ConfigErrors
+	assert.ErrorAs(t, err, &errs)
+	assert.Equal(t, []string{
+		"3:8: vars.a: variable 'a' refers to itself: a -> b -> c -> a",
+		"7:8: vars.e: cannot parse expression '1 +': unexpected end of expression",
+		"8:10: vars.f g: variable name 'f g' may contain only letters, digits, underscores and dots",
+	}, configErrorStrings(errs))
+}
+
+func TestDerivedVariablesPreviousValues(t *testing.T) {
+	// Functions reading previous values or samples don't make a cycle, while
+	// counter functions read the current value too.
+	config, err := buildConfigFromJson([]byte(`{
+	"vars": {
+		"runs": "prev(runs) + 1",
+		"peak": "max(peak) + avg(load)",
+		"speed": "rate(rx)",
+		"rx": "delta(rx)",
+	},
+}`), "/opt/reporter")
+
+	var errs ConfigErrors
+	assert.ErrorAs(t, err, &errs)
+	assert.Equal(t, []string{
+		"6:9: vars.rx: variable 'rx' refers to itself: rx -> rx",
+	}, configErrorStrings(errs))
+
+	config, err = buildConfigFromJson([]byte(`{
+	"vars": {"runs": "prev(runs) + 1", "speed": "rate(rx) * 8", "rx": "bytes / 1000"},
+}`), "/opt/reporter")
+	assert.NoError(t, err)
+
+	var order []string
+	for _, derived := range config.derived {
+		order = append(order, derived.name)
+	}
+	assert.Equal(t, []string{"runs", "rx", "speed"}, order)
+
+	vars := EvalVariables{"$prev.runs": "4"}
+	config.addDerivedVariables(vars)
+	assert.Equal(t, "5", vars["runs"])
+}
+
+func TestDerivedVariableNamesValidation(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"config.json": `{
+	"builtins": {"time_formats": {"date": "2006-01-02"}},
+	"vars": {
+		"time.unix": "1",
+		"time.date": "1",
+		"host.name_length": "1",
+		"_gatherers.machine.ok": "1",
+		"$prev.load": "1",
+	},
+}`,
+	})
+
+	_, err := ReadConfig(filepath.Join(dir, "config.json"))
+	var errs ConfigErrors
+	assert.ErrorAs(t, err, &errs)
+	for i := range errs {
+		errs[i].File = ""
+	}
+
+	assert.Equal(t, []string{
+		"4:16: vars.time.unix: variable 'time.unix' would override built-in variable",
+		"5:16: vars.time.date: variable 'time.date' would override built-in variable",
+		"7:28: vars._gatherers.machine.ok: variable '_gatherers.machine.ok' would override built-in variable",
+		"8:17: vars.$prev.load: variable name '$prev.load' may contain only letters, digits, underscores and dots",
+	}, configErrorStrings(errs))
+}
+
+func TestReporterDerivedVariables(t *testing.T) {
+	gatherer := writeTestGatherer(t, "load.sh", "echo load=2\n")
+	config, err := buildConfigFromJson([]byte(`{
+	"gatherers": ["`+gatherer+`"],
+	"vars": {"double": "load * 2", "cycle": "reporter.cycle * 10"},
+}`), "/opt/reporter")
+	assert.NoError(t, err)
+
+	reporter := &Reporter{ConfigJson: config}
+	vars, _ := reporter.Gather(context.Background())
+	assert.Equal(t, "4", vars["double"])
+	assert.Equal(t, "10", vars["cycle"])
+}
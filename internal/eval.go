@@ -0,0 +1,97 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Commands available in the interactive expression evaluator.
+const (
+	evalReplVars     = ":vars"
+	evalReplTemplate = ":template"
+	evalReplQuit     = ":quit"
+)
+
+// Reads variables from a file, so that expressions can be evaluated without
+// running gatherers. JSON files (e.g. output of "reporter ctl vars --json")
+// are flattened the same way JSON responses of HTTP gatherers are, anything
+// else is read as INI, i.e. the same format executable gatherers print.
+func ReadVariablesFile(path string) (EvalVariables, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		return parseJsonValues(bytes, nil)
+	}
+
+	return readIniValues(bytes), nil
+}
+
+// Evaluates a single expression (e.g. "a + b") or, if "template" is true,
+// expands all "${...}" expressions inside a whole string.
+func Evaluate(input string, template bool, vars EvalVariables) (string, error) {
+	if template {
+		return expandExpressions(input, vars)
+	}
+
+	// Be forgiving to expressions copied from payload template as-is.
+	input = strings.TrimSpace(input)
+	if strings.HasPrefix(input, "${") && strings.HasSuffix(input, "}") {
+		input = input[2 : len(input)-1]
+	}
+
+	return evalExpression(input, vars)
+}
+
+// Reads expressions line by line from the input and writes their results (or
+// errors) into the output until the input is exhausted or the user quits.
+// Returns number of expressions that couldn't be evaluated.
+func EvalRepl(in io.Reader, out io.Writer, vars EvalVariables, template bool) int {
+	failed := 0
+	scanner := bufio.NewScanner(in)
+
+	fmt.Fprintf(out, "%d variables loaded. Type '%s' to list them, '%s' to toggle template mode and '%s' to exit.\n", len(vars), evalReplVars, evalReplTemplate, evalReplQuit)
+	prompt := func() {
+		if template {
+			fmt.Fprint(out, "template> ")
+		} else {
+			fmt.Fprint(out, "> ")
+		}
+	}
+
+	for prompt(); scanner.Scan(); prompt() {
+		line := scanner.Text()
+
+		switch strings.TrimSpace(line) {
+		case "":
+			continue
+		case evalReplVars:
+			fmt.Fprint(out, formatVariables(vars))
+			continue
+		case evalReplTemplate:
+			template = !template
+			continue
+		case evalReplQuit:
+			return failed
+		}
+
+		result, err := Evaluate(line, template, vars)
+		if err != nil {
+			failed++
+			fmt.Fprintf(out, "Error: %s\n", err.Error())
+			continue
+		}
+
+		fmt.Fprintln(out, result)
+	}
+
+	// Finish the line with the last prompt.
+	fmt.Fprintln(out)
+	return failed
+}
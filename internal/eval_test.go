@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadVariablesFile(t *testing.T) {
+	dir := t.TempDir()
+
+	iniPath := filepath.Join(dir, "vars.ini")
+	os.WriteFile(iniPath, []byte("a=1\nb = 2\n"), 0644)
+	vars, err := ReadVariablesFile(iniPath)
+	assert.NoError(t, err)
+	assert.Equal(t, EvalVariables{"a": "1", "b": "2"}, vars)
+
+	jsonPath := filepath.Join(dir, "vars.json")
+	os.WriteFile(jsonPath, []byte(`{"a": 1, "host.name": "x", "db": {"up": true}}`), 0644)
+	vars, err = ReadVariablesFile(jsonPath)
+	assert.NoError(t, err)
+	assert.Equal(t, EvalVariables{"a": "1", "host.name": "x", "db.up": "true"}, vars)
+
+	_, err = ReadVariablesFile(filepath.Join(dir, "missing.ini"))
+	assert.Error(t, err)
+}
+
+func TestEvaluate(t *testing.T) {
+	vars := EvalVariables{"a": "3", "b": "4"}
+
+	result, err := Evaluate("a * b + 1", false, vars)
+	assert.NoError(t, err)
+	assert.Equal(t, "13", result)
+
+	result, err = Evaluate(" ${a - b} ", false, vars)
+	assert.NoError(t, err)
+	assert.Equal(t, "-1", result)
+
+	result, err = Evaluate("sum is ${a + b}", true, vars)
+	assert.NoError(t, err)
+	assert.Equal(t, "sum is 7", result)
+
+	_, err = Evaluate("a / 0", false, vars)
+	assert.EqualError(t, err, "division by zero")
+
+	_, err = Evaluate("a + c", false, vars)
+	assert.EqualError(t, err, "undefined variable 'c'")
+
+	// Names of variables are used as-is, just like in payload templates.
+	vars = EvalVariables{"cpu-temp": "55", "cpu": "4", "temp": "1", "disk:/": "80"}
+	for input, expected := range map[string]string{"cpu-temp": "55", "${cpu-temp}": "55", "disk:/": "80"} {
+		result, err = Evaluate(input, false, vars)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, result, input)
+	}
+	result, _ = Evaluate("cpu - temp", false, vars)
+	assert.Equal(t, "3", result)
+}
+
+func TestEvalRepl(t *testing.T) {
+	vars := EvalVariables{"a": "3", "b": "4"}
+	input := strings.Join([]string{
+		"a + b",
+		"",
+		"a / 0",
+		":vars",
+		":template",
+		"x=${a * b}",
+		":quit",
+		"a + b",
+	}, "\n")
+
+	var out bytes.Buffer
+	failed := EvalRepl(strings.NewReader(input), &out, vars, false)
+
+	assert.Equal(t, 1, failed)
+	assert.Contains(t, out.String(), "> 7\n")
+	assert.Contains(t, out.String(), "Error: division by zero\n")
+	assert.Contains(t, out.String(), "a=3\nb=4\n")
+	assert.Contains(t, out.String(), "template> x=12\n")
+	assert.Equal(t, 1, strings.Count(out.String(), "7\n"))
+}
@@ -4,229 +4,404 @@ import (
 	"errors"
 	"fmt"
 	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/shopspring/decimal"
 )
 
-func doEval(expr string, vars EvalVariables) (string, error) {
-	// Handle parentheses first. Go from left to right and innermost first and
-	// replace each with a result
-	var err error
-	var matched, matched_something bool
-	var result = strings.TrimSpace(expr)
-
-	// If "just some number" (as string), then return that number (as string).
-	isNumber := RE_NUM_ONLY.MatchString(result)
-	if isNumber {
-		return result, nil
-	}
-
-	// If the string is a name of existing variable, return that variable's
-	// value right now.
-	value, was_variable := vars[result]
-	if was_variable {
+// Evaluates parsed expression. Result of a plain variable is its value as-is
+// (so that variables with non-numeric values can be used in templates), while
+// all operands of arithmetic operations must be numbers.
+func evalExprNode(node exprNode, vars EvalVariables) (string, error) {
+	switch node := node.(type) {
+	case exprNumber:
+		return node.value, nil
+	case exprVariable:
+		value, ok := vars[node.name]
+		if !ok {
+			return "", fmt.Errorf("undefined variable '%s'", node.name)
+		}
 		return value, nil
-	}
-
-	matched_something = false
-
-	for {
-		matched = false
-		result, err = ReplaceAllStringSubmatchFunc(RE_PAR, result, func(groups []string) (string, error) {
-			matched = true
-			matched_something = true
-			return doEval(groups[1], vars)
-		}, -1) // Don't limit processing of multiple non-overlapping matches consecutively.
-
+	case exprUnparsable:
+		value, ok := vars[node.name]
+		if !ok {
+			return "", node.err
+		}
+		return value, nil
+	case exprNegation:
+		operand, err := evalExprNumber(node.operand, vars)
 		if err != nil {
 			return "", err
 		}
-
-		if !matched {
-			break
-		}
-	}
-
-	// Then handle multiplication/division. Go from left to right and replace
-	// each with a result
-	for {
-		matched = false
-		result, err = ReplaceAllStringSubmatchFunc(RE_MUL, result, func(groups []string) (string, error) {
-			matched = true
-			matched_something = true
-			return binaryOpEval(doMul, groups, vars)
-		}, 1) // Limit to processing only the first match found (associativity is then processed correctly).
-
+		return operand.Neg().String(), nil
+	case exprBinary:
+		a, err := evalExprNumber(node.left, vars)
 		if err != nil {
 			return "", err
 		}
-
-		if !matched {
-			break
-		}
-	}
-
-	// Then handle addition/subtraction. Go from left to right and replace
-	// each with a result.
-	for {
-		matched = false
-		result, err = ReplaceAllStringSubmatchFunc(RE_ADD, result, func(groups []string) (string, error) {
-			matched = true
-			matched_something = true
-			return binaryOpEval(doAdd, groups, vars)
-		}, 1) // Limit to processing only the first match found (associativity is then processed correctly).
-
+		b, err := evalExprNumber(node.right, vars)
 		if err != nil {
 			return "", err
 		}
+		return doBinaryOp(a, node.op, b)
+	case exprCall:
+		return exprFunctions[node.name].call(node.args, vars)
+	}
 
-		if !matched {
-			break
-		}
+	panic(fmt.Sprintf("unknown expression node %T", node))
+}
+
+func evalExprNumber(node exprNode, vars EvalVariables) (decimal.Decimal, error) {
+	value, err := evalExprNode(node, vars)
+	if err != nil {
+		return decimal.Decimal{}, err
 	}
 
-	// None of the expected rules above matched our string - we don't know
-	// what it is.
-	if !matched_something {
-		return "", fmt.Errorf("cannot parse expression '%s'", expr)
+	result, err := decimal.NewFromString(value)
+	if err != nil {
+		return decimal.Decimal{}, fmt.Errorf("cannot convert '%s' to float", value)
 	}
 
 	return result, nil
-
 }
 
-func doTerminal(a string, vars EvalVariables) (string, error) {
+func doBinaryOp(a decimal.Decimal, op byte, b decimal.Decimal) (string, error) {
+	var result decimal.Decimal
 
-	isNumber := RE_NUM_ONLY.MatchString(a)
-	if isNumber {
-		return a, nil
+	switch op {
+	case '+':
+		result = a.Add(b)
+	case '-':
+		result = a.Sub(b)
+	case '*':
+		result = a.Mul(b)
+	case '/':
+		if b.Cmp(DecimalZero) == 0 {
+			return "", errors.New("division by zero")
+		}
+		result = a.Div(b)
 	}
 
-	var value, ok = vars[a]
-	if !ok {
-		return "", fmt.Errorf("undefined variable '%s'", a)
-	}
+	return result.String(), nil
+}
 
-	return value, nil
+// Function available in expressions.
+type exprFunction struct {
+	// Arguments are variables which are only checked for existence, so the
+	// expression doesn't need them to be defined.
+	checksExistence bool
+	// Returns names of variables the function reads for its variable name
+	// argument, if they're not just the variable itself (e.g. "$prev.x" for
+	// "prev(x)").
+	reads func(name string) []string
+	// Returns error describing what's wrong with the arguments, if anything.
+	checkArgs func(args []exprNode) error
+	call      func(args []exprNode, vars EvalVariables) (string, error)
+}
 
+// Functions available in expressions [name: function]:
+//   - "defined(name)" - 1 if the variable is defined, 0 otherwise,
+//   - "exists(prefix)" - 1 if there's any variable under the prefix (e.g.
+//     "exists(gpu)" for "gpu.temp" or "gpu.0.load"), 0 otherwise,
+//   - "prev(name)" - value of the variable in the previous cycle,
+//   - "delta(name)" - increase of the counter variable since the previous
+//     cycle (its current value if it was reset),
+//   - "rate(name)" - increase of the counter variable per second since the
+//     previous cycle,
+//   - "avg(name)", "min(name)", "max(name)", "p95(name)" - average, minimum,
+//     maximum and 95th percentile of numeric values of the variable sampled
+//     since the report was sent last time,
+//   - "count(name)" - number of such values.
+var exprFunctions = map[string]exprFunction{
+	"defined": {
+		checksExistence: true,
+		checkArgs:       checkVariableNameArg,
+		call: func(args []exprNode, vars EvalVariables) (string, error) {
+			_, ok := vars[args[0].(exprVariable).name]
+			return exprBool(ok), nil
+		},
+	},
+	"exists": {
+		checksExistence: true,
+		checkArgs:       checkVariableNameArg,
+		call: func(args []exprNode, vars EvalVariables) (string, error) {
+			prefix := args[0].(exprVariable).name
+			for name := range vars {
+				// Reserved variables (e.g. "$prev.gpu.temp") don't count,
+				// unless they're asked for.
+				if isReservedVariable(name) && !isReservedVariable(prefix) {
+					continue
+				}
+				if name == prefix || strings.HasPrefix(name, prefix+".") {
+					return exprBool(true), nil
+				}
+			}
+			return exprBool(false), nil
+		},
+	},
+	"prev": {
+		checkArgs: checkVariableNameArg,
+		reads: func(name string) []string {
+			return []string{prevVarPrefix + name}
+		},
+		call: func(args []exprNode, vars EvalVariables) (string, error) {
+			name := args[0].(exprVariable).name
+			value, ok := vars[prevVarPrefix+name]
+			if !ok {
+				return "", fmt.Errorf("no previous value of variable '%s'", name)
+			}
+			return value, nil
+		},
+	},
+	"delta": {
+		checkArgs: checkVariableNameArg,
+		reads:     counterReads,
+		call: func(args []exprNode, vars EvalVariables) (string, error) {
+			delta, _, err := counterDelta(args[0].(exprVariable).name, vars)
+			if err != nil {
+				return "", err
+			}
+			return delta.String(), nil
+		},
+	},
+	"rate": {
+		checkArgs: checkVariableNameArg,
+		reads:     counterReads,
+		call: func(args []exprNode, vars EvalVariables) (string, error) {
+			name := args[0].(exprVariable).name
+			delta, elapsed, err := counterDelta(name, vars)
+			if err != nil {
+				return "", err
+			}
+			if !elapsed.IsPositive() {
+				return "", fmt.Errorf("no time elapsed since previous value of variable '%s'", name)
+			}
+			return delta.Div(elapsed).String(), nil
+		},
+	},
+	"avg":   aggregateFunction("avg"),
+	"min":   aggregateFunction("min"),
+	"max":   aggregateFunction("max"),
+	"p95":   aggregateFunction("p95"),
+	"count": aggregateFunction("count"),
 }
 
-func doMul(a string, op string, b string) (string, error) {
+// Returns function giving the aggregate of samples of the variable, which is
+// provided as a reserved variable.
+func aggregateFunction(name string) exprFunction {
+	return exprFunction{
+		checkArgs: checkVariableNameArg,
+		reads: func(variable string) []string {
+			return []string{"$" + name + "." + variable}
+		},
+		call: func(args []exprNode, vars EvalVariables) (string, error) {
+			variable := args[0].(exprVariable).name
+			value, ok := vars["$"+name+"."+variable]
+			if !ok {
+				return "", fmt.Errorf("no samples of variable '%s'", variable)
+			}
+			return value, nil
+		},
+	}
+}
 
-	aDecimal, err := decimal.NewFromString(a)
-	if err != nil {
-		return "", fmt.Errorf("cannot convert '%s' to float", a)
+// Counter functions read the current value of the variable as well as its
+// previous value and time.
+func counterReads(name string) []string {
+	return []string{name, prevVarPrefix + name, prevTimePrefix + name}
+}
+
+// Checks there's a single argument which is a variable name. Such argument is
+// not evaluated, so the variable doesn't need to exist.
+func checkVariableNameArg(args []exprNode) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expects 1 argument, got %d", len(args))
+	}
+	if _, ok := args[0].(exprVariable); !ok {
+		return errors.New("expects a variable name")
 	}
 
-	bDecimal, err := decimal.NewFromString(b)
-	if err != nil {
-		return "", fmt.Errorf("cannot convert '%s' to float", b)
+	return nil
+}
+
+func exprBool(value bool) string {
+	if value {
+		return "1"
 	}
 
-	var result decimal.Decimal
-	if op == "*" {
-		result = aDecimal.Mul(bDecimal)
-	} else {
-		if bDecimal.Cmp(DecimalZero) == 0 {
-			return "", errors.New("division by zero")
-		}
-		result = aDecimal.Div(bDecimal)
+	return "0"
+}
+
+// Returns true if value of an expression is considered true in conditions,
+// i.e. it's not empty, "false" or a number equal to zero.
+func isTruthy(value string) bool {
+	value = strings.TrimSpace(value)
+	if value == "" || strings.EqualFold(value, "false") {
+		return false
 	}
 
-	return result.String(), nil
+	if number, err := decimal.NewFromString(value); err == nil {
+		return !number.IsZero()
+	}
 
+	return true
 }
 
-func doAdd(a string, op string, b string) (string, error) {
+// Returns sorted names of variables the expression needs.
+func exprVariables(node exprNode) []string {
+	return collectExprVariables(node, false)
+}
 
-	aDecimal, err := decimal.NewFromString(a)
-	if err != nil {
-		return "", fmt.Errorf("cannot convert '%s' to float", a)
-	}
+// Returns sorted names of variables the expression reads when evaluated. It
+// differs from exprVariables() in functions like "prev(x)", which read
+// reserved variables (e.g. "$prev.x") instead of their argument.
+func exprDependencies(node exprNode) []string {
+	return collectExprVariables(node, true)
+}
 
-	bDecimal, err := decimal.NewFromString(b)
-	if err != nil {
-		return "", fmt.Errorf("cannot convert '%s' to float", b)
+func collectExprVariables(node exprNode, reserved bool) []string {
+	found := make(map[string]bool)
+
+	var walk func(node exprNode)
+	walk = func(node exprNode) {
+		switch node := node.(type) {
+		case exprVariable:
+			found[node.name] = true
+		case exprUnparsable:
+			found[node.name] = true
+		case exprNegation:
+			walk(node.operand)
+		case exprBinary:
+			walk(node.left)
+			walk(node.right)
+		case exprCall:
+			function := exprFunctions[node.name]
+			// Variables which are only checked for existence are not needed.
+			if function.checksExistence {
+				break
+			}
+			if reserved && function.reads != nil {
+				for _, name := range function.reads(node.args[0].(exprVariable).name) {
+					found[name] = true
+				}
+				break
+			}
+			for _, arg := range node.args {
+				walk(arg)
+			}
+		}
 	}
+	walk(node)
 
-	var result decimal.Decimal
-	if op == "+" {
-		result = aDecimal.Add(bDecimal)
-	} else {
-		result = aDecimal.Sub(bDecimal)
+	result := make([]string, 0, len(found))
+	for name := range found {
+		result = append(result, name)
 	}
+	sort.Strings(result)
 
-	return result.String(), nil
-
+	return result
 }
 
-func binaryOpEval(
-	fn binaryOpEvalCallback,
-	groups []string,
-	vars EvalVariables,
-) (string, error) {
-	var err error
-	var termA string
-	var termB string
-
-	termA, err = doTerminal(groups[1], vars)
+// Evaluates the expression the same way as if it was in "${...}" of a
+// payload template.
+func evalExpression(expr string, vars EvalVariables) (string, error) {
+	node, err := parseTemplateExpression(expr)
 	if err != nil {
 		return "", err
 	}
 
-	termB, err = doTerminal(groups[3], vars)
+	return evalTemplateExpression(expr, node, vars)
+}
+
+// Parses body of "${...}" in a template. Gatherers may produce variables with
+// any names (e.g. "disk:/"), so a body which is not a valid expression may
+// still be a name of a variable, unless it clearly isn't.
+func parseTemplateExpression(source string) (exprNode, error) {
+	node, err := parseExpression(strings.TrimSpace(source))
 	if err != nil {
-		return "", err
+		name := strings.TrimSpace(source)
+		if !RE_PLAIN_VARIABLE_NAME.MatchString(name) {
+			return nil, err
+		}
+		node = exprUnparsable{name: name, err: err}
 	}
 
-	val, err := fn(termA, groups[2], termB)
-	if err != nil {
-		return "", err
+	return node, nil
+}
+
+// Evaluates parsed body of "${...}" in a template. Body which is a name of an
+// existing variable (e.g. "cpu-temp", which would be a subtraction otherwise)
+// gives the variable's value.
+func evalTemplateExpression(source string, node exprNode, vars EvalVariables) (string, error) {
+	if value, ok := vars[strings.TrimSpace(source)]; ok {
+		return value, nil
 	}
 
-	return val, nil
+	return evalExprNode(node, vars)
 }
 
-func evalExpression(expr string, vars EvalVariables) (string, error) {
-	return doEval(expr, vars)
+// String with "${...}" expressions parsed in advance, so that it can be
+// expanded repeatedly without parsing it again.
+type compiledTemplate struct {
+	literals    []string   // Parts of the string around expressions.
+	expressions []exprNode // Expression i is placed after literal i.
+	sources     []string   // Source code of the expressions.
 }
 
-func expandExpressions(str string, vars EvalVariables) (string, error) {
-	var err error
+func compileTemplate(str string) (*compiledTemplate, error) {
+	t := &compiledTemplate{}
 
-	result := RE_BRACED_EXPR.ReplaceAllStringFunc(str, func(match string) string {
-		_result, _err := doEval(match[2:len(match)-1], vars)
+	last := 0
+	for _, match := range RE_BRACED_EXPR.FindAllStringIndex(str, -1) {
+		source := str[match[0]+2 : match[1]-1]
+		node, err := parseTemplateExpression(source)
+		if err != nil {
+			return nil, err
+		}
 
-		// Bubble up the error, if there's any (we can't do that via returning,
-		// because regexp.ReplaceAllStringFunc() expects only a string to be
-		// returned).
-		if _err != nil {
-			err = _err
+		t.literals = append(t.literals, str[last:match[0]])
+		t.expressions = append(t.expressions, node)
+		t.sources = append(t.sources, source)
+		last = match[1]
+	}
+	t.literals = append(t.literals, str[last:])
+
+	return t, nil
+}
+
+func (t *compiledTemplate) expand(vars EvalVariables) (string, error) {
+	var result strings.Builder
+
+	for i, expr := range t.expressions {
+		value, err := evalTemplateExpression(t.sources[i], expr, vars)
+		if err != nil {
+			return "", err
 		}
 
-		return _result
-	})
+		result.WriteString(t.literals[i])
+		result.WriteString(value)
+	}
+	result.WriteString(t.literals[len(t.literals)-1])
 
-	return result, err
+	return result.String(), nil
+}
+
+func expandExpressions(str string, vars EvalVariables) (string, error) {
+	t, err := compileTemplate(str)
+	if err != nil {
+		return "", err
+	}
+
+	return t.expand(vars)
 }
 
 var DecimalZero, _ = decimal.NewFromString("0")
 
-const __RE_NUM = `-?\d+(?:\.\d+)?`
-const __RE_NUM_ONLY = `^` + __RE_NUM + `$`
-const __RE_VAR = `[a-zA-Z][a-zA-Z0-9_.]*`
-const __RE_OP = `(?:(?:` + __RE_VAR + `)|(?:` + __RE_NUM + `))`
-const __RE_MUL = `(` + __RE_OP + `)\s*([*\/])\s*(` + __RE_OP + `)`
-const __RE_ADD = `(` + __RE_OP + `)\s*([+-])\s*(` + __RE_OP + `)`
-const __RE_PAR = `\(\s*([^\(]*?)\s*\)`
 const __RE_BRACED_EXPR = `\$\{.*?\}`
 
-var RE_NUM = regexp.MustCompile(__RE_NUM)
-var RE_NUM_ONLY = regexp.MustCompile(__RE_NUM_ONLY)
-var RE_VAR = regexp.MustCompile(__RE_VAR)
-var RE_OP = regexp.MustCompile(__RE_OP)
-var RE_MUL = regexp.MustCompile(__RE_MUL)
-var RE_ADD = regexp.MustCompile(__RE_ADD)
-var RE_PAR = regexp.MustCompile(__RE_PAR)
 var RE_BRACED_EXPR = regexp.MustCompile(__RE_BRACED_EXPR)
+
+// Body of "${...}" which is not a valid expression, but can still be a name
+// of a variable.
+var RE_PLAIN_VARIABLE_NAME = regexp.MustCompile(`^[^\s(),]+$`)
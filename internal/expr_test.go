@@ -48,6 +48,11 @@ func TestEvalExprOk(t *testing.T) {
 	testEvalExpr(t, vars, "hey", "HEY")
 	testEvalExpr(t, vars, "hey.dude", "HEY...DUDE")
 
+	// Variables bound by payload loops.
+	vars["$1"] = "2"
+	vars["$value"] = "3"
+	testEvalExpr(t, vars, "$1 * $value", "6")
+
 }
 
 func TestEvalExprParseError(t *testing.T) {
@@ -111,3 +116,146 @@ func BenchmarkEvalExpr_complex(b *testing.B) {
 	}
 	b.ReportAllocs()
 }
+
+func TestParseExpression(t *testing.T) {
+
+	node, err := parseExpression(" 1 + a.b * -(2 - c) ")
+	assert.NoError(t, err)
+	assert.Equal(t, exprBinary{
+		op:   '+',
+		left: exprNumber{"1"},
+		right: exprBinary{
+			op:   '*',
+			left: exprVariable{"a.b"},
+			right: exprNegation{exprBinary{
+				op:    '-',
+				left:  exprNumber{"2"},
+				right: exprVariable{"c"},
+			}},
+		},
+	}, node)
+
+	// Operators of the same precedence are left-associative.
+	node, err = parseExpression("8 / 4 / 2")
+	assert.NoError(t, err)
+	assert.Equal(t, exprBinary{
+		op:    '/',
+		left:  exprBinary{op: '/', left: exprNumber{"8"}, right: exprNumber{"4"}},
+		right: exprNumber{"2"},
+	}, node)
+
+	_, err = parseExpression("")
+	assert.EqualError(t, err, "cannot parse expression '': unexpected end of expression")
+	_, err = parseExpression("1 +")
+	assert.EqualError(t, err, "cannot parse expression '1 +': unexpected end of expression")
+	_, err = parseExpression("(1 + 2")
+	assert.EqualError(t, err, "cannot parse expression '(1 + 2': unexpected end of expression")
+	_, err = parseExpression("a a")
+	assert.EqualError(t, err, "cannot parse expression 'a a': unexpected 'a' at position 3")
+	_, err = parseExpression("1 * / 2")
+	assert.EqualError(t, err, "cannot parse expression '1 * / 2': unexpected '/' at position 5")
+	_, err = parseExpression("1.=")
+	assert.EqualError(t, err, "cannot parse expression '1.=': unexpected character '.' at position 2")
+
+}
+
+func TestCompileTemplate(t *testing.T) {
+
+	vars := EvalVariables{"a": "2", "b": "3", "name": "box"}
+
+	tpl, err := compileTemplate("${name}: ${a * b} of ${(a + b) * 2}!")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"name", "a * b", "(a + b) * 2"}, tpl.sources)
+
+	result, err := tpl.expand(vars)
+	assert.NoError(t, err)
+	assert.Equal(t, "box: 6 of 10!", result)
+
+	_, err = tpl.expand(EvalVariables{"name": "box", "a": "x", "b": "1"})
+	assert.EqualError(t, err, "cannot convert 'x' to float")
+
+	tpl, err = compileTemplate("no expressions")
+	assert.NoError(t, err)
+	result, err = tpl.expand(vars)
+	assert.NoError(t, err)
+	assert.Equal(t, "no expressions", result)
+
+	_, err = compileTemplate("ok ${a} and ${a +}")
+	assert.EqualError(t, err, "cannot parse expression 'a +': unexpected end of expression")
+
+	assert.Equal(t, []string{"a", "b.c"}, exprVariables(mustParseExpression(t, "b.c * (a - b.c) / -a")))
+
+}
+
+func TestTemplateVariableNames(t *testing.T) {
+	vars := EvalVariables{"cpu-temp": "55", "disk:/": "80", "cpu": "4", "temp": "1"}
+
+	// Whole expression which is a name of a variable gives its value.
+	result, err := expandExpressions("${cpu-temp} ${ cpu - temp } ${disk:/}%", vars)
+	assert.NoError(t, err)
+	assert.Equal(t, "55 3 80%", result)
+
+	_, err = expandExpressions("${disk:/}", EvalVariables{})
+	assert.EqualError(t, err, "cannot parse expression 'disk:/': unexpected character ':' at position 5")
+	_, err = compileTemplate("${avg(disk:/)}")
+	assert.Error(t, err)
+
+	config, err := buildConfigFromJson([]byte(`{
+	"payload": {"temp": "${cpu-temp}", "disk": "${disk:/}", "load": "${load}"},
+}`), "/opt/reporter")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"payload.load: expression 'load' needs variable 'load' which is not defined",
+	}, configErrorStrings(config.CheckPayloadVariables(vars)))
+}
+
+func mustParseExpression(t *testing.T, expr string) exprNode {
+	node, err := parseExpression(expr)
+	assert.NoError(t, err)
+	return node
+}
+
+func TestExprFunctions(t *testing.T) {
+
+	vars := EvalVariables{"raid.status": "ok", "gpu.0.temp": "60", "gpu.0.load": "20"}
+
+	testEvalExpr(t, vars, "defined(raid.status)", "1")
+	testEvalExpr(t, vars, "defined(raid)", "0")
+	testEvalExpr(t, vars, "exists(raid)", "1")
+	testEvalExpr(t, vars, "exists(gpu.0)", "1")
+	testEvalExpr(t, vars, "exists(gpu.1)", "0")
+	testEvalExpr(t, vars, "exists(gp)", "0")
+	testEvalExpr(t, vars, "defined(gpu.0.temp) + defined(gpu.1.temp)", "1")
+
+	node := mustParseExpression(t, "defined(a) * b")
+	assert.Equal(t, exprBinary{
+		op:    '*',
+		left:  exprCall{name: "defined", args: []exprNode{exprVariable{"a"}}},
+		right: exprVariable{"b"},
+	}, node)
+	// Variables checked for existence are not needed.
+	assert.Equal(t, []string{"b"}, exprVariables(node))
+
+	_, err := parseExpression("nope(a)")
+	assert.EqualError(t, err, "cannot parse expression 'nope(a)': unknown function 'nope' at position 1")
+	_, err = parseExpression("1 + defined(a, b)")
+	assert.EqualError(t, err, "cannot parse expression '1 + defined(a, b)': function 'defined' at position 5 expects 1 argument, got 2")
+	_, err = parseExpression("exists(1)")
+	assert.EqualError(t, err, "cannot parse expression 'exists(1)': function 'exists' at position 1 expects a variable name")
+	_, err = parseExpression("defined(a b)")
+	assert.EqualError(t, err, "cannot parse expression 'defined(a b)': unexpected 'b' at position 11")
+	_, err = parseExpression("defined(a")
+	assert.EqualError(t, err, "cannot parse expression 'defined(a': unexpected end of expression")
+
+}
+
+func TestIsTruthy(t *testing.T) {
+
+	for _, value := range []string{"1", "-0.5", "yes", "ok", "0x"} {
+		assert.True(t, isTruthy(value), value)
+	}
+	for _, value := range []string{"", " ", "0", "0.00", "-0", "false", "FALSE"} {
+		assert.False(t, isTruthy(value), value)
+	}
+
+}
@@ -0,0 +1,281 @@
+package internal
+
+import (
+	"fmt"
+)
+
+// Parsed expression (abstract syntax tree) of an expression used in payload
+// template, e.g. "100 * (machine.load_avg / machine.cpu_count)".
+type exprNode interface{}
+
+type exprNumber struct {
+	value string
+}
+
+type exprVariable struct {
+	name string
+}
+
+// Body of "${...}" in a template which is not a valid expression, but may be
+// a name of a variable produced by a gatherer (e.g. "disk:/"). It's the
+// variable's value if it's defined, the parse error otherwise.
+type exprUnparsable struct {
+	name string
+	err  error
+}
+
+// Unary minus.
+type exprNegation struct {
+	operand exprNode
+}
+
+type exprBinary struct {
+	op    byte // One of '+', '-', '*', '/'.
+	left  exprNode
+	right exprNode
+}
+
+// Call of a function, e.g. "defined(raid.status)".
+type exprCall struct {
+	name string
+	args []exprNode
+}
+
+type exprTokenKind int
+
+const (
+	exprTokenEnd exprTokenKind = iota
+	exprTokenNumber
+	exprTokenIdent
+	exprTokenOp
+	exprTokenLeftParen
+	exprTokenRightParen
+	exprTokenComma
+)
+
+type exprToken struct {
+	kind  exprTokenKind
+	value string
+	pos   int // Position of the token in the expression (from 0).
+}
+
+// Recursive descent parser of expressions. Grammar:
+//
+//	expr   = term { ("+" | "-") term }
+//	term   = factor { ("*" | "/") factor }
+//	factor = "-" factor | number | call | variable | "(" expr ")"
+//	call   = name "(" [ expr { "," expr } ] ")"
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+}
+
+// Parses expression into its syntax tree.
+func parseExpression(expr string) (exprNode, error) {
+	tokens, err := tokenizeExpression(expr)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse expression '%s': %s", expr, err.Error())
+	}
+
+	p := &exprParser{tokens: tokens}
+	node, err := p.parseExpr()
+	if err == nil && p.peek().kind != exprTokenEnd {
+		err = p.unexpected()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse expression '%s': %s", expr, err.Error())
+	}
+
+	return node, nil
+}
+
+func tokenizeExpression(expr string) ([]exprToken, error) {
+	var tokens []exprToken
+
+	isDigit := func(c byte) bool { return c >= '0' && c <= '9' }
+	isIdentStart := func(c byte) bool {
+		return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+	}
+
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		start := i
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+			continue
+		case isDigit(c):
+			for i < len(expr) && isDigit(expr[i]) {
+				i++
+			}
+			// Decimal part must have at least one digit.
+			if i+1 < len(expr) && expr[i] == '.' && isDigit(expr[i+1]) {
+				i++
+				for i < len(expr) && isDigit(expr[i]) {
+					i++
+				}
+			}
+			tokens = append(tokens, exprToken{exprTokenNumber, expr[start:i], start})
+		// Variables bound by payload loops start with "$", e.g. "$1".
+		case isIdentStart(c) || c == '$':
+			i++
+			for i < len(expr) && (isIdentStart(expr[i]) || isDigit(expr[i]) || expr[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, exprToken{exprTokenIdent, expr[start:i], start})
+		case c == '+' || c == '-' || c == '*' || c == '/':
+			i++
+			tokens = append(tokens, exprToken{exprTokenOp, expr[start:i], start})
+		case c == '(':
+			i++
+			tokens = append(tokens, exprToken{exprTokenLeftParen, "(", start})
+		case c == ')':
+			i++
+			tokens = append(tokens, exprToken{exprTokenRightParen, ")", start})
+		case c == ',':
+			i++
+			tokens = append(tokens, exprToken{exprTokenComma, ",", start})
+		default:
+			return nil, fmt.Errorf("unexpected character '%c' at position %d", c, start+1)
+		}
+	}
+
+	return append(tokens, exprToken{exprTokenEnd, "", len(expr)}), nil
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() exprToken {
+	token := p.tokens[p.pos]
+	if token.kind != exprTokenEnd {
+		p.pos++
+	}
+
+	return token
+}
+
+func (p *exprParser) unexpected() error {
+	token := p.peek()
+	if token.kind == exprTokenEnd {
+		return fmt.Errorf("unexpected end of expression")
+	}
+
+	return fmt.Errorf("unexpected '%s' at position %d", token.value, token.pos+1)
+}
+
+func (p *exprParser) parseExpr() (exprNode, error) {
+	left, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		token := p.peek()
+		if token.kind != exprTokenOp || (token.value != "+" && token.value != "-") {
+			return left, nil
+		}
+		p.next()
+
+		right, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		left = exprBinary{op: token.value[0], left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseTerm() (exprNode, error) {
+	left, err := p.parseFactor()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		token := p.peek()
+		if token.kind != exprTokenOp || (token.value != "*" && token.value != "/") {
+			return left, nil
+		}
+		p.next()
+
+		right, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		left = exprBinary{op: token.value[0], left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseFactor() (exprNode, error) {
+	token := p.peek()
+
+	switch token.kind {
+	case exprTokenNumber:
+		p.next()
+		return exprNumber{value: token.value}, nil
+	case exprTokenIdent:
+		p.next()
+		if p.peek().kind == exprTokenLeftParen {
+			return p.parseCall(token)
+		}
+		return exprVariable{name: token.value}, nil
+	case exprTokenOp:
+		if token.value != "-" {
+			return nil, p.unexpected()
+		}
+		p.next()
+		operand, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		return exprNegation{operand: operand}, nil
+	case exprTokenLeftParen:
+		p.next()
+		node, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek().kind != exprTokenRightParen {
+			return nil, p.unexpected()
+		}
+		p.next()
+		return node, nil
+	}
+
+	return nil, p.unexpected()
+}
+
+func (p *exprParser) parseCall(name exprToken) (exprNode, error) {
+	function, ok := exprFunctions[name.value]
+	if !ok {
+		return nil, fmt.Errorf("unknown function '%s' at position %d", name.value, name.pos+1)
+	}
+
+	// Skip the left parenthesis.
+	p.next()
+
+	var args []exprNode
+	for p.peek().kind != exprTokenRightParen {
+		if len(args) != 0 {
+			if p.peek().kind != exprTokenComma {
+				return nil, p.unexpected()
+			}
+			p.next()
+		}
+
+		arg, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	p.next()
+
+	if err := function.checkArgs(args); err != nil {
+		return nil, fmt.Errorf("function '%s' at position %d %s", name.value, name.pos+1, err.Error())
+	}
+
+	return exprCall{name: name.value, args: args}, nil
+}
@@ -5,5 +5,3 @@ var (
 	ReporterVersion = "unknown"
 	ReporterDevFlag = "0"
 )
-
-var Settings ReporterSettings
@@ -0,0 +1,65 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Name of file (in the reporter's state directory) which, if it exists,
+// overrides the host ID read from the system.
+const hostIdOverrideFile = "host-id"
+
+// Files with machine ID provided by the system, in order of preference.
+var machineIdPaths = []string{
+	"/etc/machine-id",
+	"/var/lib/dbus/machine-id",
+}
+
+// Returns the stable identifier of this host, which is resolved only once.
+// If a salt is specified in config, the ID is hashed together with it, so that
+// the raw machine ID is not disclosed.
+func (r *Reporter) getHostId() string {
+	if r.hostId == "" {
+		paths := machineIdPaths
+		if r.StateDir != "" {
+			paths = append([]string{filepath.Join(r.StateDir, hostIdOverrideFile)}, paths...)
+		}
+		r.hostId = hashHostId(resolveHostId(paths), r.ConfigJson.HostId.Salt)
+	}
+
+	return r.hostId
+}
+
+// Returns contents of the first existing non-empty file from the list. If
+// there's none, hostname is used as the last resort.
+func resolveHostId(paths []string) string {
+	for _, path := range paths {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+
+		if id := strings.TrimSpace(string(content)); id != "" {
+			log.Debugf("Using host ID from %s", path)
+			return id
+		}
+	}
+
+	hostname, _ := os.Hostname()
+	log.Warnf("No machine ID found, using hostname '%s' as host ID", hostname)
+	return hostname
+}
+
+func hashHostId(id string, salt string) string {
+	if salt == "" {
+		return id
+	}
+
+	hash := sha256.Sum256([]byte(salt + id))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,37 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveHostId(t *testing.T) {
+	dir := t.TempDir()
+	override := filepath.Join(dir, "host-id")
+	machineId := filepath.Join(dir, "machine-id")
+
+	assert.NoError(t, os.WriteFile(machineId, []byte("0123456789abcdef\n"), 0644))
+	assert.Equal(t, "0123456789abcdef", resolveHostId([]string{override, machineId}))
+
+	// Empty override file is ignored.
+	assert.NoError(t, os.WriteFile(override, []byte("\n"), 0644))
+	assert.Equal(t, "0123456789abcdef", resolveHostId([]string{override, machineId}))
+
+	assert.NoError(t, os.WriteFile(override, []byte("my-host"), 0644))
+	assert.Equal(t, "my-host", resolveHostId([]string{override, machineId}))
+
+	hostname, _ := os.Hostname()
+	assert.Equal(t, hostname, resolveHostId([]string{filepath.Join(dir, "nope")}))
+}
+
+func TestHashHostId(t *testing.T) {
+	assert.Equal(t, "abc", hashHostId("abc", ""))
+
+	hashed := hashHostId("abc", "salt")
+	assert.Len(t, hashed, 64)
+	assert.Equal(t, hashed, hashHostId("abc", "salt"))
+	assert.NotEqual(t, hashed, hashHostId("abc", "other salt"))
+}
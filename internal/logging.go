@@ -0,0 +1,220 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"log/syslog"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+	logrus_syslog "github.com/sirupsen/logrus/hooks/syslog"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Special values of logging destination.
+const (
+	LogDestinationStderr = "stderr"
+	LogDestinationStdout = "stdout"
+	LogDestinationSyslog = "syslog"
+)
+
+const (
+	LogFormatText = "text"
+	LogFormatJson = "json"
+)
+
+// Subsystems which can have their own log level.
+const (
+	LogSubsystemGatherers   = "gatherers"
+	LogSubsystemExpressions = "expressions"
+	LogSubsystemDelivery    = "delivery"
+)
+
+// Loggers of subsystems. They share destination and format with the standard
+// logger, but can have a different log level.
+var (
+	gathererLog   = log.StandardLogger()
+	expressionLog = log.StandardLogger()
+	deliveryLog   = log.StandardLogger()
+)
+
+// Default log rotation settings.
+const (
+	defaultLogMaxSizeMb  = 20
+	defaultLogMaxBackups = 1
+	defaultLogMaxAgeDays = 30
+)
+
+// Parses log level name as accepted in CLI arguments and config.
+func ParseLogLevel(level string) (log.Level, error) {
+	switch level {
+	case "warning", "warn":
+		return log.WarnLevel, nil
+	case "info":
+		return log.InfoLevel, nil
+	case "debug":
+		return log.DebugLevel, nil
+	case "error":
+		return log.ErrorLevel, nil
+	}
+
+	return log.WarnLevel, fmt.Errorf("unknown log level '%s'", level)
+}
+
+func validateLoggingConfig(c LoggingConfig) error {
+	switch c.Format {
+	case "", LogFormatText, LogFormatJson:
+	default:
+		return fmt.Errorf("unknown log format '%s'", c.Format)
+	}
+
+	if c.Level != "" {
+		if _, err := ParseLogLevel(c.Level); err != nil {
+			return err
+		}
+	}
+
+	for subsystem, level := range c.Levels {
+		switch subsystem {
+		case LogSubsystemGatherers, LogSubsystemExpressions, LogSubsystemDelivery:
+		default:
+			return fmt.Errorf("unknown logging subsystem '%s'", subsystem)
+		}
+		if _, err := ParseLogLevel(level); err != nil {
+			return err
+		}
+	}
+
+	if c.MaxSizeMb < 0 || c.MaxBackups < 0 || c.MaxAgeDays < 0 {
+		return fmt.Errorf("log rotation settings must not be negative")
+	}
+
+	return nil
+}
+
+// Log file the loggers currently write into, if any.
+var logFile io.Closer
+
+// Configures the standard logger and loggers of subsystems. If destination is
+// not specified in config, the defaultPath is used. If journald is true and
+// logs go to stderr, timestamps are omitted (journald adds its own). Secrets
+// known to the redactor (if any, see SetLogRedactor()) never get into the
+// logs.
+func SetupLogging(c LoggingConfig, defaultPath string, journald bool, redactor *Redactor) error {
+	if err := validateLoggingConfig(c); err != nil {
+		return err
+	}
+
+	level := log.WarnLevel
+	if c.Level != "" {
+		level, _ = ParseLogLevel(c.Level)
+	}
+
+	var formatter log.Formatter = &log.TextFormatter{
+		DisableTimestamp: journald && c.Path == LogDestinationStderr,
+	}
+	if c.Format == LogFormatJson {
+		formatter = &log.JSONFormatter{}
+	}
+	SetLogRedactor(redactor)
+	formatter = &redactingFormatter{formatter: formatter}
+
+	var output io.Writer
+	var hooks log.LevelHooks = make(log.LevelHooks)
+
+	switch c.Path {
+	case LogDestinationStderr:
+		output = os.Stderr
+	case LogDestinationStdout:
+		output = os.Stdout
+	case LogDestinationSyslog:
+		hook, err := logrus_syslog.NewSyslogHook("", "", syslog.LOG_INFO|syslog.LOG_DAEMON, "maxon-reporter")
+		if err != nil {
+			return fmt.Errorf("cannot connect to syslog: %s", err.Error())
+		}
+		hooks.Add(hook)
+		output = io.Discard
+	default:
+		path := c.Path
+		if path == "" {
+			path = defaultPath
+		}
+		output = &lumberjack.Logger{
+			Filename:   path,
+			MaxSize:    valueOrDefault(c.MaxSizeMb, defaultLogMaxSizeMb),
+			MaxBackups: valueOrDefault(c.MaxBackups, defaultLogMaxBackups),
+			MaxAge:     valueOrDefault(c.MaxAgeDays, defaultLogMaxAgeDays),
+			Compress:   c.Compress,
+		}
+	}
+
+	std := log.StandardLogger()
+	std.SetOutput(output)
+	// Logging may be set up again when config is reloaded.
+	if logFile != nil {
+		logFile.Close()
+	}
+	logFile, _ = output.(io.Closer)
+	std.SetFormatter(formatter)
+	std.SetLevel(level)
+	std.ReplaceHooks(hooks)
+
+	newSubsystemLogger := func(subsystem string) *log.Logger {
+		subsystemLevel, ok := c.Levels[subsystem]
+		if !ok {
+			return std
+		}
+
+		logger := log.New()
+		logger.SetOutput(output)
+		logger.SetFormatter(formatter)
+		logger.ReplaceHooks(hooks)
+		parsed, _ := ParseLogLevel(subsystemLevel)
+		logger.SetLevel(parsed)
+		return logger
+	}
+
+	gathererLog = newSubsystemLogger(LogSubsystemGatherers)
+	expressionLog = newSubsystemLogger(LogSubsystemExpressions)
+	deliveryLog = newSubsystemLogger(LogSubsystemDelivery)
+
+	return nil
+}
+
+// Makes the standard logger (with its current formatter) redact secrets known
+// to the redactor, for logging done before SetupLogging() is called.
+func RedactStandardLogger(redactor *Redactor) {
+	if redactor == nil {
+		return
+	}
+
+	SetLogRedactor(redactor)
+	std := log.StandardLogger()
+	if _, ok := std.Formatter.(*redactingFormatter); !ok {
+		std.SetFormatter(&redactingFormatter{formatter: std.Formatter})
+	}
+}
+
+func valueOrDefault(value int, defaultValue int) int {
+	if value == 0 {
+		return defaultValue
+	}
+
+	return value
+}
+
+// Resolves relative log file path against the base directory. Special
+// destinations are kept as-is.
+func resolveLogPath(path string, baseDir string) string {
+	switch path {
+	case "", LogDestinationStderr, LogDestinationStdout, LogDestinationSyslog:
+		return path
+	}
+
+	if filepath.IsAbs(path) {
+		return path
+	}
+
+	return filepath.Join(baseDir, path)
+}
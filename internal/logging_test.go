@@ -0,0 +1,88 @@
+package internal
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// Restores default logging after the test.
+func restoreLogging(t *testing.T) {
+	t.Cleanup(func() {
+		SetupLogging(LoggingConfig{Path: LogDestinationStderr}, "", false, nil)
+	})
+}
+
+func TestSetupLoggingFileJson(t *testing.T) {
+	restoreLogging(t)
+	path := filepath.Join(t.TempDir(), "reporter.log")
+
+	err := SetupLogging(LoggingConfig{
+		Path:   path,
+		Format: LogFormatJson,
+		Level:  "info",
+		Levels: StringMap{LogSubsystemGatherers: "debug", LogSubsystemDelivery: "error"},
+	}, "/nonexistent/default.log", false, nil)
+	assert.NoError(t, err)
+
+	log.Info("main info")
+	log.Debug("main debug")
+	gathererLog.Debug("gatherer debug")
+	deliveryLog.Warn("delivery warning")
+	deliveryLog.Error("delivery error")
+	expressionLog.Info("expression info")
+
+	content, err := os.ReadFile(path)
+	assert.NoError(t, err)
+
+	var messages []string
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		var entry map[string]interface{}
+		assert.NoError(t, json.Unmarshal([]byte(line), &entry))
+		messages = append(messages, entry["msg"].(string))
+	}
+
+	assert.Equal(t, []string{
+		"main info",
+		"gatherer debug",
+		"delivery error",
+		"expression info",
+	}, messages)
+}
+
+func TestSetupLoggingDefaultPath(t *testing.T) {
+	restoreLogging(t)
+	path := filepath.Join(t.TempDir(), "default.log")
+
+	assert.NoError(t, SetupLogging(LoggingConfig{}, path, false, nil))
+	log.Warn("some warning")
+	log.Info("some info")
+
+	content, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), `level=warning msg="some warning"`)
+	assert.NotContains(t, string(content), "some info")
+}
+
+func TestLoggingConfigValidation(t *testing.T) {
+	assert.NoError(t, validateLoggingConfig(LoggingConfig{}))
+	assert.EqualError(t, validateLoggingConfig(LoggingConfig{Format: "xml"}), "unknown log format 'xml'")
+	assert.EqualError(t, validateLoggingConfig(LoggingConfig{Level: "loud"}), "unknown log level 'loud'")
+	assert.EqualError(
+		t,
+		validateLoggingConfig(LoggingConfig{Levels: StringMap{"network": "info"}}),
+		"unknown logging subsystem 'network'",
+	)
+}
+
+func TestResolveLogPath(t *testing.T) {
+	assert.Equal(t, "stderr", resolveLogPath("stderr", "/etc/reporter"))
+	assert.Equal(t, "", resolveLogPath("", "/etc/reporter"))
+	assert.Equal(t, "/var/log/reporter.log", resolveLogPath("/var/log/reporter.log", "/etc/reporter"))
+	assert.Equal(t, "/etc/reporter/logs/reporter.log", resolveLogPath("logs/reporter.log", "/etc/reporter"))
+}
@@ -0,0 +1,222 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	metricCounter   = "counter"
+	metricGauge     = "gauge"
+	metricHistogram = "histogram"
+)
+
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Upper bounds (in seconds) of histogram buckets.
+var metricBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+type metricDefinition struct {
+	kind string
+	help string
+}
+
+// All metrics exposed by the reporter about itself.
+var metricDefinitions = map[string]metricDefinition{
+	"reporter_info": {
+		metricGauge, "Information about the reporter.",
+	},
+	"reporter_cycles_total": {
+		metricCounter, "Total number of gather-and-send cycles.",
+	},
+	"reporter_cycle_duration_seconds": {
+		metricHistogram, "Duration of whole gather-and-send cycles.",
+	},
+	"reporter_last_cycle_timestamp_seconds": {
+		metricGauge, "Unix timestamp of the last finished cycle.",
+	},
+	"reporter_gatherer_runs_total": {
+		metricCounter, "Total number of gatherer runs by their status.",
+	},
+	"reporter_gatherer_duration_seconds": {
+		metricHistogram, "Duration of gatherer runs.",
+	},
+	"reporter_gatherer_last_exit_code": {
+		metricGauge, "Exit code of the last gatherer run (-1 if it didn't exit normally).",
+	},
+	"reporter_expression_errors_total": {
+		metricCounter, "Total number of errors when evaluating payload expressions.",
+	},
+	"reporter_deliveries_total": {
+		metricCounter, "Total number of payload deliveries by target and response status code.",
+	},
+	"reporter_delivery_duration_seconds": {
+		metricHistogram, "Duration of payload deliveries by target.",
+	},
+}
+
+// Collection of metrics about the reporter itself, which can be served in
+// Prometheus text exposition format.
+type Metrics struct {
+	mu     sync.Mutex
+	series map[string]map[string]*metricSeries // [name: [labels: series]]
+}
+
+type metricSeries struct {
+	value   float64  // Value of counter or gauge.
+	buckets []uint64 // Cumulative bucket counts of histogram.
+	sum     float64  // Sum of observed values of histogram.
+	count   uint64   // Number of observed values of histogram.
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{series: make(map[string]map[string]*metricSeries)}
+}
+
+// Returns series of the metric with the labels (specified as key-value pairs),
+// creating it if it doesn't exist yet. Must be called with the mutex locked.
+func (m *Metrics) getSeries(name string, labels []string) *metricSeries {
+	if _, ok := metricDefinitions[name]; !ok {
+		panic(fmt.Sprintf("undefined metric '%s'", name))
+	}
+
+	var rendered []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		rendered = append(rendered, fmt.Sprintf(`%s="%s"`, labels[i], metricLabelEscaper.Replace(labels[i+1])))
+	}
+	key := strings.Join(rendered, ",")
+
+	if m.series[name] == nil {
+		m.series[name] = make(map[string]*metricSeries)
+	}
+
+	series, ok := m.series[name][key]
+	if !ok {
+		series = &metricSeries{buckets: make([]uint64, len(metricBuckets))}
+		m.series[name][key] = series
+	}
+
+	return series
+}
+
+// Increments counter by the value.
+func (m *Metrics) Add(name string, value float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.getSeries(name, labels).value += value
+}
+
+// Sets gauge to the value.
+func (m *Metrics) Set(name string, value float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.getSeries(name, labels).value = value
+}
+
+// Records an observed value into histogram.
+func (m *Metrics) Observe(name string, value float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	series := m.getSeries(name, labels)
+	series.sum += value
+	series.count++
+	for i, bound := range metricBuckets {
+		if value <= bound {
+			series.buckets[i]++
+		}
+	}
+}
+
+// Writes all metrics in Prometheus text exposition format.
+func (m *Metrics) Write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, 0, len(m.series))
+	for name := range m.series {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		def := metricDefinitions[name]
+		fmt.Fprintf(w, "# HELP %s %s\n", name, def.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, def.kind)
+
+		keys := make([]string, 0, len(m.series[name]))
+		for key := range m.series[name] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			series := m.series[name][key]
+			if def.kind != metricHistogram {
+				fmt.Fprintf(w, "%s%s %s\n", name, wrapLabels(key), formatMetricValue(series.value))
+				continue
+			}
+
+			for i, bound := range metricBuckets {
+				le := joinLabels(key, fmt.Sprintf(`le="%s"`, formatMetricValue(bound)))
+				fmt.Fprintf(w, "%s_bucket{%s} %d\n", name, le, series.buckets[i])
+			}
+			fmt.Fprintf(w, "%s_bucket{%s} %d\n", name, joinLabels(key, `le="+Inf"`), series.count)
+			fmt.Fprintf(w, "%s_sum%s %s\n", name, wrapLabels(key), formatMetricValue(series.sum))
+			fmt.Fprintf(w, "%s_count%s %d\n", name, wrapLabels(key), series.count)
+		}
+	}
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.Write(w)
+}
+
+// Starts HTTP server serving metrics on "/metrics" in background until the
+// context is done.
+func (m *Metrics) Serve(ctx context.Context, address string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	server := &http.Server{Addr: address, Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	go func() {
+		log.Infof("Serving metrics on http://%s/metrics", address)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Metrics server failed: %s", err.Error())
+		}
+	}()
+}
+
+func wrapLabels(labels string) string {
+	if labels == "" {
+		return ""
+	}
+
+	return "{" + labels + "}"
+}
+
+func joinLabels(labels string, extra string) string {
+	if labels == "" {
+		return extra
+	}
+
+	return labels + "," + extra
+}
+
+func formatMetricValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
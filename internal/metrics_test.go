@@ -0,0 +1,54 @@
+package internal
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsExposition(t *testing.T) {
+	metrics := NewMetrics()
+	metrics.Add("reporter_cycles_total", 1)
+	metrics.Add("reporter_cycles_total", 1)
+	metrics.Set("reporter_gatherer_last_exit_code", 3, "gatherer", "some_script")
+	metrics.Add("reporter_deliveries_total", 1, "target", "https://localhost/report", "code", "200")
+	metrics.Add("reporter_deliveries_total", 1, "target", `https://x/"quoted"`, "code", "error")
+	metrics.Observe("reporter_cycle_duration_seconds", 0.3)
+	metrics.Observe("reporter_cycle_duration_seconds", 2)
+
+	var out strings.Builder
+	metrics.Write(&out)
+	text := out.String()
+
+	assert.Contains(t, text, "# TYPE reporter_cycles_total counter\nreporter_cycles_total 2\n")
+	assert.Contains(t, text, `reporter_gatherer_last_exit_code{gatherer="some_script"} 3`)
+	assert.Contains(t, text, `reporter_deliveries_total{target="https://localhost/report",code="200"} 1`)
+	assert.Contains(t, text, `reporter_deliveries_total{target="https://x/\"quoted\"",code="error"} 1`)
+	assert.Contains(t, text, "# TYPE reporter_cycle_duration_seconds histogram\n")
+	assert.Contains(t, text, `reporter_cycle_duration_seconds_bucket{le="0.25"} 0`)
+	assert.Contains(t, text, `reporter_cycle_duration_seconds_bucket{le="0.5"} 1`)
+	assert.Contains(t, text, `reporter_cycle_duration_seconds_bucket{le="2.5"} 2`)
+	assert.Contains(t, text, `reporter_cycle_duration_seconds_bucket{le="+Inf"} 2`)
+	assert.Contains(t, text, "reporter_cycle_duration_seconds_sum 2.3\n")
+	assert.Contains(t, text, "reporter_cycle_duration_seconds_count 2\n")
+}
+
+func TestMetricsHandler(t *testing.T) {
+	metrics := NewMetrics()
+	metrics.Add("reporter_expression_errors_total", 5)
+
+	server := httptest.NewServer(metrics)
+	defer server.Close()
+
+	response, err := http.Get(server.URL + "/metrics")
+	assert.NoError(t, err)
+	defer response.Body.Close()
+
+	body, _ := io.ReadAll(response.Body)
+	assert.Contains(t, response.Header.Get("Content-Type"), "text/plain")
+	assert.Contains(t, string(body), "reporter_expression_errors_total 5\n")
+}
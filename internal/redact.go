@@ -0,0 +1,272 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Replacement of secret values in logs and verbose output.
+const RedactedValue = "[REDACTED]"
+
+// Secrets shorter than this are redacted only as whole tokens (i.e. not
+// when surrounded by letters, digits or underscores), so that e.g. secret "1"
+// doesn't garble every number in logs.
+const minSubstringSecretLength = 8
+
+// Replaces known secret values in strings. Secrets from config are known
+// from the start, other secrets (e.g. values of secret payload fields) are
+// added in each cycle and kept only until the cycle after the next one
+// starts, so that they don't accumulate when they change. Nil Redactor
+// doesn't redact anything.
+type Redactor struct {
+	mu        sync.RWMutex
+	static    map[string]bool
+	cycle     map[string]bool // Added in the current cycle.
+	lastCycle map[string]bool // Added in the previous cycle.
+	secrets   []string        // All of the above, sorted from the longest.
+}
+
+func NewRedactor(secrets ...string) *Redactor {
+	r := &Redactor{
+		static:    make(map[string]bool),
+		cycle:     make(map[string]bool),
+		lastCycle: make(map[string]bool),
+	}
+	r.addTo(r.static, secrets)
+
+	return r
+}
+
+// Adds secrets found in the current cycle.
+func (r *Redactor) Add(secrets ...string) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.addTo(r.cycle, secrets)
+}
+
+// Starts a new cycle, forgetting secrets added before the previous one.
+func (r *Redactor) StartCycle() {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.lastCycle = r.cycle
+	r.cycle = make(map[string]bool)
+	r.updateSecrets()
+}
+
+func (r *Redactor) addTo(set map[string]bool, secrets []string) {
+	added := false
+	for _, secret := range secrets {
+		// Secrets can appear in JSON output (e.g. JSON logs) with special
+		// characters escaped.
+		encoded, _ := json.Marshal(secret)
+		escaped := string(encoded[1 : len(encoded)-1])
+
+		for _, variant := range []string{secret, escaped} {
+			if variant == "" || set[variant] {
+				continue
+			}
+			set[variant] = true
+			added = true
+		}
+	}
+
+	if added {
+		r.updateSecrets()
+	}
+}
+
+func (r *Redactor) updateSecrets() {
+	known := make(map[string]bool)
+	r.secrets = r.secrets[:0]
+	for _, set := range []map[string]bool{r.static, r.lastCycle, r.cycle} {
+		for secret := range set {
+			if !known[secret] {
+				known[secret] = true
+				r.secrets = append(r.secrets, secret)
+			}
+		}
+	}
+
+	// Longer secrets first, so that a secret containing another one is
+	// redacted completely.
+	sort.Slice(r.secrets, func(i, j int) bool {
+		if len(r.secrets[i]) != len(r.secrets[j]) {
+			return len(r.secrets[i]) > len(r.secrets[j])
+		}
+		return r.secrets[i] < r.secrets[j]
+	})
+}
+
+func (r *Redactor) Redact(str string) string {
+	if r == nil {
+		return str
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, secret := range r.secrets {
+		if len(secret) < minSubstringSecretLength {
+			str = replaceToken(str, secret, RedactedValue)
+		} else {
+			str = strings.ReplaceAll(str, secret, RedactedValue)
+		}
+	}
+
+	return str
+}
+
+// Replaces secrets in strings (values and keys) in the JSON. Other values
+// (e.g. numbers) are kept, so that the result is still valid JSON.
+func (r *Redactor) RedactJson(data []byte) ([]byte, error) {
+	if r == nil {
+		return data, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(r.redactValue(value))
+}
+
+func (r *Redactor) redactValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(value))
+		for k, v := range value {
+			result[r.Redact(k)] = r.redactValue(v)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(value))
+		for i, v := range value {
+			result[i] = r.redactValue(v)
+		}
+		return result
+	case string:
+		return r.Redact(value)
+	}
+
+	return value
+}
+
+// Replaces occurrences of the token which are not surrounded by letters,
+// digits or underscores.
+func replaceToken(str string, token string, replacement string) string {
+	var result strings.Builder
+
+	for {
+		i := strings.Index(str, token)
+		if i < 0 {
+			break
+		}
+
+		end := i + len(token)
+		if (i > 0 && isWordByte(str[i-1])) || (end < len(str) && isWordByte(str[end])) {
+			result.WriteString(str[:i+1])
+			str = str[i+1:]
+			continue
+		}
+
+		result.WriteString(str[:i])
+		result.WriteString(replacement)
+		str = str[end:]
+	}
+	result.WriteString(str)
+
+	return result.String()
+}
+
+func isWordByte(b byte) bool {
+	return b == '_' || ('0' <= b && b <= '9') || ('a' <= b && b <= 'z') || ('A' <= b && b <= 'Z')
+}
+
+// Redactor used by log formatters. It's replaced when config (and so its
+// secrets) is reloaded.
+var logRedactor atomic.Pointer[Redactor]
+
+// Sets redactor of secrets used by log formatters set up by SetupLogging()
+// or RedactStandardLogger().
+func SetLogRedactor(redactor *Redactor) {
+	logRedactor.Store(redactor)
+}
+
+// Log formatter redacting secrets in output of another formatter.
+type redactingFormatter struct {
+	formatter log.Formatter
+}
+
+func (f *redactingFormatter) Format(entry *log.Entry) ([]byte, error) {
+	formatted, err := f.formatter.Format(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(logRedactor.Load().Redact(string(formatted))), nil
+}
+
+// Finds all string values in the value (recursively). Other scalars (numbers
+// and booleans) are not considered secret, as they're too likely to appear in
+// logs anyway.
+func collectStrings(value interface{}) []string {
+	var result []string
+
+	switch value := value.(type) {
+	case StringKeyMap:
+		for _, v := range value {
+			result = append(result, collectStrings(v)...)
+		}
+	case []interface{}:
+		for _, v := range value {
+			result = append(result, collectStrings(v)...)
+		}
+	case string:
+		result = append(result, value)
+	}
+
+	return result
+}
+
+// Returns value at the path (e.g. "fields[0].value") in the payload, nil if
+// there's none.
+func lookupPayloadPath(payload PayloadType, path string) interface{} {
+	var current interface{} = payload
+
+	for _, segment := range splitConfigPath(path) {
+		switch value := current.(type) {
+		case StringKeyMap:
+			current = value[segment]
+		case []interface{}:
+			index, err := strconv.Atoi(segment)
+			if err != nil || index < 0 || index >= len(value) {
+				return nil
+			}
+			current = value[index]
+		default:
+			return nil
+		}
+	}
+
+	return current
+}
@@ -0,0 +1,160 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactor(t *testing.T) {
+	r := NewRedactor("abc", "", "abcdef")
+	r.Add(`with "quotes"`)
+
+	assert.Equal(t, "x [REDACTED] y [REDACTED] z", r.Redact("x abcdef y abc z"))
+	assert.Equal(t, `{"msg":"[REDACTED]"}`, r.Redact(`{"msg":"with \"quotes\""}`))
+	assert.Equal(t, "no secrets", r.Redact("no secrets"))
+
+	var none *Redactor
+	none.Add("abc")
+	assert.Equal(t, "abc", none.Redact("abc"))
+}
+
+func TestRedactorShortSecrets(t *testing.T) {
+	r := NewRedactor("1", "true")
+
+	// Short secrets are redacted only as whole tokens.
+	assert.Equal(t, "cycle 12, took 100ms", r.Redact("cycle 12, took 100ms"))
+	assert.Equal(t, "code [REDACTED], ok=[REDACTED]", r.Redact("code 1, ok=true"))
+	assert.Equal(t, "untrue [REDACTED]", r.Redact("untrue true"))
+
+	// Only strings of secret payload fields are secrets.
+	assert.Equal(t, []string{"token"}, collectStrings(StringKeyMap{
+		"token":   "token",
+		"id":      float64(1),
+		"enabled": true,
+		"none":    nil,
+	}))
+}
+
+func TestRedactorCycles(t *testing.T) {
+	r := NewRedactor("static-secret")
+
+	r.Add("first-cycle-secret")
+	r.StartCycle()
+	r.Add("second-cycle-secret")
+	assert.Equal(t, "[REDACTED] [REDACTED] [REDACTED]", r.Redact("static-secret first-cycle-secret second-cycle-secret"))
+
+	// Secrets from cycles before the previous one are forgotten.
+	r.StartCycle()
+	assert.Equal(t, "[REDACTED] first-cycle-secret [REDACTED]", r.Redact("static-secret first-cycle-secret second-cycle-secret"))
+	r.StartCycle()
+	assert.Equal(t, []string{"static-secret"}, r.secrets)
+}
+
+func TestSecretsNeverLogged(t *testing.T) {
+	restoreLogging(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	t.Setenv("REPORTER_TEST_TOKEN", "env-token-1234")
+	dir := writeConfigFiles(t, map[string]string{
+		"config.json": `{
+			"target": ["` + server.URL + `/report"],
+			"gatherers": ["./gatherer.sh", "./failing.sh"],
+			"env": {
+				"TOKEN": "${env:REPORTER_TEST_TOKEN}",
+				"PASSWORD": "${file:password}",
+			},
+			"payload": {
+				"auth": {"token": "${api.token}"},
+				"broken": "${1 + api.token}",
+			},
+			"secrets": ["env.TOKEN", "payload.auth"],
+		}`,
+		"password":    "file-password-5678\n",
+		"gatherer.sh": "#!/bin/sh\necho api.token=gathered-token-9012\n",
+		"failing.sh":  "#!/bin/sh\necho \"$TOKEN $PASSWORD\" >&2\nexit 1\n",
+	})
+	secrets := []string{"env-token-1234", "file-password-5678", "gathered-token-9012"}
+
+	config, err := ReadConfig(filepath.Join(dir, "config.json"))
+	assert.NoError(t, err)
+
+	for _, format := range []string{LogFormatText, LogFormatJson} {
+		logPath := filepath.Join(t.TempDir(), "reporter.log")
+		assert.NoError(t, SetupLogging(LoggingConfig{
+			Path:   logPath,
+			Format: format,
+			Level:  "debug",
+		}, "", false, config.Redactor()))
+
+		var verbose bytes.Buffer
+		reporter := Reporter{ConfigJson: config, HttpClient: &http.Client{}, VerboseOutput: &verbose}
+		summary, err := reporter.Single(context.Background())
+		assert.NoError(t, err)
+		log.Infof("Payload sent: %v", summary.Payload)
+
+		logged, err := os.ReadFile(logPath)
+		assert.NoError(t, err)
+
+		// The secrets are used, but never shown.
+		assert.Equal(t, "gathered-token-9012", summary.Payload["auth"].(StringKeyMap)["token"])
+		assert.Contains(t, string(logged), "exited with code 1")
+		assert.Contains(t, string(logged), RedactedValue)
+		assert.Contains(t, verbose.String(), RedactedValue)
+		for _, secret := range secrets {
+			assert.NotContains(t, string(logged), secret, format)
+			assert.NotContains(t, verbose.String(), secret, format)
+		}
+	}
+}
+
+func TestSecretsAfterReload(t *testing.T) {
+	restoreLogging(t)
+
+	readConfig := func(token string) Config {
+		config, err := buildConfigFromJson([]byte(`{
+	"env": {"TOKEN": "`+token+`"},
+	"secrets": ["env.TOKEN"],
+}`), "/opt/reporter")
+		assert.NoError(t, err)
+		return config
+	}
+
+	config := readConfig("first-token-1234")
+	logPath := filepath.Join(t.TempDir(), "reporter.log")
+	assert.NoError(t, SetupLogging(LoggingConfig{Path: logPath}, "", false, config.Redactor()))
+
+	reporter := &Reporter{ConfigJson: config}
+	reporter.applyReloadedConfig(readConfig("second-token-5678"))
+	// Secrets found in cycles are added to the new config's redactor.
+	reporter.ConfigJson.redactor.Add("payload-secret-9012")
+	log.Warnf("Tokens: second-token-5678 payload-secret-9012")
+
+	logged, err := os.ReadFile(logPath)
+	assert.NoError(t, err)
+	assert.Contains(t, string(logged), "Tokens: [REDACTED] [REDACTED]")
+}
+
+func TestSecretPathErrors(t *testing.T) {
+	_, err := buildConfigFromJson([]byte(`{
+	"env": {"TOKEN": "x"},
+	"secrets": ["env.TOKEN", "env.MISSING"],
+}`), "/opt/reporter")
+
+	var errs ConfigErrors
+	assert.ErrorAs(t, err, &errs)
+	assert.Equal(t, []string{
+		"3:27: secrets[1]: secret 'env.MISSING' not found in config",
+	}, configErrorStrings(errs))
+}
@@ -2,11 +2,16 @@ package internal
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
 	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -15,52 +20,260 @@ import (
 	"github.com/mohae/deepcopy"
 )
 
+// Gatherer's stderr output beyond this size is discarded.
+const maxGathererStderrSize = 4096
+
+// Time to wait between two cycles if not specified in config.
+const defaultRunInterval = 10 * time.Second
+
+// Name of the report made of top-level "target" and "payload" in config.
+const defaultReportName = "default"
+
+// Policies for output of gatherers that failed.
+const (
+	GathererOnFailureDiscard         = "discard"
+	GathererOnFailureKeep            = "keep"
+	GathererOnFailureKeepWithWarning = "keep-with-warning"
+)
+
+// Key of directive including a nested object or an array item in payload only
+// if its condition (usually an expression) is true, e.g.
+// {"$if": "${defined(raid.status)}", "value": "${raid.status}"}.
+const payloadIfKey = "$if"
+
+// Keys of directive generating array items from the item for each variable
+// matching a pattern, e.g. {"$each": "disk.*.used", "$as": "disk", "title":
+// "${disk}", "value": "${$value}"}. Parts of the variable name matched by "*"
+// are available as "$1", "$2", ... (and under comma-separated names from
+// "$as"), the whole name as "$key" and the variable's value as "$value".
+const (
+	payloadEachKey = "$each"
+	payloadAsKey   = "$as"
+)
+
 // Recursively iterates over a payload template and expands variables and
-// expressions in all of the string values present. The result is then returned.
+// expressions in all of the string values present. Templates compiled in
+// advance are used, if available. Nested objects and array items with "$if"
+// condition which is not true are omitted. The result is then returned
+// together with errors of expressions that couldn't be evaluated (such values
+// are kept unexpanded).
 func buildPayload(
 	template PayloadType,
 	vars EvalVariables,
-) PayloadType {
+	templates map[string]*compiledTemplate,
+) (PayloadType, []error) {
+	var errs []error
 
 	for k, v := range template {
+		// The condition was already evaluated for the object.
+		if k == payloadIfKey {
+			delete(template, k)
+			continue
+		}
+
 		switch v := v.(type) {
 		case string:
-			_v, err := expandExpressions(v, vars)
+			_v, err := expandPayloadString(v, vars, templates)
 
 			// Replace the value only if there was not an error.
 			if err == nil {
 				template[k] = _v
+			} else {
+				expressionLog.Debugf("Cannot expand '%s': %s", v, err.Error())
+				errs = append(errs, err)
 			}
 		case float64:
 			template[k] = v
 		case StringKeyMap:
-			template[k] = buildPayload(v, vars)
+			include, err := payloadCondition(v, vars, templates)
+			if err != nil {
+				errs = append(errs, err)
+			}
+			if !include {
+				delete(template, k)
+				continue
+			}
+
+			var subErrs []error
+			template[k], subErrs = buildPayload(v, vars, templates)
+			errs = append(errs, subErrs...)
 		case []interface{}:
 			// Slice/array? Iterate over its items (we assume the items are
 			// maps) and process each one of them).
-			for i, sub_v := range v {
-				v[i] = buildPayload(sub_v.(StringKeyMap), vars)
+			items := make([]interface{}, 0, len(v))
+			for _, sub_v := range v {
+				sub_map, ok := sub_v.(StringKeyMap)
+				if !ok {
+					errs = append(errs, fmt.Errorf("unexpected payload template array item of type '%T'", sub_v))
+					items = append(items, sub_v)
+					continue
+				}
+
+				if _, ok := sub_map[payloadEachKey]; ok {
+					loopItems, subErrs := expandPayloadLoop(sub_map, vars, templates)
+					errs = append(errs, subErrs...)
+					items = append(items, loopItems...)
+					continue
+				}
+
+				include, err := payloadCondition(sub_map, vars, templates)
+				if err != nil {
+					errs = append(errs, err)
+				}
+				if !include {
+					continue
+				}
+
+				item, subErrs := buildPayload(sub_map, vars, templates)
+				errs = append(errs, subErrs...)
+				items = append(items, item)
 			}
+			template[k] = items
 		default:
-			ErrorExit("Building payload", fmt.Sprintf("encountered unexpected payload template value of type '%s'", v))
+			errs = append(errs, fmt.Errorf("unexpected payload template value of type '%T'", v))
+		}
+	}
+
+	return template, errs
+
+}
+
+// Expands expressions in the payload template string, using the compiled
+// template if available.
+func expandPayloadString(str string, vars EvalVariables, templates map[string]*compiledTemplate) (string, error) {
+	if compiled, ok := templates[str]; ok {
+		return compiled.expand(vars)
+	}
+
+	return expandExpressions(str, vars)
+}
+
+// Evaluates "$if" condition of the payload template object. Objects without
+// condition are always included, while objects whose condition couldn't be
+// evaluated are omitted.
+func payloadCondition(
+	template PayloadType,
+	vars EvalVariables,
+	templates map[string]*compiledTemplate,
+) (bool, error) {
+	var value string
+	var err error
+
+	switch condition := template[payloadIfKey].(type) {
+	case nil:
+		return true, nil
+	case float64:
+		return condition != 0, nil
+	case string:
+		value, err = expandPayloadString(condition, vars, templates)
+	default:
+		return false, fmt.Errorf("unexpected payload condition of type '%T'", condition)
+	}
+
+	if err != nil {
+		expressionLog.Debugf("Cannot evaluate condition '%s': %s", template[payloadIfKey], err.Error())
+		return false, err
+	}
+
+	return isTruthy(value), nil
+}
+
+// Builds an item from the "$each" template item for each variable matching its
+// pattern (sorted by names of the variables).
+func expandPayloadLoop(
+	template PayloadType,
+	vars EvalVariables,
+	templates map[string]*compiledTemplate,
+) ([]interface{}, []error) {
+	// Patterns of nested loops may use variables bound by the outer ones.
+	pattern, _ := template[payloadEachKey].(string)
+	pattern, err := expandPayloadString(pattern, vars, templates)
+	if err != nil {
+		expressionLog.Debugf("Cannot expand loop pattern '%s': %s", template[payloadEachKey], err.Error())
+		return nil, []error{err}
+	}
+
+	as, _ := template[payloadAsKey].(string)
+	re := payloadEachRegexp(pattern)
+	names := payloadEachNames(as)
+
+	// Reserved variables (e.g. previous values) are not looped over.
+	var keys []string
+	for key := range vars {
+		if !isReservedVariable(key) && re.MatchString(key) {
+			keys = append(keys, key)
 		}
 	}
+	sort.Strings(keys)
+
+	var items []interface{}
+	var errs []error
+
+	for _, key := range keys {
+		loopVars := make(EvalVariables, len(vars)+2+2*len(names))
+		for k, v := range vars {
+			loopVars[k] = v
+		}
+		loopVars["$key"] = key
+		loopVars["$value"] = vars[key]
+		for i, part := range re.FindStringSubmatch(key)[1:] {
+			loopVars["$"+strconv.Itoa(i+1)] = part
+			if i < len(names) {
+				loopVars[names[i]] = part
+			}
+		}
+
+		item := deepcopy.Copy(template).(PayloadType)
+		delete(item, payloadEachKey)
+		delete(item, payloadAsKey)
+
+		include, err := payloadCondition(item, loopVars, templates)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if !include {
+			continue
+		}
+
+		built, subErrs := buildPayload(item, loopVars, templates)
+		errs = append(errs, subErrs...)
+		items = append(items, built)
+	}
+
+	return items, errs
+}
 
-	return template
+// Returns regexp matching names of variables matched by "$each" pattern, with
+// a group for each "*" wildcard (matching a single part of the name).
+func payloadEachRegexp(pattern string) *regexp.Regexp {
+	quoted := regexp.QuoteMeta(pattern)
+	return regexp.MustCompile("^" + strings.ReplaceAll(quoted, `\*`, `([^.]+)`) + "$")
+}
+
+// Returns names bound to parts matched by wildcards of "$each" pattern.
+func payloadEachNames(as string) []string {
+	var names []string
+	for _, name := range strings.Split(as, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
 
+	return names
 }
 
 func executeGatherer(
+	ctx context.Context,
 	wg *sync.WaitGroup,
 	channel chan<- *OrderedGathererResult,
 	index int,
-	gathererPath string,
+	gatherer GathererConfig,
 	env map[string]string,
 ) {
 	defer (*wg).Done()
 
-	log.Info("Executing gatherer:", TryMakingRelativePath(gathererPath))
-	cmd := exec.Command(gathererPath)
+	gathererLog.Info("Executing gatherer:", gatherer)
+	cmd := exec.CommandContext(ctx, gatherer.Path)
 
 	// Load Env variables from config and set them to subprocess Env.
 	cmd.Env = os.Environ()
@@ -69,57 +282,147 @@ func executeGatherer(
 		cmd.Env = append(cmd.Env, key+"="+value)
 	}
 
-	stdout, err := cmd.Output()
+	var stdout bytes.Buffer
+	stderr := &limitedBuffer{limit: maxGathererStderrSize}
+	cmd.Stdout = &stdout
+	cmd.Stderr = stderr
+
+	start := time.Now()
+	err := cmd.Run()
+	duration := time.Since(start)
+
+	// Exit code is -1 if the process couldn't be started or was killed.
+	exitCode := -1
+	if cmd.ProcessState != nil {
+		exitCode = cmd.ProcessState.ExitCode()
+	}
 
 	channel <- &OrderedGathererResult{
 		index:     index,
-		gatherer:  gathererPath,
+		gatherer:  gatherer,
 		exitError: err,
-		data:      readIniValues(stdout),
+		exitCode:  exitCode,
+		stderr:    stderr.String(),
+		duration:  duration,
+		data:      readIniValues(stdout.Bytes()),
 	}
 }
 
-func (r *Reporter) sendPayload(payload PayloadType) {
+// Sends the report's payload to all its targets and returns results of the
+// deliveries.
+func (r *Reporter) sendPayload(ctx context.Context, report ReportConfig, payload PayloadType) ([]DeliveryResult, error) {
+	var deliveries []DeliveryResult
+
 	jsonPayload, err := json.Marshal(payload)
-	FatalExitOnError(err)
+	if err != nil {
+		return nil, err
+	}
 
-	if Settings.VerboseMode {
+	if r.VerboseOutput != nil {
 		pretty, err := json.MarshalIndent(payload, "", "  ")
-		FatalExitOnError(err)
-		println("Payload:")
-		println(string(pretty))
+		if err != nil {
+			return nil, err
+		}
+		if report.path == "" {
+			fmt.Fprintln(r.VerboseOutput, "Payload:")
+		} else {
+			fmt.Fprintf(r.VerboseOutput, "Payload of report '%s':\n", report.Name)
+		}
+		fmt.Fprintln(r.VerboseOutput, r.ConfigJson.redactor.Redact(string(pretty)))
 	}
 
-	bytes := bytes.NewBuffer(jsonPayload)
 	userAgent := fmt.Sprintf("maxon-reporter[go][%s]", ReporterVersion)
 
-	for _, target := range r.ConfigJson.Target {
+	// Deliveries are labelled by report only if there are explicit reports.
+	reportName := ""
+	if report.path != "" {
+		reportName = report.Name
+	}
+
+	for _, target := range report.Target {
+		// Targets may contain secrets (e.g. tokens), which must not get into
+		// metrics.
+		targetLabel := r.ConfigJson.redactor.Redact(target)
 
-		request, err := http.NewRequest("POST", target, bytes)
-		FatalExitOnError(err)
+		request, err := http.NewRequestWithContext(ctx, "POST", target, bytes.NewReader(jsonPayload))
+		if err != nil {
+			deliveries = append(deliveries, DeliveryResult{Report: reportName, Target: target, Error: err.Error()})
+			continue
+		}
 
 		request.Header.Set("User-Agent", userAgent)
 		request.Header.Set("Content-Type", "application/json; charset=UTF-8")
+		if header := r.ConfigJson.HostId.Header; header != "" {
+			request.Header.Set(header, r.getHostId())
+		}
 
-		log.Infof("Sending payload to: %s", target)
+		deliveryLog.Infof("Sending payload to: %s", target)
+		start := time.Now()
 		response, err := r.HttpClient.Do(request)
+		duration := time.Since(start)
+		r.getMetrics().Observe("reporter_delivery_duration_seconds", duration.Seconds(), "target", targetLabel)
 
+		delivery := DeliveryResult{Report: reportName, Target: target, DurationMs: duration.Milliseconds()}
 		if err != nil {
+			status := "error"
 			if isTimeoutError(err) {
-				log.Errorf("Request timeout exceeded to: %s\n", target)
+				status = "timeout"
+				deliveryLog.Errorf("Request timeout exceeded to: %s\n", target)
 			} else {
-				log.Errorf("Request failed: %s\n", err.Error())
+				deliveryLog.Errorf("Request failed: %s\n", err.Error())
 			}
+			delivery.Error = err.Error()
+			r.getMetrics().Add("reporter_deliveries_total", 1, "target", targetLabel, "code", status)
 		} else {
-			log.Infof("Response [%s]", response.Status)
-			defer response.Body.Close()
+			deliveryLog.Infof("Response [%s]", response.Status)
+			response.Body.Close()
+			delivery.StatusCode = response.StatusCode
+			r.getMetrics().Add("reporter_deliveries_total", 1, "target", targetLabel, "code", strconv.Itoa(response.StatusCode))
 		}
+
+		deliveries = append(deliveries, delivery)
 	}
+
+	return deliveries, nil
+}
+
+// Returns metrics about the reporter itself, creating them if needed.
+func (r *Reporter) getMetrics() *Metrics {
+	if r.metrics == nil {
+		r.metrics = NewMetrics()
+		r.metrics.Set("reporter_info", 1, "version", ReporterVersion)
+	}
+
+	return r.metrics
+}
+
+// Runs all gatherers and returns variables for evaluating the payload
+// template (including built-in variables) together with names of gatherers
+// that failed. Each call is considered to be a new cycle.
+func (r *Reporter) Gather(ctx context.Context) (EvalVariables, []string) {
+	gathered := r.gather(ctx, r.ConfigJson.Gatherers)
+	return r.variables(gathered, nil), gathered.failed()
+}
+
+// Results of gatherers run in a single cycle.
+type gatheredResults struct {
+	now       time.Time // When the cycle started.
+	gatherers []GathererConfig
+	// Results of the gatherers (in the same order).
+	results []StringMap
+	// Built-in variables including gatherer health variables.
+	builtins StringMap
 }
 
-func (r *Reporter) Single() {
+// Runs the gatherers (starting a new cycle) and returns their results.
+func (r *Reporter) gather(ctx context.Context, gatherers []GathererConfig) *gatheredResults {
 	var wg sync.WaitGroup
-	gatherers := r.ConfigJson.Gatherers
+
+	now := time.Now()
+	if r.startedAt.IsZero() {
+		r.startedAt = now
+	}
+	r.cycle++
 
 	// Prepare empty slice for storing results of gatherers. We do this to keep
 	// track of their order (gatherers are executed asynchronously).
@@ -128,6 +431,7 @@ func (r *Reporter) Single() {
 	// about the order we get predictable behavior when two gatherers return
 	// values under identical key - the latter will overwrite the former.)
 	results := make([]StringMap, len(gatherers))
+	health := make(StringMap)
 
 	channel := make(chan *OrderedGathererResult)
 
@@ -136,7 +440,11 @@ func (r *Reporter) Single() {
 	// Run gatherers asynchronously in goroutines.
 	for index, gatherer := range gatherers {
 		wg.Add(1)
-		go executeGatherer(&wg, channel, index, gatherer, env)
+		if gatherer.Url != "" {
+			go scrapeGatherer(ctx, &wg, channel, index, gatherer)
+		} else {
+			go executeGatherer(ctx, &wg, channel, index, gatherer, env)
+		}
 	}
 
 	// Wait for all goroutines to finish.
@@ -152,43 +460,448 @@ func (r *Reporter) Single() {
 		close(channel)
 	}()
 
-	processResults(channel, &results)
-	finalResult := MergeResults(results)
+	r.processResults(channel, &results, health)
+
+	// Gatherer health variables are reporter-provided too, so they're treated
+	// just like other built-in variables.
+	return &gatheredResults{
+		now:       now,
+		gatherers: gatherers,
+		results:   results,
+		builtins: MergeResults([]StringMap{
+			r.builtinVariables(now),
+			health,
+		}),
+	}
+}
+
+// Returns variables made of results of the named gatherers (all of them if
+// there are no names), built-in variables and derived variables. Values from
+// previous cycles are available to expressions via reserved variables.
+func (r *Reporter) variables(gathered *gatheredResults, names []string) EvalVariables {
+	var results []StringMap
+	for i, gatherer := range gathered.gatherers {
+		if len(names) == 0 || containsString(names, gatherer.Name) {
+			results = append(results, gathered.results[i])
+		}
+	}
+
+	vars := r.mergeWithBuiltins(results, gathered.builtins)
+	r.addPreviousVariables(vars, gathered.now)
+	r.ConfigJson.addDerivedVariables(vars)
 
-	payload := buildPayload(
-		deepcopy.Copy(r.ConfigJson.Payload).(PayloadType),
-		finalResult,
+	return vars
+}
+
+// Returns names of gatherers which failed.
+func (g *gatheredResults) failed() []string {
+	return failedGatherers(g.gatherers, g.builtins)
+}
+
+// Runs gatherers needed by the reports (as a single cycle) and returns
+// variables for each of the reports.
+func (r *Reporter) GatherReports(ctx context.Context, reports []ReportConfig) []EvalVariables {
+	gathered := r.gather(ctx, reportGatherers(r.ConfigJson.Gatherers, reports))
+
+	result := make([]EvalVariables, len(reports))
+	for i, report := range reports {
+		result[i] = r.variables(gathered, report.Gatherers)
+		r.sampleReport(report, result[i], gathered.now, true)
+	}
+
+	return result
+}
+
+// Builds payload from the report's payload template using the variables.
+func (r *Reporter) Render(report ReportConfig, vars EvalVariables) (PayloadType, []error) {
+	r.ConfigJson.addSecretVariables(vars)
+	payload, errs := buildPayload(
+		deepcopy.Copy(report.Payload).(PayloadType),
+		vars,
+		r.ConfigJson.templates,
 	)
+	r.ConfigJson.addPayloadSecrets(report, payload)
+	if len(errs) != 0 {
+		expressionLog.Warnf("%d expression(s) in payload of report '%s' could not be evaluated", len(errs), report.Name)
+	}
+
+	return payload, errs
+}
 
-	r.sendPayload(payload)
+// Does a single cycle with all reports - runs gatherers, builds payloads and
+// sends them to all targets (even if their send interval didn't elapse yet).
+// Error is returned only if some payload couldn't be sent at all, results of
+// the particular deliveries are in the summary.
+func (r *Reporter) Single(ctx context.Context) (*CycleSummary, error) {
+	return r.runReports(ctx, r.ConfigJson.EffectiveReports(), true)
 }
 
-func (r *Reporter) Run() {
+// Does a single cycle with the reports. Gatherers needed by any of the
+// reports are run only once and their results are shared by the reports.
+// Reports with send interval are only sampled until it elapses, unless
+// sending is forced.
+func (r *Reporter) runReports(ctx context.Context, reports []ReportConfig, forceSend bool) (*CycleSummary, error) {
+	start := time.Now()
+	r.ConfigJson.redactor.StartCycle()
+	gathered := r.gather(ctx, reportGatherers(r.ConfigJson.Gatherers, reports))
+
+	vars := r.variables(gathered, nil)
+	summary := &CycleSummary{
+		Cycle:           r.cycle,
+		StartedAt:       start,
+		FailedGatherers: gathered.failed(),
+		Variables:       withoutReservedVariables(vars),
+		Deliveries:      []DeliveryResult{},
+		Reports:         []ReportSummary{},
+	}
+
+	var firstErr error
+	for _, report := range reports {
+		reportVars := r.variables(gathered, report.Gatherers)
+		if !r.sampleReport(report, reportVars, gathered.now, forceSend) {
+			log.Debugf("Report '%s' sampled, it will be sent later", report.Name)
+			continue
+		}
+
+		payload, errs := r.Render(report, reportVars)
+		deliveries, err := r.sendPayload(ctx, report, payload)
+		if err != nil {
+			deliveryLog.Errorf("Cannot send payload of report '%s': %s", report.Name, err.Error())
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+
+		if len(summary.Reports) == 0 {
+			summary.Payload = payload
+		}
+		summary.ExpressionErrors += len(errs)
+		summary.Deliveries = append(summary.Deliveries, deliveries...)
+		summary.Reports = append(summary.Reports, ReportSummary{
+			Name:             report.Name,
+			ExpressionErrors: len(errs),
+			Payload:          payload,
+			Deliveries:       deliveries,
+		})
+	}
+	summary.DurationMs = time.Since(start).Milliseconds()
+	r.recordPreviousVariables(summary.Variables, gathered.now)
+
+	r.mu.Lock()
+	r.lastCycle = summary
+	if r.lastPayloads == nil {
+		r.lastPayloads = make(map[string]PayloadType)
+	}
+	for _, report := range summary.Reports {
+		r.lastPayloads[report.Name] = report.Payload
+	}
+	r.mu.Unlock()
+
+	metrics := r.getMetrics()
+	metrics.Add("reporter_expression_errors_total", float64(summary.ExpressionErrors))
+	metrics.Add("reporter_cycles_total", 1)
+	metrics.Observe("reporter_cycle_duration_seconds", time.Since(start).Seconds())
+	metrics.Set("reporter_last_cycle_timestamp_seconds", float64(time.Now().Unix()))
+
+	return summary, firstErr
+}
+
+// Returns gatherers needed by the reports (in config order).
+func reportGatherers(gatherers []GathererConfig, reports []ReportConfig) []GathererConfig {
+	var needed []GathererConfig
+	for _, gatherer := range gatherers {
+		for _, report := range reports {
+			if len(report.Gatherers) == 0 || containsString(report.Gatherers, gatherer.Name) {
+				needed = append(needed, gatherer)
+				break
+			}
+		}
+	}
+
+	return needed
+}
+
+// Runs cycles periodically until the context is done. The control socket
+// and the metrics server (if enabled) are served meanwhile.
+func (r *Reporter) Run(ctx context.Context) error {
+	r.initControl()
+
+	if address := r.ConfigJson.Metrics.Listen; address != "" {
+		r.getMetrics().Serve(ctx, address)
+	}
+
+	if err := r.ServeControl(ctx); err != nil {
+		log.Errorf("Cannot start control socket: %s", err.Error())
+	}
+
+	if r.Systemd {
+		r.notifySystemdReady()
+	}
+
+	// Each report is due one interval from now - the first cycle with all
+	// reports was already done via Reporter.Single() (even before
+	// daemonization).
+	reports := r.ConfigJson.EffectiveReports()
+	due := scheduleReports(reports, time.Now())
+
 	for {
-		// Wait first - when the Maxon Reporter is executed, it's initial
-		// "gathering" is called first via Reporter.single(), which happens even
-		// before daemonization of the Reporter. Because of that when this
-		// Reporter.run() is then called, it's we actually have our first
-		// "gathering" done and it makes sense to wait at this point.
-		time.Sleep(10 * time.Second)
+		next := due[0]
+		for _, at := range due[1:] {
+			if at.Before(next) {
+				next = at
+			}
+		}
+		r.mu.Lock()
+		r.nextRunAt = next
+		r.mu.Unlock()
+
+		timer := time.NewTimer(time.Until(next))
+		forced := false
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		case <-r.runNow:
+			forced = true
+		case config := <-r.reload:
+			timer.Stop()
+			r.applyReloadedConfig(config)
+			log.Warning("Config reloaded:", config.path)
+			reports = config.EffectiveReports()
+			due = scheduleReports(reports, time.Now())
+			continue
+		}
+		timer.Stop()
+
+		// Forced cycle sends all reports, even the ones waiting for their send
+		// interval.
+		now := time.Now()
+		var running []ReportConfig
+		for i, report := range reports {
+			if forced || !now.Before(due[i]) {
+				running = append(running, report)
+				due[i] = now.Add(report.RunInterval())
+			}
+		}
+
+		if r.isPaused() && !forced {
+			log.Info("Reporter is paused, skipping cycle")
+			if r.Systemd {
+				// Being paused is intentional, so we keep the watchdog happy.
+				r.notifySystemdStatus("Paused")
+			}
+			continue
+		}
+
+		summary, err := r.runReports(ctx, running, forced)
+		if err != nil {
+			deliveryLog.Errorf("Cannot send payload: %s", err.Error())
+		}
+		if r.Systemd {
+			r.notifySystemdStatus(formatCycleStatus(summary))
+		}
+	}
+}
+
+// Replaces config of the running reporter. Logs redact secrets of the new
+// config since now and logging is set up again. Settings of the control
+// socket and the metrics server are applied only after restart.
+func (r *Reporter) applyReloadedConfig(config Config) {
+	previous := r.ConfigJson
+
+	r.mu.Lock()
+	r.ConfigJson = config
+	// Salt of the host ID may have changed.
+	r.hostId = ""
+	r.mu.Unlock()
+
+	SetLogRedactor(config.redactor)
+	if r.SetupLogging != nil {
+		if err := r.SetupLogging(config); err != nil {
+			log.Errorf("Cannot set up logging of reloaded config: %s", err.Error())
+		}
+	}
+
+	for _, setting := range restartOnlyChanges(previous, config) {
+		log.Warnf("Reloaded config changes '%s', which is applied only after restart", setting)
+	}
+}
 
-		r.Single()
+// Returns paths of settings which differ in the configs, but can be applied
+// only when the reporter starts.
+func restartOnlyChanges(previous Config, config Config) []string {
+	var changed []string
+	if previous.Control.Socket != config.Control.Socket {
+		changed = append(changed, "control.socket")
+	}
+	if previous.Control.Mode != config.Control.Mode {
+		changed = append(changed, "control.mode")
 	}
+	if previous.Metrics.Listen != config.Metrics.Listen {
+		changed = append(changed, "metrics.listen")
+	}
+
+	return changed
 }
 
-func processResults(channel chan *OrderedGathererResult, results *[]StringMap) {
+// Returns times when the reports are due for the first time after now.
+func scheduleReports(reports []ReportConfig, now time.Time) []time.Time {
+	due := make([]time.Time, len(reports))
+	for i, report := range reports {
+		due[i] = now.Add(report.RunInterval())
+	}
+
+	return due
+}
+
+// Returns time to wait between two cycles sending the report.
+func (r ReportConfig) RunInterval() time.Duration {
+	if r.Interval <= 0 {
+		return defaultRunInterval
+	}
+
+	return time.Duration(r.Interval)
+}
+
+// Returns time to wait between two cycles, i.e. the shortest interval of all
+// reports.
+func (c Config) RunInterval() time.Duration {
+	var shortest time.Duration
+	for _, report := range c.EffectiveReports() {
+		if interval := report.RunInterval(); shortest == 0 || interval < shortest {
+			shortest = interval
+		}
+	}
+
+	return shortest
+}
+
+func (r *Reporter) processResults(
+	channel chan *OrderedGathererResult,
+	results *[]StringMap,
+	health StringMap,
+) {
+	if r.lastSuccess == nil {
+		r.lastSuccess = make(map[string]gathererSnapshot)
+	}
+
 	// Gather results of all gatherers (while keeping track of their original
 	// order).
 	for result := range channel {
-		if result.exitError != nil {
-			log.Errorf("Gatherer %s exited with non-zero code: ", TryMakingRelativePath(result.gatherer))
-			if exitErr, ok := result.exitError.(*exec.ExitError); ok {
-				log.Error(exitErr.ExitCode())
-			} else {
-				log.Error("Unexpected error when processing exit code:", result.exitError.Error())
+		addGathererHealth(health, result)
+		name := result.gatherer.Name
+		r.recordGathererMetrics(result)
+
+		if result.exitError == nil {
+			if result.stderr != "" {
+				gathererLog.Warnf("Gatherer %s (%s) wrote to stderr: %s", name, result.gatherer, result.stderr)
 			}
-		} else {
+			r.lastSuccess[name] = gathererSnapshot{data: result.data, at: time.Now()}
 			(*results)[result.index] = result.data
+			continue
+		}
+
+		if _, ok := result.exitError.(*exec.ExitError); ok {
+			gathererLog.Errorf(
+				"Gatherer %s (%s) exited with code %d, stderr: %s",
+				name, result.gatherer, result.exitCode, result.stderr,
+			)
+		} else {
+			gathererLog.Errorf(
+				"Gatherer %s (%s) failed: %s",
+				name, result.gatherer, result.exitError.Error(),
+			)
 		}
+
+		(*results)[result.index] = r.resultOfFailedGatherer(result, health)
+	}
+}
+
+// Decides what data (if any) will be used from a gatherer that failed. If the
+// gatherer has a fallback grace period specified and its last successful run
+// happened within that period, results of that run are used. Partial output of
+// the failed run itself is then used on top of that if the gatherer's failure
+// policy says so.
+func (r *Reporter) resultOfFailedGatherer(
+	result *OrderedGathererResult,
+	health StringMap,
+) StringMap {
+	var layers []StringMap
+	gatherer := result.gatherer
+
+	grace := time.Duration(gatherer.FallbackGrace)
+	last, hasLast := r.lastSuccess[gatherer.Name]
+	if grace > 0 && hasLast && time.Since(last.at) <= grace {
+		gathererLog.Warnf(
+			"Gatherer %s failed, using its last successful result from %s",
+			gatherer.Name, last.at.Format(time.RFC3339),
+		)
+		health[gathererHealthPrefix+gatherer.Name+".stale"] = "1"
+		layers = append(layers, last.data)
+	}
+
+	switch gatherer.OnFailure {
+	case GathererOnFailureKeep:
+		layers = append(layers, result.data)
+	case GathererOnFailureKeepWithWarning:
+		gathererLog.Warnf("Gatherer %s failed, keeping its partial output: %d value(s)", gatherer.Name, len(result.data))
+		layers = append(layers, result.data)
 	}
+
+	if len(layers) == 0 {
+		return nil
+	}
+
+	return MergeResults(layers)
+}
+
+func (r *Reporter) recordGathererMetrics(result *OrderedGathererResult) {
+	metrics := r.getMetrics()
+	name := result.gatherer.Name
+
+	status := "ok"
+	if result.exitError != nil {
+		status = "failed"
+	}
+
+	metrics.Add("reporter_gatherer_runs_total", 1, "gatherer", name, "status", status)
+	metrics.Observe("reporter_gatherer_duration_seconds", result.duration.Seconds(), "gatherer", name)
+	metrics.Set("reporter_gatherer_last_exit_code", float64(result.exitCode), "gatherer", name)
+}
+
+// Returns names of gatherers which failed according to the health variables.
+func failedGatherers(gatherers []GathererConfig, health StringMap) []string {
+	failed := []string{}
+	for _, g := range gatherers {
+		if health[gathererHealthPrefix+g.Name+".ok"] == "0" {
+			failed = append(failed, g.Name)
+		}
+	}
+
+	return failed
+}
+
+// Stores information about the gatherer's run into variables available to
+// expressions under "_gatherers.<gatherer name>." prefix.
+func addGathererHealth(health StringMap, result *OrderedGathererResult) {
+	prefix := gathererHealthPrefix + result.gatherer.Name + "."
+
+	ok := "1"
+	stderr := result.stderr
+	if result.exitError != nil {
+		ok = "0"
+		// For failures not producing any stderr output (e.g. the gatherer
+		// couldn't be executed at all) use the error message itself.
+		if stderr == "" {
+			stderr = result.exitError.Error()
+		}
+	}
+
+	health[prefix+"ok"] = ok
+	health[prefix+"stale"] = "0"
+	health[prefix+"exit_code"] = strconv.Itoa(result.exitCode)
+	health[prefix+"stderr"] = strings.TrimSpace(stderr)
+	health[prefix+"duration_ms"] = strconv.FormatInt(result.duration.Milliseconds(), 10)
 }
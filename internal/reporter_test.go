@@ -1,19 +1,240 @@
 package internal
 
 import (
+	"context"
+	"io"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestReporter(t *testing.T) {
 
-	Settings.SelfDir = "../example"
-	config := LoadConfig(FindConfig())
+	path, err := SearchConfig("../example")
+	assert.NoError(t, err)
+	config, err := ReadConfig(path)
+	assert.NoError(t, err)
 
 	reporter := Reporter{
 		ConfigJson: config,
 		HttpClient: &http.Client{},
 	}
 
-	reporter.Single()
+	summary, err := reporter.Single(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, summary.Cycle)
+}
+
+// Creates an executable shell script gatherer in a temporary directory and
+// returns its path.
+func writeTestGatherer(t *testing.T, name string, script string) string {
+	path := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0755)
+	assert.NoError(t, err)
+
+	return path
+}
+
+func runTestGatherers(r *Reporter, gatherers []GathererConfig) ([]StringMap, StringMap) {
+	var wg sync.WaitGroup
+	channel := make(chan *OrderedGathererResult)
+	results := make([]StringMap, len(gatherers))
+	health := make(StringMap)
+
+	for i, g := range gatherers {
+		wg.Add(1)
+		go executeGatherer(context.Background(), &wg, channel, i, g, nil)
+	}
+
+	go func() {
+		wg.Wait()
+		close(channel)
+	}()
+
+	r.processResults(channel, &results, health)
+	return results, health
+}
+
+func TestGathererStderrAndHealth(t *testing.T) {
+	okPath := writeTestGatherer(t, "ok.sh", "echo a=1\n")
+	failingPath := writeTestGatherer(t, "failing.sh", "echo b=2\necho 'ZeroDivisionError: division by zero' >&2\nexit 3\n")
+
+	results, health := runTestGatherers(&Reporter{}, []GathererConfig{
+		{Name: "ok", Path: okPath},
+		{Name: "failing", Path: failingPath},
+		{Name: "missing", Path: okPath + ".nope"},
+	})
+
+	assert.Equal(t, StringMap{"a": "1"}, results[0])
+	assert.Nil(t, results[1])
+	assert.Nil(t, results[2])
+
+	assert.Equal(t, "1", health["_gatherers.ok.ok"])
+	assert.Equal(t, "0", health["_gatherers.ok.exit_code"])
+	assert.Equal(t, "", health["_gatherers.ok.stderr"])
+	assert.Contains(t, health, "_gatherers.ok.duration_ms")
+
+	assert.Equal(t, "0", health["_gatherers.failing.ok"])
+	assert.Equal(t, "3", health["_gatherers.failing.exit_code"])
+	assert.Equal(t, "ZeroDivisionError: division by zero", health["_gatherers.failing.stderr"])
+
+	assert.Equal(t, "0", health["_gatherers.missing.ok"])
+	assert.Equal(t, "-1", health["_gatherers.missing.exit_code"])
+	assert.Contains(t, health["_gatherers.missing.stderr"], "no such file or directory")
+
+	value, err := evalExpression("_gatherers.failing.exit_code * 2", health)
+	assert.NoError(t, err)
+	assert.Equal(t, "6", value)
+}
+
+func TestFailedGathererPolicies(t *testing.T) {
+	failingPath := writeTestGatherer(t, "failing.sh", "echo random_number=42\nexit 1\n")
+
+	results, _ := runTestGatherers(&Reporter{}, []GathererConfig{
+		{Name: "discard", Path: failingPath},
+		{Name: "keep", Path: failingPath, OnFailure: GathererOnFailureKeep},
+		{Name: "warn", Path: failingPath, OnFailure: GathererOnFailureKeepWithWarning},
+	})
+
+	assert.Nil(t, results[0])
+	assert.Equal(t, StringMap{"random_number": "42"}, results[1])
+	assert.Equal(t, StringMap{"random_number": "42"}, results[2])
+}
+
+func TestFailedGathererFallback(t *testing.T) {
+	failingPath := writeTestGatherer(t, "failing.sh", "echo b=3\nexit 1\n")
+	gatherers := []GathererConfig{
+		{Name: "fresh", Path: failingPath, FallbackGrace: Duration(time.Minute)},
+		{Name: "fresh_keep", Path: failingPath, FallbackGrace: Duration(time.Minute), OnFailure: GathererOnFailureKeep},
+		{Name: "expired", Path: failingPath, FallbackGrace: Duration(time.Minute)},
+		{Name: "no_grace", Path: failingPath},
+	}
+
+	reporter := &Reporter{lastSuccess: map[string]gathererSnapshot{
+		"fresh":      {data: StringMap{"a": "1", "b": "2"}, at: time.Now().Add(-30 * time.Second)},
+		"fresh_keep": {data: StringMap{"a": "1", "b": "2"}, at: time.Now().Add(-30 * time.Second)},
+		"expired":    {data: StringMap{"a": "1"}, at: time.Now().Add(-2 * time.Minute)},
+		"no_grace":   {data: StringMap{"a": "1"}, at: time.Now()},
+	}}
+
+	results, health := runTestGatherers(reporter, gatherers)
+
+	assert.Equal(t, StringMap{"a": "1", "b": "2"}, results[0])
+	assert.Equal(t, StringMap{"a": "1", "b": "3"}, results[1])
+	assert.Nil(t, results[2])
+	assert.Nil(t, results[3])
+
+	assert.Equal(t, "1", health["_gatherers.fresh.stale"])
+	assert.Equal(t, "0", health["_gatherers.expired.stale"])
+}
+
+func TestLimitedBuffer(t *testing.T) {
+	buffer := &limitedBuffer{limit: 5}
+	n, err := buffer.Write([]byte("abc"))
+	assert.Equal(t, 3, n)
+	assert.NoError(t, err)
+
+	n, _ = buffer.Write([]byte("defgh"))
+	assert.Equal(t, 5, n)
+	assert.Equal(t, "abcde... (truncated)", buffer.String())
+}
+
+func TestReports(t *testing.T) {
+	received := make(map[string][]string)
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		received[r.URL.Path] = append(received[r.URL.Path], string(body))
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	counter := filepath.Join(t.TempDir(), "runs")
+	dir := writeConfigFiles(t, map[string]string{
+		"config.json": `{
+			"gatherers": [
+				{"name": "load", "path": "./load.sh"},
+				{"name": "disk", "path": "./disk.sh"},
+			],
+			"reports": [
+				{
+					"name": "heartbeat",
+					"target": ["` + server.URL + `/heartbeat"],
+					"interval": "1m",
+					"gatherers": ["load"],
+					"payload": {"load": "${load}", "disk": "${disk}"},
+				},
+				{
+					"name": "detailed",
+					"target": ["` + server.URL + `/detailed"],
+					"payload": {"load": "${load}", "disk": "${disk}"},
+				},
+			],
+		}`,
+		"load.sh": "#!/bin/sh\necho load >> " + counter + "\necho load=1\n",
+		"disk.sh": "#!/bin/sh\necho disk >> " + counter + "\necho disk=2\n",
+	})
+
+	config, err := ReadConfig(filepath.Join(dir, "config.json"))
+	assert.NoError(t, err)
+	assert.Equal(t, defaultRunInterval, config.RunInterval())
+
+	reporter := Reporter{ConfigJson: config, HttpClient: &http.Client{}}
+	summary, err := reporter.Single(context.Background())
+	assert.NoError(t, err)
+	assert.NoError(t, summary.Err())
+
+	// Each gatherer runs only once, the heartbeat gets only its variables.
+	runs, _ := os.ReadFile(counter)
+	assert.ElementsMatch(t, []string{"load", "disk"}, strings.Fields(string(runs)))
+	assert.JSONEq(t, `{"load": "1", "disk": "${disk}"}`, received["/heartbeat"][0])
+	assert.JSONEq(t, `{"load": "1", "disk": "2"}`, received["/detailed"][0])
+
+	assert.Equal(t, 1, summary.ExpressionErrors)
+	assert.Equal(t, PayloadType{"load": "1", "disk": "${disk}"}, summary.Payload)
+	assert.Len(t, summary.Reports, 2)
+	assert.Equal(t, "detailed", summary.Reports[1].Name)
+	assert.Equal(t, []string{"heartbeat", "detailed"}, []string{
+		summary.Deliveries[0].Report,
+		summary.Deliveries[1].Report,
+	})
+
+	// Only gatherers needed by the reports being sent are run.
+	os.Remove(counter)
+	summary, err = reporter.runReports(context.Background(), config.EffectiveReports()[:1], false)
+	assert.NoError(t, err)
+	runs, _ = os.ReadFile(counter)
+	assert.Equal(t, "load\n", string(runs))
+	assert.Len(t, summary.Deliveries, 1)
+	assert.Equal(t, 2, summary.Cycle)
+}
+
+func TestReportsSchedule(t *testing.T) {
+	config := Config{
+		Interval: Duration(time.Minute),
+		Reports: []ReportConfig{
+			{Name: "a", Interval: Duration(5 * time.Second)},
+			{Name: "b"},
+		},
+	}
+
+	reports := config.EffectiveReports()
+	assert.Equal(t, 5*time.Second, reports[0].RunInterval())
+	assert.Equal(t, time.Minute, reports[1].RunInterval())
+	assert.Equal(t, 5*time.Second, config.RunInterval())
+
+	now := time.Now()
+	assert.Equal(t, []time.Time{now.Add(5 * time.Second), now.Add(time.Minute)}, scheduleReports(reports, now))
+
+	// Top-level target and payload make the default report.
+	reports = Config{Target: []string{"http://localhost"}}.EffectiveReports()
+	assert.Equal(t, []ReportConfig{{Name: "default", Target: []string{"http://localhost"}}}, reports)
 }
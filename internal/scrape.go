@@ -0,0 +1,369 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ScrapeFormatJson       = "json"
+	ScrapeFormatPrometheus = "prometheus"
+)
+
+// Default timeout for HTTP gatherers which don't specify their own.
+const defaultScrapeTimeout = 5 * time.Second
+
+// Responses larger than this are truncated before being parsed.
+const maxScrapeResponseSize = 10 << 20
+
+// Fetches data from gatherer's URL and parses the response into variables.
+// This is the HTTP counterpart of executeGatherer().
+func scrapeGatherer(
+	ctx context.Context,
+	wg *sync.WaitGroup,
+	channel chan<- *OrderedGathererResult,
+	index int,
+	gatherer GathererConfig,
+) {
+	defer (*wg).Done()
+
+	gathererLog.Info("Scraping gatherer:", gatherer.Url)
+	start := time.Now()
+	data, err := scrape(ctx, gatherer)
+
+	// HTTP gatherers have no real exit code, but we mimic it for consistency
+	// with executable gatherers.
+	exitCode := 0
+	if err != nil {
+		exitCode = -1
+	}
+
+	channel <- &OrderedGathererResult{
+		index:     index,
+		gatherer:  gatherer,
+		exitError: err,
+		exitCode:  exitCode,
+		duration:  time.Since(start),
+		data:      data,
+	}
+}
+
+func scrape(ctx context.Context, gatherer GathererConfig) (StringMap, error) {
+	timeout := time.Duration(gatherer.Timeout)
+	if timeout == 0 {
+		timeout = defaultScrapeTimeout
+	}
+
+	request, err := http.NewRequestWithContext(ctx, "GET", gatherer.Url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Timeout: timeout}
+	response, err := client.Do(request)
+	if err != nil {
+		if isTimeoutError(err) {
+			return nil, fmt.Errorf("timeout of %s exceeded", timeout)
+		}
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return nil, fmt.Errorf("unexpected response status [%s]", response.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(response.Body, maxScrapeResponseSize))
+	if err != nil {
+		return nil, err
+	}
+
+	if gatherer.Format == ScrapeFormatPrometheus {
+		return parsePrometheusValues(body, gatherer.Extract)
+	}
+
+	return parseJsonValues(body, gatherer.Extract)
+}
+
+// Parses JSON document and returns its values as variables.
+//
+// Without any "extract" specified all scalar values of the document are
+// returned under their flattened paths (e.g. "status.db.latency" or
+// "items.0.name"). With "extract" specified (as [variable name: JSON path]) only
+// the requested values are returned. If the JSON path points to an object or
+// an array, all of its values are returned with the variable name as prefix.
+func parseJsonValues(body []byte, extract StringMap) (StringMap, error) {
+	var document interface{}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&document); err != nil {
+		return nil, fmt.Errorf("cannot parse JSON response: %s", err.Error())
+	}
+
+	result := make(StringMap)
+	if len(extract) == 0 {
+		flattenJsonValue(result, "", document)
+		return result, nil
+	}
+
+	for name, path := range extract {
+		value, found := lookupJsonPath(document, path)
+		if !found {
+			gathererLog.Debugf("JSON path '%s' not found in response", path)
+			continue
+		}
+		flattenJsonValue(result, name, value)
+	}
+
+	return result, nil
+}
+
+// Finds value in JSON document by its path. Path segments are separated by
+// dots and array items can be accessed either via "items.0" or "items[0]".
+// Optional leading "$." is ignored.
+func lookupJsonPath(document interface{}, path string) (interface{}, bool) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	path = strings.ReplaceAll(strings.ReplaceAll(path, "[", "."), "]", "")
+	if path == "" {
+		return document, true
+	}
+
+	current := document
+	for _, segment := range strings.Split(path, ".") {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			value, ok := node[segment]
+			if !ok {
+				return nil, false
+			}
+			current = value
+		case []interface{}:
+			i, err := strconv.Atoi(segment)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			current = node[i]
+		default:
+			return nil, false
+		}
+	}
+
+	return current, true
+}
+
+// Puts all scalar values found in the JSON value into the result map under
+// keys prefixed with the specified prefix.
+func flattenJsonValue(result StringMap, prefix string, value interface{}) {
+	join := func(key string) string {
+		if prefix == "" {
+			return key
+		}
+		return prefix + "." + key
+	}
+
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for k, v := range value {
+			flattenJsonValue(result, join(k), v)
+		}
+	case []interface{}:
+		for i, v := range value {
+			flattenJsonValue(result, join(strconv.Itoa(i)), v)
+		}
+	case nil:
+		result[prefix] = ""
+	case string:
+		result[prefix] = value
+	default:
+		// Numbers (json.Number) and booleans.
+		result[prefix] = fmt.Sprint(value)
+	}
+}
+
+// A single sample parsed from Prometheus text exposition format.
+type prometheusSample struct {
+	name   string
+	labels StringMap
+	value  string
+}
+
+// Parses Prometheus text exposition format and returns its values as
+// variables.
+//
+// Without any "extract" specified only samples without labels are returned,
+// under their metric names. With "extract" specified (as [variable name:
+// selector]) only the requested samples are returned. Selector is either
+// a plain metric name or a metric name with labels to match, e.g.
+// 'node_filesystem_avail_bytes{mountpoint="/"}'. If there are multiple samples
+// matching the selector, the first one is used.
+func parsePrometheusValues(body []byte, extract StringMap) (StringMap, error) {
+	samples, err := parsePrometheusSamples(body)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(StringMap)
+	if len(extract) == 0 {
+		for _, sample := range samples {
+			if len(sample.labels) == 0 {
+				result[sample.name] = sample.value
+			}
+		}
+		return result, nil
+	}
+
+	for name, selector := range extract {
+		wanted, err := parsePrometheusSample(selector + " 0")
+		if err != nil {
+			return nil, fmt.Errorf("invalid metric selector '%s'", selector)
+		}
+
+		for _, sample := range samples {
+			if sample.matches(wanted) {
+				result[name] = sample.value
+				break
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// Returns true if the sample has the same name as the other sample and has
+// all of the other sample's labels.
+func (s prometheusSample) matches(other prometheusSample) bool {
+	if s.name != other.name {
+		return false
+	}
+
+	for k, v := range other.labels {
+		if s.labels[k] != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+func parsePrometheusSamples(body []byte) ([]prometheusSample, error) {
+	var samples []prometheusSample
+
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 0, 64*1024), maxScrapeResponseSize)
+
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+
+		// Skip empty lines and comments (including HELP and TYPE lines).
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		sample, err := parsePrometheusSample(line)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse metrics on line %d: %s", lineNo, err.Error())
+		}
+
+		samples = append(samples, sample)
+	}
+
+	return samples, scanner.Err()
+}
+
+// Parses a single sample line in format 'name{label="value",...} value [timestamp]'.
+func parsePrometheusSample(line string) (prometheusSample, error) {
+	sample := prometheusSample{labels: make(StringMap)}
+
+	nameEnd := strings.IndexAny(line, "{ \t")
+	if nameEnd <= 0 {
+		return sample, fmt.Errorf("invalid sample '%s'", line)
+	}
+	sample.name = line[:nameEnd]
+	rest := line[nameEnd:]
+
+	if strings.HasPrefix(rest, "{") {
+		var err error
+		rest, err = parsePrometheusLabels(rest[1:], sample.labels)
+		if err != nil {
+			return sample, err
+		}
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) < 1 || len(fields) > 2 {
+		return sample, fmt.Errorf("invalid sample '%s'", line)
+	}
+
+	sample.value = normalizePrometheusValue(fields[0])
+	return sample, nil
+}
+
+// Parses labels (the opening brace already consumed) into the provided map
+// and returns the rest of the line after the closing brace.
+func parsePrometheusLabels(str string, labels StringMap) (string, error) {
+	for {
+		str = strings.TrimLeft(str, " \t,")
+		if strings.HasPrefix(str, "}") {
+			return str[1:], nil
+		}
+
+		eq := strings.Index(str, "=")
+		if eq <= 0 || len(str) < eq+2 || str[eq+1] != '"' {
+			return "", fmt.Errorf("invalid labels '%s'", str)
+		}
+		name := strings.TrimSpace(str[:eq])
+		str = str[eq+2:]
+
+		// Read the quoted label value with escape sequences.
+		var value strings.Builder
+		closed := false
+		for i := 0; i < len(str); i++ {
+			c := str[i]
+			if c == '\\' && i+1 < len(str) {
+				i++
+				switch str[i] {
+				case 'n':
+					value.WriteByte('\n')
+				default:
+					value.WriteByte(str[i])
+				}
+				continue
+			}
+			if c == '"' {
+				str = str[i+1:]
+				closed = true
+				break
+			}
+			value.WriteByte(c)
+		}
+
+		if !closed {
+			return "", fmt.Errorf("unterminated label value for '%s'", name)
+		}
+		labels[name] = value.String()
+	}
+}
+
+// Converts value from exposition format (e.g. "1.5e+06") into plain decimal
+// notation usable in expressions. Special values like "NaN" are kept as-is.
+func normalizePrometheusValue(value string) string {
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return value
+	}
+
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
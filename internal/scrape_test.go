@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testJsonResponse = `{
+	"status": "ok",
+	"db": {"connected": true, "latency": 1.25},
+	"queues": [{"name": "mail", "size": 10}, {"name": "jobs", "size": 3}]
+}`
+
+const testPrometheusResponse = `# HELP node_load1 1m load average.
+# TYPE node_load1 gauge
+node_load1 0.42
+node_memory_MemFree_bytes 1.5e+09
+node_filesystem_avail_bytes{device="/dev/sda1",mountpoint="/"} 1234
+node_filesystem_avail_bytes{device="/dev/sdb1",mountpoint="/data"} 5678 1700000000000
+`
+
+func testServer(body string, status int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+}
+
+func TestScrapeJsonAll(t *testing.T) {
+	server := testServer(testJsonResponse, 200)
+	defer server.Close()
+
+	data, err := scrape(context.Background(), GathererConfig{Url: server.URL})
+	assert.NoError(t, err)
+
+	assert.Equal(t, "ok", data["status"])
+	assert.Equal(t, "true", data["db.connected"])
+	assert.Equal(t, "1.25", data["db.latency"])
+	assert.Equal(t, "jobs", data["queues.1.name"])
+	assert.Equal(t, "10", data["queues.0.size"])
+}
+
+func TestScrapeJsonExtract(t *testing.T) {
+	server := testServer(testJsonResponse, 200)
+	defer server.Close()
+
+	data, err := scrape(context.Background(), GathererConfig{
+		Url:    server.URL,
+		Format: ScrapeFormatJson,
+		Extract: StringMap{
+			"app.latency":   "db.latency",
+			"app.mail_size": "$.queues[0].size",
+			"app.db":        "db",
+			"app.missing":   "db.nope",
+		},
+	})
+	assert.NoError(t, err)
+
+	assert.Len(t, data, 4)
+	assert.Equal(t, "1.25", data["app.latency"])
+	assert.Equal(t, "10", data["app.mail_size"])
+	assert.Equal(t, "true", data["app.db.connected"])
+	assert.Equal(t, "1.25", data["app.db.latency"])
+}
+
+func TestScrapePrometheus(t *testing.T) {
+	server := testServer(testPrometheusResponse, 200)
+	defer server.Close()
+
+	data, err := scrape(context.Background(), GathererConfig{Url: server.URL, Format: ScrapeFormatPrometheus})
+	assert.NoError(t, err)
+	assert.Equal(t, StringMap{
+		"node_load1":                "0.42",
+		"node_memory_MemFree_bytes": "1500000000",
+	}, data)
+
+	data, err = scrape(context.Background(), GathererConfig{
+		Url:    server.URL,
+		Format: ScrapeFormatPrometheus,
+		Extract: StringMap{
+			"load":      "node_load1",
+			"root_free": `node_filesystem_avail_bytes{mountpoint="/"}`,
+			"data_free": `node_filesystem_avail_bytes{mountpoint="/data"}`,
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, StringMap{
+		"load":      "0.42",
+		"root_free": "1234",
+		"data_free": "5678",
+	}, data)
+}
+
+func TestScrapeErrors(t *testing.T) {
+	server := testServer("{}", 503)
+	defer server.Close()
+
+	_, err := scrape(context.Background(), GathererConfig{Url: server.URL})
+	assert.ErrorContains(t, err, "unexpected response status [503 Service Unavailable]")
+
+	invalid := testServer("{not json", 200)
+	defer invalid.Close()
+
+	_, err = scrape(context.Background(), GathererConfig{Url: invalid.URL})
+	assert.ErrorContains(t, err, "cannot parse JSON response")
+
+	_, err = parsePrometheusValues([]byte("metric{label=\"x} 1\n"), nil)
+	assert.ErrorContains(t, err, "cannot parse metrics on line 1")
+}
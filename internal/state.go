@@ -0,0 +1,210 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/shopspring/decimal"
+)
+
+// Reserved variables giving stateful expression functions ("prev()",
+// "delta()" and "rate()") access to values from previous cycles:
+//   - "$prev.<name>" - the variable's value in the last cycle it was gathered,
+//   - "$prev_at.<name>" - Unix time (in seconds) of that cycle,
+//   - "$now" - Unix time (in seconds) of the current cycle.
+const (
+	prevVarPrefix  = "$prev."
+	prevTimePrefix = "$prev_at."
+	cycleTimeVar   = "$now"
+)
+
+// Number of cycles of the least frequent report after which values of
+// variables which were not gathered since are forgotten.
+const previousValueMaxCycles = 10
+
+// Value of a variable in the last cycle it was gathered in.
+type previousValue struct {
+	Value string    `json:"value"`
+	At    time.Time `json:"at"`
+}
+
+// Adds values of variables from previous cycles and time of the current cycle
+// into the variables. Previous values are loaded from the state file first,
+// if there's one.
+func (r *Reporter) addPreviousVariables(vars EvalVariables, now time.Time) {
+	if r.previous == nil {
+		r.previous = r.loadState()
+	}
+
+	for name, previous := range r.previous {
+		vars[prevVarPrefix+name] = previous.Value
+		vars[prevTimePrefix+name] = unixSeconds(previous.At)
+	}
+	vars[cycleTimeVar] = unixSeconds(now)
+}
+
+// Remembers values of the variables of the finished cycle (except the
+// reserved ones) and saves them into the state file, if there's one. Values
+// of variables which were not gathered for a while (e.g. because their
+// gatherer was removed from config) are forgotten.
+func (r *Reporter) recordPreviousVariables(vars EvalVariables, at time.Time) {
+	if r.previous == nil {
+		r.previous = make(map[string]previousValue)
+	}
+
+	for name, value := range vars {
+		if !isReservedVariable(name) {
+			r.previous[name] = previousValue{Value: value, At: at}
+		}
+	}
+
+	expired := at.Add(-previousValueMaxCycles * r.ConfigJson.longestInterval())
+	for name, previous := range r.previous {
+		if previous.At.Before(expired) {
+			delete(r.previous, name)
+		}
+	}
+
+	r.saveState()
+}
+
+// Returns previous values from the state file, or an empty map if there are
+// none.
+func (r *Reporter) loadState() map[string]previousValue {
+	previous := make(map[string]previousValue)
+
+	path := r.ConfigJson.StateFile
+	if path == "" {
+		return previous
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return previous
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &previous)
+	}
+	if err != nil {
+		log.Errorf("Cannot read state file '%s': %s", path, err.Error())
+		return make(map[string]previousValue)
+	}
+
+	log.Debugf("Loaded %d previous value(s) from state file: %s", len(previous), path)
+	return previous
+}
+
+func (r *Reporter) saveState() {
+	path := r.ConfigJson.StateFile
+	if path == "" {
+		return
+	}
+
+	data, err := json.Marshal(r.previous)
+	if err != nil {
+		log.Errorf("Cannot save state file '%s': %s", path, err.Error())
+		return
+	}
+
+	// Write a temporary file first, so that the state file is never left
+	// half-written.
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	err = os.WriteFile(tmp, data, 0600)
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		log.Errorf("Cannot save state file '%s': %s", path, err.Error())
+	}
+}
+
+// Returns the longest time between two cycles running any of the reports.
+func (c Config) longestInterval() time.Duration {
+	var longest time.Duration
+	for _, report := range c.EffectiveReports() {
+		if interval := report.RunInterval(); interval > longest {
+			longest = interval
+		}
+	}
+
+	return longest
+}
+
+// Returns copy of the variables without the reserved ones.
+func withoutReservedVariables(vars EvalVariables) EvalVariables {
+	result := make(EvalVariables, len(vars))
+	for name, value := range vars {
+		if !isReservedVariable(name) {
+			result[name] = value
+		}
+	}
+
+	return result
+}
+
+func isReservedVariable(name string) bool {
+	return strings.HasPrefix(name, "$")
+}
+
+func unixSeconds(t time.Time) string {
+	return decimal.New(t.UnixMilli(), -3).String()
+}
+
+// Returns increase of the counter variable since the previous cycle together
+// with seconds elapsed since then. A counter lower than in the previous cycle
+// is considered to be reset (e.g. after reboot), so its current value is the
+// increase.
+func counterDelta(name string, vars EvalVariables) (decimal.Decimal, decimal.Decimal, error) {
+	current, err := variableNumber(name, vars)
+	if err != nil {
+		return decimal.Decimal{}, decimal.Decimal{}, err
+	}
+	previous, err := previousNumber(name, prevVarPrefix, vars)
+	if err != nil {
+		return decimal.Decimal{}, decimal.Decimal{}, err
+	}
+	previousAt, err := previousNumber(name, prevTimePrefix, vars)
+	if err != nil {
+		return decimal.Decimal{}, decimal.Decimal{}, err
+	}
+	now, err := variableNumber(cycleTimeVar, vars)
+	if err != nil {
+		return decimal.Decimal{}, decimal.Decimal{}, err
+	}
+
+	delta := current.Sub(previous)
+	if delta.IsNegative() {
+		delta = current
+	}
+
+	return delta, now.Sub(previousAt), nil
+}
+
+func variableNumber(name string, vars EvalVariables) (decimal.Decimal, error) {
+	value, ok := vars[name]
+	if !ok {
+		return decimal.Decimal{}, fmt.Errorf("undefined variable '%s'", name)
+	}
+
+	result, err := decimal.NewFromString(value)
+	if err != nil {
+		return decimal.Decimal{}, fmt.Errorf("cannot convert '%s' to float", value)
+	}
+
+	return result, nil
+}
+
+func previousNumber(name string, prefix string, vars EvalVariables) (decimal.Decimal, error) {
+	if _, ok := vars[prefix+name]; !ok {
+		return decimal.Decimal{}, fmt.Errorf("no previous value of variable '%s'", name)
+	}
+
+	return variableNumber(prefix+name, vars)
+}
@@ -0,0 +1,163 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatefulFunctions(t *testing.T) {
+	vars := EvalVariables{
+		"rx":              "1500",
+		"$prev.rx":        "1000",
+		"$prev_at.rx":     "100.5",
+		"reset":           "200",
+		"$prev.reset":     "5000",
+		"$prev_at.reset":  "100.5",
+		"name":            "box",
+		"$prev.name":      "old-box",
+		"$prev_at.name":   "100.5",
+		"$now":            "110.5",
+		"same":            "1",
+		"$prev.same":      "1",
+		"$prev_at.same":   "110.5",
+		"missing_prev.at": "1",
+	}
+
+	testEvalExpr(t, vars, "prev(rx)", "1000")
+	testEvalExpr(t, vars, "prev(name)", "old-box")
+	testEvalExpr(t, vars, "delta(rx)", "500")
+	testEvalExpr(t, vars, "rate(rx)", "50")
+	testEvalExpr(t, vars, "rate(rx) * 8 / 1000", "0.4")
+	// Counter which is lower than before was reset.
+	testEvalExpr(t, vars, "delta(reset)", "200")
+	testEvalExpr(t, vars, "rate(reset)", "20")
+	testEvalExpr(t, vars, "defined($prev.rx)", "1")
+
+	_, err := evalExpression("prev(tx)", vars)
+	assert.EqualError(t, err, "no previous value of variable 'tx'")
+	_, err = evalExpression("delta(tx)", vars)
+	assert.EqualError(t, err, "undefined variable 'tx'")
+	_, err = evalExpression("delta(missing_prev.at)", vars)
+	assert.EqualError(t, err, "no previous value of variable 'missing_prev.at'")
+	_, err = evalExpression("rate(name)", vars)
+	assert.EqualError(t, err, "cannot convert 'box' to float")
+	_, err = evalExpression("rate(same)", vars)
+	assert.EqualError(t, err, "no time elapsed since previous value of variable 'same'")
+	_, err = parseExpression("rate(rx * 2)")
+	assert.EqualError(t, err, "cannot parse expression 'rate(rx * 2)': function 'rate' at position 1 expects a variable name")
+
+	// The counter itself is needed.
+	assert.Equal(t, []string{"rx"}, exprVariables(mustParseExpression(t, "rate(rx)")))
+}
+
+func TestPreviousCycleValues(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	counter := filepath.Join(t.TempDir(), "counter")
+	os.WriteFile(counter, []byte("100"), 0644)
+	gatherer := writeTestGatherer(t, "counter.sh", "echo rx=$(cat "+counter+")\n")
+
+	dir := writeConfigFiles(t, map[string]string{
+		"config.json": `{
+			"target": ["` + server.URL + `"],
+			"gatherers": ["` + gatherer + `"],
+			"vars": {"rx_delta": "delta(rx)"},
+			"state_file": "state.json",
+			"payload": {"delta": "${rx_delta}", "prev": "${prev(rx)}"},
+		}`,
+	})
+	config, err := ReadConfig(filepath.Join(dir, "config.json"))
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "state.json"), config.StateFile)
+
+	reporter := &Reporter{ConfigJson: config, HttpClient: &http.Client{}}
+	summary, err := reporter.Single(context.Background())
+	assert.NoError(t, err)
+	// There's no previous value in the first cycle.
+	assert.Equal(t, "${rx_delta}", summary.Payload["delta"])
+	assert.NotContains(t, summary.Variables, "rx_delta")
+	assert.NotContains(t, summary.Variables, cycleTimeVar)
+
+	os.WriteFile(counter, []byte("250"), 0644)
+	summary, _ = reporter.Single(context.Background())
+	assert.Equal(t, "150", summary.Payload["delta"])
+	assert.Equal(t, "100", summary.Payload["prev"])
+	assert.Equal(t, "150", summary.Variables["rx_delta"])
+
+	// Previous values survive a restart thanks to the state file.
+	os.WriteFile(counter, []byte("50"), 0644)
+	restarted := &Reporter{ConfigJson: config, HttpClient: &http.Client{}}
+	summary, _ = restarted.Single(context.Background())
+	assert.Equal(t, "50", summary.Payload["delta"])
+	assert.Equal(t, "250", summary.Payload["prev"])
+
+	previous := restarted.loadState()
+	assert.Equal(t, "50", previous["rx"].Value)
+	assert.WithinDuration(t, time.Now(), previous["rx"].At, time.Minute)
+	assert.NotContains(t, previous, "$now")
+
+	// Broken state file is ignored.
+	os.WriteFile(config.StateFile, []byte("{"), 0600)
+	assert.Empty(t, restarted.loadState())
+}
+
+func TestReservedVariablesHidden(t *testing.T) {
+	config, err := buildConfigFromJson([]byte(`{
+	"payload": {
+		"counters": [{"$each": "*.rx", "name": "${$1}"}],
+		"any": [{"$each": "*.*", "name": "${$key}"}],
+		"gpu": "${exists(gpu)}",
+		"prev": "${exists($prev.gpu)}",
+	},
+}`), "/opt/reporter")
+	assert.NoError(t, err)
+
+	vars := EvalVariables{
+		"eth0.rx":           "1",
+		"$prev.rx":          "1",
+		"$prev.load":        "1",
+		"$prev.gpu.temp":    "50",
+		"$prev_at.gpu.temp": "100",
+		"$avg.eth0.rx":      "1",
+		cycleTimeVar:        "110",
+	}
+	payload, errs := buildPayload(config.Payload, vars, config.templates)
+	assert.Empty(t, errs)
+	assert.Equal(t, PayloadType{
+		"counters": []interface{}{StringKeyMap{"name": "eth0"}},
+		"any":      []interface{}{StringKeyMap{"name": "eth0.rx"}},
+		"gpu":      "0",
+		"prev":     "1",
+	}, payload)
+}
+
+func TestPreviousValuesExpire(t *testing.T) {
+	config, err := buildConfigFromJson([]byte(`{
+	"reports": [
+		{"name": "often", "interval": "10s"},
+		{"name": "rarely", "interval": "1m"},
+	],
+}`), "/opt/reporter")
+	assert.NoError(t, err)
+
+	now := time.Now()
+	reporter := &Reporter{ConfigJson: config}
+	reporter.recordPreviousVariables(EvalVariables{"removed": "1", "hourly": "2"}, now.Add(-11*time.Minute))
+	reporter.recordPreviousVariables(EvalVariables{"hourly": "3"}, now.Add(-9*time.Minute))
+	reporter.recordPreviousVariables(EvalVariables{"load": "4"}, now)
+
+	// Values not gathered in the last 10 cycles of the least frequent report
+	// are forgotten.
+	assert.Equal(t, map[string]previousValue{
+		"hourly": {Value: "3", At: now.Add(-9 * time.Minute)},
+		"load":   {Value: "4", At: now},
+	}, reporter.previous)
+}
@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Returns true if the reporter was started by systemd as a service with
+// Type=notify (i.e. systemd expects notifications from us).
+func IsSystemdNotifyAvailable() bool {
+	return os.Getenv("NOTIFY_SOCKET") != ""
+}
+
+// Sends notification to systemd via socket specified by NOTIFY_SOCKET env
+// variable. Does nothing if the variable is not set.
+// See https://www.freedesktop.org/software/systemd/man/sd_notify.html
+func sdNotify(state string) error {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		return nil
+	}
+
+	// Abstract namespace socket.
+	if strings.HasPrefix(socketPath, "@") {
+		socketPath = "\x00" + socketPath[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// Returns interval in which systemd expects watchdog pings from us or zero if
+// the watchdog is not enabled (or is meant for another process).
+func systemdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	return time.Duration(usec) * time.Microsecond
+}
+
+// Tells systemd the reporter is ready.
+func (r *Reporter) notifySystemdReady() {
+	interval := r.ConfigJson.RunInterval()
+	if watchdog := systemdWatchdogInterval(); watchdog != 0 && watchdog <= interval {
+		log.Warnf(
+			"Systemd watchdog interval (%s) is not longer than cycle interval (%s), the service will be killed",
+			watchdog, interval,
+		)
+	}
+
+	if err := sdNotify("READY=1"); err != nil {
+		log.Errorf("Cannot notify systemd: %s", err.Error())
+	}
+}
+
+// Tells systemd the current status and pings the watchdog. This is supposed to
+// be called only when the reporter is known to be working (i.e. a cycle was
+// actually finished or skipped on purpose).
+func (r *Reporter) notifySystemdStatus(status string) {
+	state := "STATUS=" + status
+	if systemdWatchdogInterval() != 0 {
+		state += "\nWATCHDOG=1"
+	}
+
+	if err := sdNotify(state); err != nil {
+		log.Errorf("Cannot notify systemd: %s", err.Error())
+	}
+}
+
+// Returns a single-line description of cycle's outcome.
+func formatCycleStatus(summary *CycleSummary) string {
+	delivered := 0
+	for _, d := range summary.Deliveries {
+		if d.Succeeded() {
+			delivered++
+		}
+	}
+
+	status := fmt.Sprintf(
+		"Cycle #%d at %s: %d failed gatherer(s), %d expression error(s), %d/%d deliveries OK",
+		summary.Cycle,
+		summary.StartedAt.Format(time.RFC3339),
+		len(summary.FailedGatherers),
+		summary.ExpressionErrors,
+		delivered,
+		len(summary.Deliveries),
+	)
+
+	return status
+}
@@ -0,0 +1,83 @@
+package internal
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Creates a fake systemd notify socket and returns a function which reads
+// a single notification from it.
+func fakeNotifySocket(t *testing.T) func() string {
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	assert.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", path)
+
+	return func() string {
+		buffer := make([]byte, 4096)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(buffer)
+		assert.NoError(t, err)
+		return string(buffer[:n])
+	}
+}
+
+func TestSdNotify(t *testing.T) {
+	read := fakeNotifySocket(t)
+	assert.True(t, IsSystemdNotifyAvailable())
+
+	reporter := &Reporter{}
+	reporter.notifySystemdReady()
+	assert.Equal(t, "READY=1", read())
+
+	summary := &CycleSummary{
+		Cycle:            2,
+		StartedAt:        time.Date(2023, 6, 15, 10, 0, 0, 0, time.UTC),
+		FailedGatherers:  []string{"some_script"},
+		ExpressionErrors: 1,
+		Deliveries: []DeliveryResult{
+			{Target: "https://a", StatusCode: 200},
+			{Target: "https://b", Error: "timeout"},
+		},
+	}
+
+	// Without watchdog enabled only the status is sent.
+	reporter.notifySystemdStatus(formatCycleStatus(summary))
+	assert.Equal(
+		t,
+		"STATUS=Cycle #2 at 2023-06-15T10:00:00Z: 1 failed gatherer(s), 1 expression error(s), 1/2 deliveries OK",
+		read(),
+	)
+
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	reporter.notifySystemdStatus("Paused")
+	assert.Equal(t, "STATUS=Paused\nWATCHDOG=1", read())
+}
+
+func TestSystemdWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "")
+	assert.Equal(t, time.Duration(0), systemdWatchdogInterval())
+
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	assert.Equal(t, 30*time.Second, systemdWatchdogInterval())
+
+	// Watchdog meant for another process.
+	t.Setenv("WATCHDOG_PID", "1")
+	assert.Equal(t, time.Duration(0), systemdWatchdogInterval())
+
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	assert.Equal(t, 30*time.Second, systemdWatchdogInterval())
+}
+
+func TestSdNotifyWithoutSocket(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	assert.False(t, IsSystemdNotifyAvailable())
+	assert.NoError(t, sdNotify("READY=1"))
+}
@@ -1,6 +1,14 @@
 package internal
 
-import "net/http"
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
 
 // [string key: any value] map type.
 type StringKeyMap = map[string]interface{}
@@ -15,38 +23,307 @@ type PayloadType = StringKeyMap
 // Type for a container of variables for expression evaluator.
 type EvalVariables = StringMap
 
-// Function type for passing callback into binaryOpEval() function.
-type binaryOpEvalCallback = func(string, string, string) (string, error)
+// Struct representing config read from config file (JSON, YAML or TOML).
+type Config struct {
+	Target   []string
+	Interval Duration // Time between two cycles (10 seconds by default).
+	// Time between sending reports, if longer than interval. Variables are
+	// sampled every cycle and aggregated (e.g. by "avg()") when a report is
+	// sent. Reports are sent every cycle if zero.
+	SendInterval Duration `json:"send_interval"`
+	Gatherers    []GathererConfig
+	Env          map[string]string
+	// [name: expression] of variables derived from gatherer variables (and
+	// each other), available in payload templates.
+	Vars    StringMap
+	Payload PayloadType
+	// Reports sent separately, each with its own targets and payload. If
+	// there are none, "target" and "payload" make a single report.
+	Reports  []ReportConfig
+	Builtins BuiltinsConfig
+	HostId   HostIdConfig `json:"host_id"`
+	Metrics  MetricsConfig
+	Control  ControlConfig
+	Logging  LoggingConfig
+	// Path to file keeping values of variables from the previous cycle (used
+	// by "prev()", "delta()" and "rate()") across restarts, relative to the
+	// config file. The values are kept only in memory if empty.
+	StateFile string `json:"state_file"`
+	// Paths of secret config values (e.g. "env.API_TOKEN") and payload
+	// fields (e.g. "payload.auth.token") which are redacted in logs and
+	// verbose output.
+	Secrets []string
 
-// Struct representing global Reporter's runtime settings and stuff.
-type ReporterSettings struct {
-	SelfDir        string // Directory path where the compiled reporter binary is.
-	ConfigJsonPath string // Populated via CLI argument "--config", if set.
-	JustTry        bool   // Populated via CLI argument "--try", if set.
-	VerboseMode    bool   // Populated via CLI argument "--verbose", if set.
-	DaemonMode     bool   // True by default, false if "--try"
-	ForegroundMode bool   // False by default, true if "--foreground"
-	LogLevel       string // Populated via CLI argument "--log-level", if set.
+	path string // Absolute path of the file the config was loaded from.
+	// Overrides applied on top of the file (kept for reloading the config).
+	overrides []ConfigOverride
+	// Redacts secret values, including values of secret payload fields
+	// added once they're known.
+	redactor *Redactor
+	// Payload template strings compiled at load [template: compiled].
+	templates map[string]*compiledTemplate
+	// Derived variables in order of their evaluation.
+	derived []derivedVariable
+	// Names of variables sampled for aggregate functions (e.g. "avg()").
+	aggregated []string
 }
 
-// Struct representing config read from config.json file.
-type Config struct {
-	Target    []string
+// Struct representing config of a single report, i.e. payload sent to some
+// targets periodically.
+type ReportConfig struct {
+	Name     string
+	Target   []string
+	Interval Duration // Defaults to interval of the whole config.
+	// Defaults to send interval of the whole config.
+	SendInterval Duration `json:"send_interval"`
+	// Names of gatherers providing variables for the payload (all gatherers
+	// if empty). Gatherers needed by more reports are run only once a cycle.
 	Gatherers []string
-	Env       map[string]string
 	Payload   PayloadType
+
+	path string // Path of the report in config, empty for the implicit one.
+}
+
+// Expression found in payload template together with variables it needs.
+type PayloadExpression struct {
+	Path       string   // Path of the template value, e.g. "payload.fields[0].value".
+	Expression string   // Source of the expression without "${" and "}".
+	Variables  []string // Sorted names of variables the expression needs.
+}
+
+// Struct representing config of built-in variables provided by the reporter.
+type BuiltinsConfig struct {
+	// [name: Go time layout] of additional "time.<name>" variables.
+	TimeFormats StringMap `json:"time_formats"`
+	// Use UTC instead of local time for "time.*" variables.
+	Utc bool
+	// Allow gatherers to overwrite built-in variables.
+	AllowOverride bool `json:"allow_override"`
+}
+
+// Struct representing config of the endpoint serving metrics about the reporter
+// itself.
+type MetricsConfig struct {
+	// Address to listen on (e.g. "127.0.0.1:9464"). Disabled if empty.
+	Listen string
+}
+
+// Struct representing config of logging.
+type LoggingConfig struct {
+	// Path to log file (relative to the config file) or one of "stderr",
+	// "stdout" or "syslog". Defaults to "reporter.log" next to the reporter
+	// binary.
+	Path string
+	// Log format: "text" (default) or "json".
+	Format string
+	// Log level: "debug", "info", "warning" (default) or "error".
+	Level string
+	// Log rotation settings (used only when logging into a file).
+	MaxSizeMb  int `json:"max_size_mb"`
+	MaxBackups int `json:"max_backups"`
+	MaxAgeDays int `json:"max_age_days"`
+	Compress   bool
+	// [subsystem: log level] for subsystems "gatherers", "expressions" and
+	// "delivery" which should use a different log level.
+	Levels StringMap
+}
+
+// Struct representing config of the local control socket.
+type ControlConfig struct {
+	// Path to the Unix domain socket (".reporter.sock" next to the reporter
+	// binary by default).
+	Socket string
+	// Permissions of the socket file as an octal string ("0600" by default).
+	Mode string
+}
+
+// Struct representing config of the stable host identifier.
+type HostIdConfig struct {
+	// If not empty, the host ID is hashed (SHA-256) together with this salt.
+	Salt string
+	// If not empty, the host ID is sent in request header of this name.
+	Header string
+}
+
+// Struct representing a single gatherer specified in config. A gatherer can be
+// specified either as a plain string (path to an executable gatherer) or as an
+// object (e.g. for HTTP gatherers scraping some local endpoint).
+type GathererConfig struct {
+	Name    string    // Name of the gatherer (derived from path/URL if empty).
+	Path    string    // Path to executable gatherer.
+	Url     string    // URL to be scraped by HTTP gatherer.
+	Format  string    // Format of HTTP response: "json" or "prometheus".
+	Timeout Duration  // Timeout for HTTP request.
+	Extract StringMap // [variable name: JSON path or metric selector]
+
+	// What to do with output of a failed run: "discard", "keep" or
+	// "keep-with-warning".
+	OnFailure string `json:"on_failure"`
+	// For how long the last successful result is used in place of results of
+	// failed runs.
+	FallbackGrace Duration `json:"fallback_grace"`
+}
+
+func (g *GathererConfig) UnmarshalJSON(data []byte) error {
+	// Plain string is a path to executable gatherer.
+	var path string
+	if err := json.Unmarshal(data, &path); err == nil {
+		g.Path = path
+		return nil
+	}
+
+	// Use type alias without the UnmarshalJSON method to avoid recursion.
+	type plainGathererConfig GathererConfig
+	return json.Unmarshal(data, (*plainGathererConfig)(g))
+}
+
+// Returns a human-readable identification of the gatherer (for logs).
+func (g GathererConfig) String() string {
+	if g.Url != "" {
+		return g.Url
+	}
+
+	return g.Path
+}
+
+// Duration which can be specified in config either as a string parsable by
+// time.ParseDuration() (e.g. "2s" or "1m30s") or as a number of seconds.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+
+	switch value := value.(type) {
+	case float64:
+		*d = Duration(value * float64(time.Second))
+	case string:
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*d = Duration(parsed)
+	default:
+		return fmt.Errorf("invalid duration '%s'", data)
+	}
+
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
 }
 
 type Reporter struct {
 	ConfigJson Config
 	HttpClient *http.Client
+
+	// Directory of reporter's own files, i.e. the host ID override file and
+	// the default control socket. These are not used if empty.
+	StateDir string
+	// If not nil, payloads are printed into it before being sent.
+	VerboseOutput io.Writer
+	// Notify systemd about readiness and status of the reporter.
+	Systemd bool
+	// Configures logging according to the config when it's reloaded. Logging
+	// is kept as it is if nil.
+	SetupLogging func(config Config) error
+
+	// [gatherer name: last successful result]
+	lastSuccess map[string]gathererSnapshot
+	// [variable name: value from the last cycle it was gathered in]
+	previous map[string]previousValue
+	// [report name: samples of variables since the report was sent last time]
+	windows   map[string]*sampleWindow
+	startedAt time.Time // When the first cycle started.
+	hostId    string    // Lazily resolved stable host identifier.
+	metrics   *Metrics  // Metrics about the reporter itself.
+	cycle     int       // Number of the current cycle (starting from 1).
+
+	// State shared with the control socket server.
+	mu        sync.Mutex
+	paused    bool
+	lastCycle *CycleSummary
+	// [report name: payload] of the last cycle sending the report.
+	lastPayloads map[string]PayloadType
+	nextRunAt    time.Time
+	runNow       chan struct{}
+	reload       chan Config
+}
+
+// Summary of a single gather-and-send cycle.
+type CycleSummary struct {
+	Cycle            int              `json:"cycle"`
+	StartedAt        time.Time        `json:"started_at"`
+	DurationMs       int64            `json:"duration_ms"`
+	FailedGatherers  []string         `json:"failed_gatherers"`
+	ExpressionErrors int              `json:"expression_errors"` // Of all reports.
+	Variables        EvalVariables    `json:"variables"`
+	Payload          PayloadType      `json:"payload"`    // Of the first report.
+	Deliveries       []DeliveryResult `json:"deliveries"` // Of all reports.
+	Reports          []ReportSummary  `json:"reports"`    // Reports sent in the cycle.
+}
+
+// Summary of a single report sent in a cycle.
+type ReportSummary struct {
+	Name             string           `json:"name"`
+	ExpressionErrors int              `json:"expression_errors"`
+	Payload          PayloadType      `json:"payload"`
+	Deliveries       []DeliveryResult `json:"deliveries"`
+}
+
+// Result of sending payload to a single target.
+type DeliveryResult struct {
+	Report     string `json:"report,omitempty"`
+	Target     string `json:"target"`
+	StatusCode int    `json:"status_code,omitempty"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+// Returns true if the payload was accepted by the target.
+func (d DeliveryResult) Succeeded() bool {
+	return d.Error == "" && d.StatusCode >= 200 && d.StatusCode <= 299
+}
+
+// Returns an error describing failed deliveries, if there are any.
+func (s *CycleSummary) Err() error {
+	var failed []string
+	for _, d := range s.Deliveries {
+		if d.Succeeded() {
+			continue
+		}
+
+		reason := d.Error
+		if reason == "" {
+			reason = fmt.Sprintf("status %d", d.StatusCode)
+		}
+		failed = append(failed, fmt.Sprintf("%s (%s)", d.Target, reason))
+	}
+
+	if len(failed) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("payload not delivered to %s", strings.Join(failed, ", "))
+}
+
+// Result of a gatherer's successful run kept for fallback purposes.
+type gathererSnapshot struct {
+	data StringMap
+	at   time.Time
 }
 
 // Struct that allows us to wrap some gatherer's result's with information about
 // the gatherer's original order of execution (within a single gather-loop).
 type OrderedGathererResult struct {
 	index     int
-	gatherer  string
+	gatherer  GathererConfig
 	exitError error
+	exitCode  int
+	stderr    string
+	duration  time.Duration
 	data      StringMap
 }
@@ -1,12 +1,9 @@
 package internal
 
 import (
-	"errors"
-	"fmt"
+	"bytes"
 	"net"
 	"os"
-	"path/filepath"
-	"regexp"
 
 	log "github.com/sirupsen/logrus"
 
@@ -17,27 +14,6 @@ func PrintHeader() {
 	log.Infof("Maxon Reporter-Go [version %s] by Premysl Karbula", ReporterVersion)
 }
 
-func FatalExitOnError(err error) {
-	if err != nil {
-		ErrorExit("Fatal", err.Error())
-	}
-}
-
-func ErrorExit(message ...string) {
-	var msg string
-	argLen := len(message)
-
-	if argLen == 1 {
-		msg = fmt.Sprintln("Error:", message[0])
-	} else if argLen == 2 {
-		msg = fmt.Sprintf("Error [%s]: %s", message[0], message[1])
-	} else {
-		FatalExitOnError(errors.New("zero or too many arguments to ErrorExit()"))
-	}
-
-	log.Fatal(msg)
-}
-
 // Returns true if the path is an existing file that can be opened. Returns
 // false otherwise.
 func IsExistingFile(path string) bool {
@@ -58,43 +34,6 @@ func IsExistingFile(path string) bool {
 	return true
 }
 
-// Regexp replace function supplying the behavior of preg_replace_callback()
-// with also the fact that the callback gets a list of all match groups as the
-// argument.
-func ReplaceAllStringSubmatchFunc(
-	re *regexp.Regexp,
-	str string,
-	repl func([]string) (string, error),
-	limit int,
-) (string, error) {
-	result := ""
-	lastIndex := 0
-
-	for index, v := range re.FindAllSubmatchIndex([]byte(str), -1) {
-		var err error
-		var next string
-
-		groups := []string{}
-		for i := 0; i < len(v); i += 2 {
-			groups = append(groups, str[v[i]:v[i+1]])
-		}
-
-		if limit == -1 || index < limit {
-			next, err = repl(groups)
-			if err != nil {
-				return "", err
-			}
-		} else {
-			next = groups[0]
-		}
-
-		result += str[lastIndex:v[0]] + next
-		lastIndex = v[1]
-	}
-
-	return result + str[lastIndex:], nil
-}
-
 // Takes an ordered list of StringMap structs and puts all their key-value
 // pairs into a single StringMap, which is then returned.
 func MergeResults(results []StringMap) StringMap {
@@ -109,15 +48,15 @@ func MergeResults(results []StringMap) StringMap {
 	return result
 }
 
-// Takes absolute path and tries to make and return a relative path - relative
-// to the path of compiled reporter binary.
-func TryMakingRelativePath(absPath string) string {
-	rel, err := filepath.Rel(Settings.SelfDir, absPath)
-	if err != nil {
-		return absPath
+// Returns true if the string is among the strings.
+func containsString(strs []string, str string) bool {
+	for _, s := range strs {
+		if s == str {
+			return true
+		}
 	}
 
-	return rel
+	return false
 }
 
 // Reads INI values from bytes and returns them as map [string key: string value].
@@ -141,3 +80,32 @@ func isTimeoutError(err error) bool {
 	e, ok := err.(net.Error)
 	return ok && e.Timeout()
 }
+
+// Writer collecting at most "limit" bytes written into it. Anything beyond
+// the limit is silently discarded (writes never fail, so that the writing
+// subprocess is not affected).
+type limitedBuffer struct {
+	buffer    bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	remaining := b.limit - b.buffer.Len()
+	if len(p) > remaining {
+		b.truncated = true
+		b.buffer.Write(p[:remaining])
+	} else {
+		b.buffer.Write(p)
+	}
+
+	return len(p), nil
+}
+
+func (b *limitedBuffer) String() string {
+	if b.truncated {
+		return b.buffer.String() + "... (truncated)"
+	}
+
+	return b.buffer.String()
+}
@@ -1,169 +1,286 @@
 package main
 
 import (
-	"fmt"
-	"net/http"
 	"os"
 	"path"
 	"path/filepath"
 	"reporter/internal"
+	"strings"
 	_ "testing"
-	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/akamensky/argparse"
-	"gopkg.in/natefinch/lumberjack.v2"
 )
 
+// Exit codes of reporter commands.
+const (
+	exitOk          = 0
+	exitFailure     = 1 // Command failed (e.g. payload could not be delivered).
+	exitUsage       = 2 // Invalid CLI arguments.
+	exitNotRunning  = 3 // No reporter daemon is running.
+	exitConfigError = 4 // Config could not be found, parsed or validated.
+)
+
+// Parsed CLI commands and their command-specific arguments.
+type cli struct {
+	validate     *argparse.Command
+	render       *argparse.Command
+	renderConfig *argparse.Command
+	run          *argparse.Command
+	daemon       *argparse.Command
+	stop         *argparse.Command
+	status       *argparse.Command
+	ctl          *argparse.Command
+	eval         *argparse.Command
+
+	validateCheckVars *bool
+	runOnce           *bool
+	ctlCommand        *string
+	ctlSocket         *string
+	ctlJson           *bool
+
+	evalExpression *string
+	evalTemplate   *string
+	evalVarsFile   *string
+}
+
+// Struct representing global Reporter's runtime settings and stuff.
+type reporterSettings struct {
+	SelfDir        string // Directory path where the compiled reporter binary is.
+	ConfigJsonPath string // Populated via CLI argument "--config", if set.
+	VerboseMode    bool   // Populated via CLI argument "--verbose", if set.
+	DaemonMode     bool   // True if "daemon" (unless in systemd mode).
+	SystemdMode    bool   // True if "--systemd" or started by systemd.
+	LogLevel       string // Populated via CLI argument "--log-level", if set.
+	LogPath        string // Populated via CLI argument "--log-path", if set.
+	LogFormat      string // Populated via CLI argument "--log-format", if set.
+	// Populated via CLI arguments "--set key.path=value", if set.
+	ConfigOverrides []string
+}
+
+var settings reporterSettings
+
 func init() {
 	// Print Maxon Reporter text header.
 	internal.PrintHeader()
 }
 
+// Translates arguments of the original flag-based CLI (e.g. "reporter --try")
+// into commands, so that existing setups keep working.
+func translateLegacyArgs(args []string) []string {
+	if len(args) > 1 && !strings.HasPrefix(args[1], "-") {
+		return args
+	}
+
+	command := []string{"daemon"}
+	var rest []string
+	for _, arg := range args[1:] {
+		switch arg {
+		case "-h", "--help":
+			// Show help of the whole CLI.
+			return args
+		case "-t", "--try":
+			// Trying the config must not send anything to the targets.
+			command = []string{"render", "--verbose"}
+		case "-f", "--foreground":
+			if command[0] == "daemon" {
+				command = []string{"run"}
+			}
+		default:
+			rest = append(rest, arg)
+		}
+	}
+
+	return append(append([]string{args[0]}, command...), rest...)
+}
+
 // Separate from init() as we don't want this code (i.e. parsing CLI arguments)
 // to be executed when initializing testing/benchmarks and when this logic was
 // placed inside Go's native init(), the benchmarks wouldn't run when executed
 // via "go test --bench ." for some reason...
-func initialize() {
-	// Define CLI arguments.
+func initialize() *cli {
+	// Define CLI arguments common for all commands.
 	parser := argparse.NewParser("reporter", "Maxon Reporter")
 	configJsonPath := parser.String(
 		"c", "config",
-		&argparse.Options{Required: false, Help: "Path to config.json"},
+		&argparse.Options{Required: false, Help: "Path to config file (JSON, YAML or TOML)"},
 	)
 	verboseMode := parser.Flag(
 		"v", "verbose",
 		&argparse.Options{Required: false, Help: "Enable verbose mode", Default: false},
 	)
-	justTry := parser.Flag(
-		"t", "try",
-		&argparse.Options{Required: false, Help: "Do a single run and exit", Default: false},
-	)
-	foregroundMode := parser.Flag(
-		"f", "foreground",
-		&argparse.Options{Required: false, Help: "Run in foreground without daemonization", Default: false},
+	systemdMode := parser.Flag(
+		"", "systemd",
+		&argparse.Options{Required: false, Help: "Run as systemd service (implied if NOTIFY_SOCKET is set)", Default: false},
 	)
 	logLevels := []string{"info", "debug", "warning", "error"}
 	logLevel := parser.Selector(
 		"l", "log-level", logLevels,
-		&argparse.Options{Required: false, Help: "Set log level", Default: "warning"},
+		&argparse.Options{Required: false, Help: "Set log level (overrides config, 'warning' by default)"},
+	)
+	logPath := parser.String(
+		"", "log-path",
+		&argparse.Options{Required: false, Help: "Path to log file or 'stderr', 'stdout' or 'syslog' (overrides config)"},
+	)
+	logFormat := parser.Selector(
+		"", "log-format", []string{internal.LogFormatText, internal.LogFormatJson},
+		&argparse.Options{Required: false, Help: "Log format (overrides config)"},
+	)
+	configOverrides := parser.StringList(
+		"", "set",
+		&argparse.Options{Required: false, Help: "Override config value as 'key.path=value' (can be repeated, also via REPORTER_SET_key__path env vars)"},
+	)
+
+	// Define commands.
+	c := &cli{}
+	c.validate = parser.NewCommand("validate", "Load and validate config")
+	c.validateCheckVars = c.validate.Flag(
+		"", "check-vars",
+		&argparse.Options{Required: false, Help: "Run gatherers and check they provide all variables used in payload", Default: false},
+	)
+	c.render = parser.NewCommand("render", "Run gatherers and print payload without sending it")
+	c.renderConfig = parser.NewCommand("render-config", "Print config with all included files and config.d fragments merged")
+	c.run = parser.NewCommand("run", "Run in foreground without daemonization")
+	c.runOnce = c.run.Flag(
+		"", "once",
+		&argparse.Options{Required: false, Help: "Do a single run and exit", Default: false},
+	)
+	c.daemon = parser.NewCommand("daemon", "Run as daemon (replacing already running one)")
+	c.stop = parser.NewCommand("stop", "Stop running daemon")
+	c.status = parser.NewCommand("status", "Check if daemon is running")
+	c.ctl = parser.NewCommand("ctl", "Control running reporter via its control socket")
+	c.ctlCommand = c.ctl.SelectorPositional(
+		internal.ControlCommands,
+		&argparse.Options{Required: true, Help: "Command to send"},
+	)
+	c.ctlSocket = c.ctl.String(
+		"s", "socket",
+		&argparse.Options{Required: false, Help: "Path to control socket (overrides config)"},
+	)
+	c.ctlJson = c.ctl.Flag(
+		"j", "json",
+		&argparse.Options{Required: false, Help: "Print raw JSON response", Default: false},
+	)
+
+	c.eval = parser.NewCommand("eval", "Evaluate expressions against variables from gatherers")
+	c.evalExpression = c.eval.StringPositional(
+		&argparse.Options{Required: false, Help: "Expression to evaluate (interactive mode if omitted)"},
+	)
+	c.evalTemplate = c.eval.String(
+		"t", "template",
+		&argparse.Options{Required: false, Help: "Expand all ${...} expressions in the string"},
+	)
+	c.evalVarsFile = c.eval.String(
+		"", "vars",
+		&argparse.Options{Required: false, Help: "Read variables from INI or JSON file instead of running gatherers"},
 	)
 
 	// Parse the arguments.
-	err := parser.Parse(os.Args)
+	err := parser.Parse(translateLegacyArgs(os.Args))
 	if err != nil {
-		log.Fatal(parser.Usage(err))
+		// Asking for help without any command is not an error.
+		if len(os.Args) == 2 && (os.Args[1] == "-h" || os.Args[1] == "--help") {
+			os.Stdout.WriteString(parser.Help(nil))
+			os.Exit(exitOk)
+		}
+		os.Stderr.WriteString(parser.Usage(err))
+		os.Exit(exitUsage)
 	}
 
-	settings := &internal.Settings
-
 	// Determine absolute path to directory of the binary.
 	selfPath, err := os.Executable()
-	internal.FatalExitOnError(err)
-	selfDir, err := filepath.Abs(path.Dir(selfPath))
-	internal.FatalExitOnError(err)
-	settings.SelfDir = selfDir
+	if err == nil {
+		settings.SelfDir, err = filepath.Abs(path.Dir(selfPath))
+	}
+	if err != nil {
+		printError(err)
+		os.Exit(exitFailure)
+	}
 
-	settings.DaemonMode = true
 	settings.VerboseMode = *verboseMode
-	settings.ForegroundMode = *foregroundMode
 	settings.ConfigJsonPath = *configJsonPath
-	settings.JustTry = *justTry
 	settings.LogLevel = *logLevel
+	settings.LogPath = *logPath
+	settings.LogFormat = *logFormat
+	settings.ConfigOverrides = *configOverrides
+	settings.SystemdMode = *systemdMode || internal.IsSystemdNotifyAvailable()
 
-	// Set log level.
-	switch settings.LogLevel {
-	case "info":
-		log.SetLevel(log.InfoLevel)
-	case "debug":
-		log.SetLevel(log.DebugLevel)
-	case "warning":
-		log.SetLevel(log.WarnLevel)
-	case "error":
-		log.SetLevel(log.ErrorLevel)
-	default:
-		log.SetLevel(log.WarnLevel)
-	}
+	// Systemd takes care of running us in background, so we must stay in
+	// foreground and we don't need any PID file.
+	settings.DaemonMode = c.daemon.Happened() && !settings.SystemdMode
 
-	// Set up log rotation
-	log.SetOutput(&lumberjack.Logger{
-		Filename:   filepath.Join(settings.SelfDir, "reporter.log"),
-		MaxSize:    20, // MB
-		MaxBackups: 1,
-		MaxAge:     30, // days
-		Compress:   false,
-	})
-	log.Info("Log rotation enabled.")
-
-	// Force some settings when In "just try" mode.
-	if settings.JustTry {
-		settings.DaemonMode = false
-		settings.VerboseMode = true
-	}
-
-	// Force some settings when In "just try" mode.
-	if settings.ForegroundMode {
-		settings.DaemonMode = false
+	// Until the config is loaded and logging is fully set up, log into stderr
+	// so that problems with config are visible.
+	if level, err := internal.ParseLogLevel(settings.LogLevel); err == nil {
+		log.SetLevel(level)
 	}
 
 	// Force some of the settings for dev builds.
-	if internal.ReporterDevFlag == "1" {
+	if internal.ReporterDevFlag == "1" && settings.ConfigJsonPath == "" && os.Getenv(internal.ConfigPathEnvVar) == "" {
 		// Because the built dev binary is in different directory than
 		// example config, we'll force the example config to be used (unless
-		// overridden with CLI argument). This makes manual testing during
-		// development easier.
-		settings.ConfigJsonPath = filepath.Join(selfDir, "../example/config.json")
+		// overridden with CLI argument or env var). This makes manual testing
+		// during development easier.
+		settings.ConfigJsonPath = filepath.Join(settings.SelfDir, "../example/config.json")
 	}
-}
 
-func main() {
-	initialize()
-
-	settings := &internal.Settings
+	return c
+}
 
-	// If the config JSON file path was not specified via CLI argument, we'll
-	// try to find the config file ourselves.
-	if settings.ConfigJsonPath == "" {
-		settings.ConfigJsonPath = internal.FindConfig()
+// Configures logging according to config, exits on failure.
+func setupLogging(config internal.Config) {
+	if err := configureLogging(config); err != nil {
+		printError(err)
+		os.Exit(exitConfigError)
 	}
+	log.Info("Logging configured.")
+}
 
-	// Do this before daemonization, so that errors in config are visible soon.
-	loadedConfig := internal.LoadConfig(settings.ConfigJsonPath)
-
-	reporter := internal.Reporter{
-		ConfigJson: loadedConfig,
-		HttpClient: &http.Client{
-			Timeout: 1 * time.Minute, // Payload requests will timeout after this.
-		},
+// Configures logging according to config, CLI arguments take precedence.
+func configureLogging(config internal.Config) error {
+	logging := config.Logging
+	if settings.LogPath != "" {
+		logging.Path = settings.LogPath
+	}
+	if settings.LogFormat != "" {
+		logging.Format = settings.LogFormat
+	}
+	if settings.LogLevel != "" {
+		logging.Level = settings.LogLevel
 	}
 
-	reporter.Single()
-
-	if settings.JustTry {
-		return
+	// Under systemd we log into stderr which is collected by journald (unless
+	// explicitly configured otherwise).
+	if settings.SystemdMode && logging.Path == "" {
+		logging.Path = internal.LogDestinationStderr
 	}
 
-	if settings.DaemonMode {
-		weAreTheDaemon, ctx := internal.Daemonize()
-
-		if weAreTheDaemon {
-			// Do our best to remove the PID file when terminating the child
-			// process.
-			defer func() {
-				if err := ctx.Release(); err != nil {
-					log.Errorf("Unable to release PID file: %s", err.Error())
-				}
-			}()
-		} else {
-			// We're the parent process - we'll tell the client the reporter
-			// is being daemonized and then exit.
-			fmt.Println("Daemonizing...")
-			os.Exit(0)
-		}
+	defaultPath := filepath.Join(settings.SelfDir, "reporter.log")
+	return internal.SetupLogging(logging, defaultPath, settings.SystemdMode, config.Redactor())
+}
 
-		log.Warning("Running in daemon mode. PID:", os.Getpid())
-	}
+func main() {
+	c := initialize()
 
-	reporter.Run()
+	switch {
+	case c.validate.Happened():
+		os.Exit(commandValidate(*c.validateCheckVars))
+	case c.render.Happened():
+		os.Exit(commandRender())
+	case c.renderConfig.Happened():
+		os.Exit(commandRenderConfig())
+	case c.run.Happened():
+		os.Exit(commandRun(*c.runOnce))
+	case c.daemon.Happened():
+		os.Exit(commandDaemon())
+	case c.stop.Happened():
+		os.Exit(commandStop())
+	case c.status.Happened():
+		os.Exit(commandStatus())
+	case c.ctl.Happened():
+		os.Exit(commandCtl(*c.ctlCommand, *c.ctlSocket, *c.ctlJson))
+	case c.eval.Happened():
+		os.Exit(commandEval(*c.evalExpression, *c.evalTemplate, *c.evalVarsFile))
+	}
 }
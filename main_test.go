@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTranslateLegacyArgs(t *testing.T) {
+	assert.Equal(t, []string{"reporter", "daemon"}, translateLegacyArgs([]string{"reporter"}))
+	assert.Equal(
+		t,
+		[]string{"reporter", "render", "--verbose", "-c", "config.json"},
+		translateLegacyArgs([]string{"reporter", "-c", "config.json", "--try"}),
+	)
+	assert.Equal(
+		t,
+		[]string{"reporter", "render", "--verbose"},
+		translateLegacyArgs([]string{"reporter", "--try", "--foreground"}),
+	)
+	assert.Equal(
+		t,
+		[]string{"reporter", "run", "-l", "debug"},
+		translateLegacyArgs([]string{"reporter", "-f", "-l", "debug"}),
+	)
+	assert.Equal(
+		t,
+		[]string{"reporter", "daemon", "--systemd"},
+		translateLegacyArgs([]string{"reporter", "--systemd"}),
+	)
+
+	// Commands are kept as-is.
+	assert.Equal(t, []string{"reporter", "render", "-v"}, translateLegacyArgs([]string{"reporter", "render", "-v"}))
+	assert.Equal(t, []string{"reporter", "--help"}, translateLegacyArgs([]string{"reporter", "--help"}))
+}
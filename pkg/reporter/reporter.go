@@ -0,0 +1,110 @@
+// Package reporter allows embedding Maxon Reporter into other programs.
+//
+// Unlike the reporter binary, the package has no global settings and never
+// terminates the process - all problems are returned as errors. Logging is
+// done via the standard logrus logger.
+package reporter
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"reporter/internal"
+	"time"
+)
+
+// Config loaded from config file.
+type Config = internal.Config
+
+// Summary of a single cycle, i.e. variables gathered, payload built and
+// results of its deliveries.
+type Result = internal.CycleSummary
+
+// Result of sending payload to a single target.
+type DeliveryResult = internal.DeliveryResult
+
+// Problems found in config. Errors returned by LoadConfig() wrap this type.
+type ConfigErrors = internal.ConfigErrors
+
+// Value set on top of the loaded config, see ParseConfigOverride().
+type ConfigOverride = internal.ConfigOverride
+
+type Reporter struct {
+	reporter *internal.Reporter
+}
+
+type Option func(*internal.Reporter)
+
+// Sets HTTP client used for sending payloads.
+func WithHttpClient(client *http.Client) Option {
+	return func(r *internal.Reporter) {
+		r.HttpClient = client
+	}
+}
+
+// Sets directory of reporter's own files - the "host-id" file overriding the
+// host ID and the default control socket. Without it, host ID is read only
+// from the system and the control socket is served only if its path is
+// specified in config.
+func WithStateDir(dir string) Option {
+	return func(r *internal.Reporter) {
+		r.StateDir = dir
+	}
+}
+
+// Prints each payload into the writer before it's sent.
+func WithVerboseOutput(w io.Writer) Option {
+	return func(r *internal.Reporter) {
+		r.VerboseOutput = w
+	}
+}
+
+// Reads, parses and validates config file. Overrides are applied on top of it
+// (in order).
+func LoadConfig(path string, overrides ...ConfigOverride) (Config, error) {
+	return internal.ReadConfig(path, overrides...)
+}
+
+// Parses config override in "key.path=value" format, e.g.
+// "payload.machine.name=box" or "target=[\"https://example.com\"]".
+func ParseConfigOverride(arg string) (ConfigOverride, error) {
+	return internal.ParseConfigOverride(arg)
+}
+
+func NewReporter(cfg Config, opts ...Option) *Reporter {
+	r := &internal.Reporter{
+		ConfigJson: cfg,
+		HttpClient: &http.Client{
+			Timeout: 1 * time.Minute,
+		},
+	}
+
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	return &Reporter{reporter: r}
+}
+
+// Does a single cycle - runs gatherers, builds payload and sends it to all
+// targets. Error is returned if the payload wasn't delivered to some of the
+// targets, the result is returned even then.
+func (r *Reporter) RunOnce(ctx context.Context) (Result, error) {
+	summary, err := r.reporter.Single(ctx)
+	if err != nil {
+		return Result{}, err
+	}
+
+	return *summary, summary.Err()
+}
+
+// Does cycles periodically until the context is done, starting with one
+// right away. The control socket and the metrics server are served meanwhile
+// (if enabled in config). Returns the context's error.
+func (r *Reporter) Run(ctx context.Context) error {
+	if _, err := r.reporter.Single(ctx); err != nil {
+		return err
+	}
+
+	return r.reporter.Run(ctx)
+}
@@ -0,0 +1,95 @@
+package reporter
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTestConfig(t *testing.T, targetUrl string) string {
+	dir := t.TempDir()
+
+	gatherer := filepath.Join(dir, "gatherer.sh")
+	os.WriteFile(gatherer, []byte("#!/bin/sh\necho load=2\necho cpus=4\n"), 0755)
+
+	path := filepath.Join(dir, "config.json")
+	os.WriteFile(path, []byte(`{
+		"target": ["`+targetUrl+`"],
+		"gatherers": ["./gatherer.sh"],
+		"payload": {"load": "${100 * load / cpus}"},
+	}`), 0644)
+
+	return path
+}
+
+func TestRunOnce(t *testing.T) {
+	received := make(chan map[string]interface{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		received <- payload
+	}))
+	defer server.Close()
+
+	config, err := LoadConfig(writeTestConfig(t, server.URL))
+	assert.NoError(t, err)
+
+	var verbose strings.Builder
+	r := NewReporter(config, WithVerboseOutput(&verbose))
+	result, err := r.RunOnce(context.Background())
+	assert.NoError(t, err)
+
+	assert.Equal(t, "50", result.Payload["load"])
+	assert.Equal(t, map[string]interface{}{"load": "50"}, <-received)
+	assert.Len(t, result.Deliveries, 1)
+	assert.Equal(t, 200, result.Deliveries[0].StatusCode)
+	assert.Contains(t, verbose.String(), `"load": "50"`)
+}
+
+func TestRunOnceFailedDelivery(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	config, err := LoadConfig(writeTestConfig(t, server.URL))
+	assert.NoError(t, err)
+
+	result, err := NewReporter(config).RunOnce(context.Background())
+	assert.EqualError(t, err, "payload not delivered to "+server.URL+" (status 503)")
+	assert.Equal(t, "50", result.Payload["load"])
+}
+
+func TestRun(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	config, err := LoadConfig(writeTestConfig(t, server.URL))
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	err = NewReporter(config).Run(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(path, []byte(`{"targets": []}`), 0644)
+
+	_, err := LoadConfig(path)
+
+	var errs ConfigErrors
+	assert.ErrorAs(t, err, &errs)
+	assert.Len(t, errs, 1)
+	assert.Equal(t, "unknown key 'targets' (did you mean 'target'?)", errs[0].Msg)
+}